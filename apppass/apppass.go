@@ -0,0 +1,289 @@
+// Package apppass implements application-specific passwords.
+//
+// Each user can have multiple generated passwords, usually one per client
+// application, that can be revoked independently. A password can be
+// restricted to a set of services (AuthReq.Service, e.g. "imap" or
+// "smtp"). Passwords are stored hashed together with a label and creation
+// and last use timestamps.
+//
+// DB implements dovecotsasl.Passdb on top of a Store. It is usually
+// combined with the regular passdb that is used to check that the user
+// exists and to get its extra fields:
+//
+//	db := apppass.New(apppass.NewFileStore("/var/lib/app-passwords.json"), users)
+//	s.AddPassdbMechanisms(db)
+package apppass
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	"github.com/foxcpp/go-dovecot-sasl/pwscheme"
+)
+
+// ErrNotFound is returned by Store.RemovePassword and DB.Revoke if there is
+// no password with the specified ID.
+var ErrNotFound = errors.New("apppass: password not found")
+
+// Password is a single application password.
+type Password struct {
+	// Random identifier, unique for the user.
+	ID string `json:"id"`
+
+	// Human-readable description, e.g. "Thunderbird on laptop".
+	Label string `json:"label"`
+
+	// Stored password in "{SCHEME}data" format.
+	Hash string `json:"hash"`
+
+	// Services the password can be used for. Empty permits all services.
+	Services []string `json:"services,omitempty"`
+
+	Created time.Time `json:"created"`
+
+	// Zero if the password was never used.
+	LastUsed time.Time `json:"last_used"`
+}
+
+// Permits reports whether the password can be used for service.
+func (p *Password) Permits(service string) bool {
+	if len(p.Services) == 0 {
+		return true
+	}
+	for _, s := range p.Services {
+		if strings.EqualFold(s, service) {
+			return true
+		}
+	}
+	return false
+}
+
+// Store keeps application passwords.
+type Store interface {
+	// Passwords returns all passwords of the user. Empty slice is
+	// returned if the user has none.
+	Passwords(ctx context.Context, user string) ([]Password, error)
+
+	AddPassword(ctx context.Context, user string, p Password) error
+
+	// RemovePassword deletes the password, ErrNotFound is returned if
+	// it does not exist.
+	RemovePassword(ctx context.Context, user, id string) error
+
+	// SetLastUsed updates the last use timestamp of the password.
+	SetLastUsed(ctx context.Context, user, id string, t time.Time) error
+}
+
+// DB checks application passwords. It implements dovecotsasl.Passdb.
+type DB struct {
+	Store Store
+
+	// Regular passdb. If not nil, users authenticated using application
+	// passwords are looked up in it to check that they exist and are not
+	// disabled and its extra fields are returned. It must be able to tell
+	// whether the user exists (see dovecotsasl.ErrCredentialsUnavailable),
+	// so e.g. LDAP with authentication binds can not be used.
+	//
+	// Regular passwords are not accepted by DB, use PassdbChain to allow
+	// both.
+	Passdb dovecotsasl.Passdb
+
+	// Scheme used to hash generated passwords, SHA512-CRYPT if not set.
+	Scheme string
+
+	// Number of characters in generated passwords, excluding separators,
+	// 16 if not set.
+	Length int
+
+	now func() time.Time
+}
+
+func New(store Store, db dovecotsasl.Passdb) *DB {
+	return &DB{
+		Store:  store,
+		Passdb: db,
+		Scheme: defaultScheme,
+		Length: defaultLength,
+	}
+}
+
+const (
+	defaultScheme = "SHA512-CRYPT"
+	defaultLength = 16
+)
+
+func (db *DB) clock() time.Time {
+	if db.now == nil {
+		return time.Now()
+	}
+	return db.now()
+}
+
+// passwordAlphabet is used for generated passwords. Lowercase letters are
+// easy to type on mobile devices.
+const passwordAlphabet = "abcdefghijklmnopqrstuvwxyz"
+
+// generatePassword returns a random password with n letters in groups of
+// four separated by dashes, e.g. "abcd-efgh-ijkl-mnop".
+func generatePassword(n int) (string, error) {
+	var b strings.Builder
+	max := big.NewInt(int64(len(passwordAlphabet)))
+	for i := 0; i < n; i++ {
+		if i != 0 && i%4 == 0 {
+			b.WriteByte('-')
+		}
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(passwordAlphabet[idx.Int64()])
+	}
+	return b.String(), nil
+}
+
+func generateID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Generate creates a new password for the user and returns it in
+// plaintext. It can not be recovered later. If services are specified,
+// the password can be used only for them.
+func (db *DB) Generate(ctx context.Context, user, label string, services ...string) (string, *Password, error) {
+	length, scheme := db.Length, db.Scheme
+	if length <= 0 {
+		length = defaultLength
+	}
+	if scheme == "" {
+		scheme = defaultScheme
+	}
+	plain, err := generatePassword(length)
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := generateID()
+	if err != nil {
+		return "", nil, err
+	}
+	hash, err := pwscheme.Generate(scheme, plain)
+	if err != nil {
+		return "", nil, err
+	}
+
+	p := Password{
+		ID:       id,
+		Label:    label,
+		Hash:     hash,
+		Services: services,
+		Created:  db.clock().UTC(),
+	}
+	if err := db.Store.AddPassword(ctx, user, p); err != nil {
+		return "", nil, err
+	}
+	return plain, &p, nil
+}
+
+// Revoke deletes the password.
+func (db *DB) Revoke(ctx context.Context, user, id string) error {
+	return db.Store.RemovePassword(ctx, user, id)
+}
+
+// List returns all passwords of the user.
+func (db *DB) List(ctx context.Context, user string) ([]Password, error) {
+	return db.Store.Passwords(ctx, user)
+}
+
+// userResult looks up the user in the regular passdb.
+func (db *DB) userResult(ctx context.Context, req *dovecotsasl.AuthReq, user string) (*dovecotsasl.PassdbResult, error) {
+	res := &dovecotsasl.PassdbResult{Extra: make(map[string]string)}
+	if db.Passdb == nil {
+		return res, nil
+	}
+
+	userRes, err := db.Passdb.LookupCredentials(ctx, req, user, "PLAIN")
+	switch dovecotsasl.PassdbStatusOf(err) {
+	case dovecotsasl.PassdbOK:
+		res.User = userRes.User
+		for k, v := range userRes.Extra {
+			res.Extra[k] = v
+		}
+	case dovecotsasl.PassdbSchemeNotAvailable:
+		if !dovecotsasl.PassdbUserFound(err) {
+			// The passdb can not tell whether the user exists.
+			return nil, dovecotsasl.ErrUserUnknown
+		}
+		// User exists, but the password is not available in plaintext.
+	default:
+		return nil, err
+	}
+	return res, nil
+}
+
+func (db *DB) VerifyPlain(ctx context.Context, req *dovecotsasl.AuthReq, user, pass string) (*dovecotsasl.PassdbResult, error) {
+	passwords, err := db.Store.Passwords(ctx, user)
+	if err != nil {
+		return nil, dovecotsasl.PassdbInternalError(err)
+	}
+	if len(passwords) == 0 {
+		return nil, dovecotsasl.ErrUserUnknown
+	}
+
+	var service string
+	if req != nil {
+		service = req.Service
+	}
+	for _, p := range passwords {
+		if !p.Permits(service) {
+			continue
+		}
+		ok, err := pwscheme.Verify(p.Hash, db.Scheme, pass)
+		if err != nil {
+			return nil, dovecotsasl.PassdbInternalError(err)
+		}
+		if !ok {
+			continue
+		}
+
+		res, err := db.userResult(ctx, req, user)
+		if err != nil {
+			return nil, err
+		}
+		// Failure to update the timestamp should not prevent the login.
+		_ = db.Store.SetLastUsed(ctx, user, p.ID, db.clock().UTC())
+		res.Extra["app_password"] = p.ID
+		return res, nil
+	}
+	return nil, dovecotsasl.ErrPasswordMismatch
+}
+
+// LookupCredentials only reports whether the user exists: hashed
+// application passwords can not be used with non-plaintext mechanisms, so
+// ErrCredentialsUnavailable is returned for existing users.
+func (db *DB) LookupCredentials(ctx context.Context, req *dovecotsasl.AuthReq, user, scheme string) (*dovecotsasl.PassdbResult, error) {
+	if db.Passdb != nil {
+		_, err := db.Passdb.LookupCredentials(ctx, req, user, "PLAIN")
+		if err == nil {
+			return nil, dovecotsasl.ErrCredentialsUnavailable
+		}
+		// The wrapped passdb may not know whether the user exists.
+		return nil, err
+	}
+
+	passwords, err := db.Store.Passwords(ctx, user)
+	if err != nil {
+		return nil, dovecotsasl.PassdbInternalError(err)
+	}
+	if len(passwords) == 0 {
+		return nil, dovecotsasl.ErrUserUnknown
+	}
+	return nil, dovecotsasl.ErrCredentialsUnavailable
+}
@@ -0,0 +1,181 @@
+package apppass
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// testPassdb knows users, "disabled" users are disabled.
+type testPassdb map[string]string
+
+func (db testPassdb) VerifyPlain(context.Context, *dovecotsasl.AuthReq, string, string) (*dovecotsasl.PassdbResult, error) {
+	return nil, dovecotsasl.ErrPasswordMismatch
+}
+
+func (db testPassdb) LookupCredentials(_ context.Context, _ *dovecotsasl.AuthReq, user, _ string) (*dovecotsasl.PassdbResult, error) {
+	state, ok := db[user]
+	if !ok {
+		return nil, dovecotsasl.ErrUserUnknown
+	}
+	if state == "disabled" {
+		return nil, dovecotsasl.ErrUserDisabled
+	}
+	return &dovecotsasl.PassdbResult{Extra: map[string]string{"quota": state}}, nil
+}
+
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	now := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	db := New(store, testPassdb{"foxcpp": "1G", "disabled": "disabled"})
+	db.Scheme = "SSHA256" // Faster than the default.
+	db.now = func() time.Time { return now }
+
+	imapPass, imapInfo, err := db.Generate(ctx, "foxcpp", "Phone", "imap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imapPass) != 19 {
+		t.Errorf("unexpected password format: %q", imapPass)
+	}
+	anyPass, _, err := db.Generate(ctx, "foxcpp", "Laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	disabledPass, _, err := db.Generate(ctx, "disabled", "Laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imap := &dovecotsasl.AuthReq{Service: "imap"}
+	smtp := &dovecotsasl.AuthReq{Service: "smtp"}
+
+	res, err := db.VerifyPlain(ctx, imap, "foxcpp", imapPass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Extra["app_password"] != imapInfo.ID || res.Extra["quota"] != "1G" {
+		t.Errorf("unexpected extra fields: %v", res.Extra)
+	}
+	if _, err := db.VerifyPlain(ctx, smtp, "foxcpp", imapPass); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("password is not limited to the service: %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, smtp, "foxcpp", anyPass); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.VerifyPlain(ctx, imap, "disabled", disabledPass); !errors.Is(err, dovecotsasl.ErrUserDisabled) {
+		t.Errorf("disabled user is not checked: %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, imap, "nobody", anyPass); !errors.Is(err, dovecotsasl.ErrUserUnknown) {
+		t.Errorf("expected unknown user, got %v", err)
+	}
+	if _, err := db.LookupCredentials(ctx, imap, "foxcpp", "SCRAM-SHA-256"); !errors.Is(err, dovecotsasl.ErrSchemeNotAvailable) {
+		t.Errorf("expected scheme not available, got %v", err)
+	}
+
+	list, err := db.List(ctx, "foxcpp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("unexpected passwords: %+v", list)
+	}
+	for _, p := range list {
+		if p.ID == imapInfo.ID {
+			if p.Label != "Phone" || !p.Created.Equal(now) || !p.LastUsed.Equal(now) || len(p.Services) != 1 {
+				t.Errorf("unexpected password info: %+v", p)
+			}
+		}
+		if p.Hash == imapPass || p.Hash == anyPass {
+			t.Error("password is stored in plaintext")
+		}
+	}
+
+	if err := db.Revoke(ctx, "foxcpp", imapInfo.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Revoke(ctx, "foxcpp", imapInfo.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, imap, "foxcpp", imapPass); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("revoked password is accepted: %v", err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apppass-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testStore(t, NewFileStore(filepath.Join(dir, "passwords.json")))
+}
+
+func TestSQLStore(t *testing.T) {
+	sqlDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	// In-memory database is per-connection.
+	sqlDB.SetMaxOpenConns(1)
+
+	store := NewSQLStore(sqlDB)
+	if err := store.CreateTable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+}
+
+// schemePassdb returns err for all credentials lookups.
+type schemePassdb struct {
+	err error
+}
+
+func (db schemePassdb) VerifyPlain(context.Context, *dovecotsasl.AuthReq, string, string) (*dovecotsasl.PassdbResult, error) {
+	return nil, dovecotsasl.ErrPasswordMismatch
+}
+
+func (db schemePassdb) LookupCredentials(context.Context, *dovecotsasl.AuthReq, string, string) (*dovecotsasl.PassdbResult, error) {
+	return nil, db.err
+}
+
+func TestZeroValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apppass-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	db := &DB{
+		Store:  NewFileStore(filepath.Join(dir, "passwords.json")),
+		Passdb: schemePassdb{dovecotsasl.ErrCredentialsUnavailable},
+	}
+	pass, _, err := db.Generate(ctx, "foxcpp", "Phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pass) != 19 {
+		t.Errorf("unexpected password format: %q", pass)
+	}
+	if _, err := db.VerifyPlain(ctx, nil, "foxcpp", pass); err != nil {
+		t.Error(err)
+	}
+
+	// The passdb can not tell whether the user exists.
+	db.Passdb = schemePassdb{dovecotsasl.ErrSchemeNotAvailable}
+	if _, err := db.VerifyPlain(ctx, nil, "foxcpp", pass); !errors.Is(err, dovecotsasl.ErrUserUnknown) {
+		t.Errorf("expected unknown user, got %v", err)
+	}
+}
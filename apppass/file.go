@@ -0,0 +1,135 @@
+package apppass
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileStore keeps passwords in a JSON file as an object mapping usernames
+// to arrays of passwords.
+//
+// The file is read on each lookup and replaced atomically on changes, so
+// it can be edited by other tools. Concurrent changes from multiple
+// processes are not supported.
+type FileStore struct {
+	Path string
+
+	lock sync.Mutex
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+func (s *FileStore) load() (map[string][]Password, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string][]Password{}, nil
+		}
+		return nil, err
+	}
+	users := map[string][]Password{}
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *FileStore) save(users map[string][]Password) error {
+	data, err := json.MarshalIndent(users, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// update runs f on the file contents and saves them.
+func (s *FileStore) update(f func(users map[string][]Password) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	users, err := s.load()
+	if err != nil {
+		return err
+	}
+	if err := f(users); err != nil {
+		return err
+	}
+	return s.save(users)
+}
+
+func (s *FileStore) Passwords(_ context.Context, user string) ([]Password, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	users, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return users[user], nil
+}
+
+func (s *FileStore) AddPassword(_ context.Context, user string, p Password) error {
+	return s.update(func(users map[string][]Password) error {
+		users[user] = append(users[user], p)
+		return nil
+	})
+}
+
+func (s *FileStore) RemovePassword(_ context.Context, user, id string) error {
+	return s.update(func(users map[string][]Password) error {
+		passwords := users[user]
+		for i, p := range passwords {
+			if p.ID != id {
+				continue
+			}
+			passwords = append(passwords[:i], passwords[i+1:]...)
+			if len(passwords) == 0 {
+				delete(users, user)
+			} else {
+				users[user] = passwords
+			}
+			return nil
+		}
+		return ErrNotFound
+	})
+}
+
+func (s *FileStore) SetLastUsed(_ context.Context, user, id string, t time.Time) error {
+	return s.update(func(users map[string][]Password) error {
+		for i := range users[user] {
+			if users[user][i].ID == id {
+				users[user][i].LastUsed = t
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+}
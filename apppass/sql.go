@@ -0,0 +1,137 @@
+package apppass
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/go-dovecot-sasl/sqldb"
+)
+
+// SQLStore keeps passwords in an SQL table with the following schema:
+//
+//	CREATE TABLE app_passwords (
+//		username TEXT NOT NULL,
+//		id TEXT NOT NULL,
+//		label TEXT NOT NULL,
+//		hash TEXT NOT NULL,
+//		services TEXT NOT NULL, -- comma-separated
+//		created BIGINT NOT NULL, -- Unix time
+//		last_used BIGINT NOT NULL, -- Unix time, 0 if never used
+//		PRIMARY KEY (username, id)
+//	);
+type SQLStore struct {
+	DB *sql.DB
+
+	// Table name, "app_passwords" by default.
+	Table string
+
+	// Placeholder returns the bind parameter marker for n-th (starting from
+	// 1) argument. Defaults to sqldb.QuestionPlaceholder, use
+	// sqldb.DollarPlaceholder for PostgreSQL.
+	Placeholder func(n int) string
+}
+
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{
+		DB:          db,
+		Table:       "app_passwords",
+		Placeholder: sqldb.QuestionPlaceholder,
+	}
+}
+
+// CreateTable creates the table if it does not exist.
+func (s *SQLStore) CreateTable(ctx context.Context) error {
+	_, err := s.DB.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+s.Table+` (
+		username TEXT NOT NULL,
+		id TEXT NOT NULL,
+		label TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		services TEXT NOT NULL,
+		created BIGINT NOT NULL,
+		last_used BIGINT NOT NULL,
+		PRIMARY KEY (username, id)
+	)`)
+	return err
+}
+
+// args returns n comma-separated placeholders.
+func (s *SQLStore) args(n int) string {
+	p := make([]string, n)
+	for i := range p {
+		p[i] = s.Placeholder(i + 1)
+	}
+	return strings.Join(p, ", ")
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0).UTC()
+}
+
+func (s *SQLStore) Passwords(ctx context.Context, user string) ([]Password, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT id, label, hash, services, created, last_used FROM `+s.Table+
+		` WHERE username = `+s.Placeholder(1)+` ORDER BY created`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var passwords []Password
+	for rows.Next() {
+		var (
+			p                 Password
+			services          string
+			created, lastUsed int64
+		)
+		if err := rows.Scan(&p.ID, &p.Label, &p.Hash, &services, &created, &lastUsed); err != nil {
+			return nil, err
+		}
+		if services != "" {
+			p.Services = strings.Split(services, ",")
+		}
+		p.Created = fromUnix(created)
+		p.LastUsed = fromUnix(lastUsed)
+		passwords = append(passwords, p)
+	}
+	return passwords, rows.Err()
+}
+
+func (s *SQLStore) AddPassword(ctx context.Context, user string, p Password) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO `+s.Table+
+		` (username, id, label, hash, services, created, last_used) VALUES (`+s.args(7)+`)`,
+		user, p.ID, p.Label, p.Hash, strings.Join(p.Services, ","), unixTime(p.Created), unixTime(p.LastUsed))
+	return err
+}
+
+func (s *SQLStore) RemovePassword(ctx context.Context, user, id string) error {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM `+s.Table+
+		` WHERE username = `+s.Placeholder(1)+` AND id = `+s.Placeholder(2), user, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) SetLastUsed(ctx context.Context, user, id string, t time.Time) error {
+	_, err := s.DB.ExecContext(ctx, `UPDATE `+s.Table+` SET last_used = `+s.Placeholder(1)+
+		` WHERE username = `+s.Placeholder(2)+` AND id = `+s.Placeholder(3), unixTime(t), user, id)
+	return err
+}
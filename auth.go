@@ -1,6 +1,7 @@
 package dovecotsasl
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net"
@@ -21,6 +22,9 @@ type AuthFail struct {
 	RequestID string
 	Code      FailCode
 	Reason    string
+
+	// Other fields, e.g. "user" or "nologin".
+	Extra map[string]string
 }
 
 func (af AuthFail) Error() string {
@@ -63,6 +67,15 @@ func parseFail(params []string) AuthFail {
 			af.Code = UserDisabled
 		case "pass_expired":
 			af.Code = PassExpired
+		default:
+			if af.Extra == nil {
+				af.Extra = make(map[string]string)
+			}
+			if len(parts) == 1 {
+				af.Extra[parts[0]] = ""
+				continue
+			}
+			af.Extra[parts[0]] = parts[1]
 		}
 	}
 	return af
@@ -77,6 +90,20 @@ func (af AuthFail) format() []string {
 	if af.Code != "" && !strings.ContainsAny(string(af.Code), "\t\n") {
 		params = append(params, "code="+string(af.Code))
 	}
+	for k, v := range af.Extra {
+		switch k {
+		case "", "reason", "code":
+			continue
+		}
+		if strings.ContainsAny(k, "=\t\n") {
+			continue
+		}
+		if v == "" {
+			params = append(params, k)
+			continue
+		}
+		params = append(params, k+"="+v)
+	}
 	return params
 }
 
@@ -84,6 +111,9 @@ type AuthOK struct {
 	RequestID string
 	UserID    string
 	Extra     map[string]string
+
+	// Userdb fields, sent as userdb_* fields.
+	Userdb map[string]string
 }
 
 func parseOk(params []string) AuthOK {
@@ -97,10 +127,26 @@ func parseOk(params []string) AuthOK {
 	}
 	for _, p := range params[1:] {
 		parts := strings.SplitN(p, "=", 2)
+		if len(parts) == 1 {
+			// Flag-only field (e.g. "nologin").
+			parts = append(parts, "")
+		}
 		switch parts[0] {
 		case "userid":
 			ao.UserID = parts[1]
+		case "user":
+			// Sent by Dovecot.
+			if ao.UserID == "" {
+				ao.UserID = parts[1]
+			}
 		default:
+			if strings.HasPrefix(parts[0], userdbPrefix) && len(parts[0]) > len(userdbPrefix) {
+				if ao.Userdb == nil {
+					ao.Userdb = make(map[string]string)
+				}
+				ao.Userdb[parts[0][len(userdbPrefix):]] = parts[1]
+				continue
+			}
 			ao.Extra[parts[0]] = parts[1]
 		}
 	}
@@ -114,11 +160,28 @@ func (ao AuthOK) format() []string {
 		params = append(params, "userid="+ao.UserID)
 	}
 	for k, v := range ao.Extra {
-		if !strings.ContainsAny(k, "=\t\n") || !strings.ContainsAny(v, "=\t\n") {
+		if k == "" || strings.ContainsAny(k, "=\t\n") {
+			continue
+		}
+		if _, ok := ao.Userdb[strings.TrimPrefix(k, userdbPrefix)]; ok && strings.HasPrefix(k, userdbPrefix) {
+			continue
+		}
+		if v == "" {
+			params = append(params, k)
 			continue
 		}
 		params = append(params, k+"="+v)
 	}
+	for k, v := range ao.Userdb {
+		if k == "" || strings.ContainsAny(k, "=\t\n") {
+			continue
+		}
+		if v == "" {
+			params = append(params, userdbPrefix+k)
+			continue
+		}
+		params = append(params, userdbPrefix+k+"="+v)
+	}
 	return params
 }
 
@@ -163,8 +226,107 @@ type AuthReq struct {
 	NoPenalty       bool
 	CertUsername    string
 	ClientID        string // IMAP ID
+	Session         string // Session ID of the login process
 
 	IR []byte
+
+	ctx context.Context
+
+	// Credentials preparation mode, set from Server.Prep.
+	prep PrepMode
+
+	// Master user logins configuration, set from Server.MasterUsers.
+	masterUsers *MasterUsers
+
+	// Authorization policy, set from Server.Authorize.
+	authorize func(req *AuthReq, authcID, authzID string) error
+
+	// Userdb used to check that the authorization identity exists if the
+	// passdb can not tell, set from Server.Userdb.
+	userdb Userdb
+
+	// Passdb extra fields of the successful authentication, used by
+	// PrefetchUserdb.
+	passdbExtra map[string]string
+
+	// Username as provided by the client (after the master user
+	// separator is removed), set by built-in mechanisms.
+	origUser string
+
+	// Master user and the user logged in as during master user logins.
+	masterUser, loginUser string
+}
+
+// Context returns the context of the request. It is canceled when the
+// client connection is closed.
+func (r *AuthReq) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// Vars returns variables for the request and username for use with
+// package expand: user, username, domain, service, mech, lip, rip, lport,
+// rport, secured, cert, client_id, session, orig_user, orig_username,
+// orig_domain, master_user and login_user. orig_* variables refer to the
+// username provided by the client to built-in mechanisms, before changes by
+// UsernameNormalizer. master_user and login_user are set for master user
+// logins. Unset values are omitted. It is valid to call Vars on nil
+// request.
+func (r *AuthReq) Vars(user string) map[string]string {
+	vars := map[string]string{
+		"user":     user,
+		"username": user,
+		"domain":   "",
+	}
+	if idx := strings.LastIndexByte(user, '@'); idx != -1 {
+		vars["username"] = user[:idx]
+		vars["domain"] = user[idx+1:]
+	}
+	orig := user
+	if r != nil && r.origUser != "" {
+		orig = r.origUser
+	}
+	vars["orig_user"], vars["orig_username"], vars["orig_domain"] = orig, orig, ""
+	if idx := strings.LastIndexByte(orig, '@'); idx != -1 {
+		vars["orig_username"] = orig[:idx]
+		vars["orig_domain"] = orig[idx+1:]
+	}
+	if r == nil {
+		return vars
+	}
+	vars["service"] = r.Service
+	vars["mech"] = r.Mechanism
+	if r.LocalIP != nil {
+		vars["lip"] = r.LocalIP.String()
+	}
+	if r.RemoteIP != nil {
+		vars["rip"] = r.RemoteIP.String()
+	}
+	if r.LocalPort != 0 {
+		vars["lport"] = strconv.Itoa(int(r.LocalPort))
+	}
+	if r.RemotePort != 0 {
+		vars["rport"] = strconv.Itoa(int(r.RemotePort))
+	}
+	if r.Secured {
+		vars["secured"] = "secured"
+	}
+	if r.ValidClientCert {
+		vars["cert"] = "valid"
+	}
+	if r.ClientID != "" {
+		vars["client_id"] = r.ClientID
+	}
+	if r.Session != "" {
+		vars["session"] = r.Session
+	}
+	if r.masterUser != "" {
+		vars["master_user"] = r.masterUser
+		vars["login_user"] = r.loginUser
+	}
+	return vars
 }
 
 func parseAuthReq(params []string) (*AuthReq, error) {
@@ -176,23 +338,33 @@ func parseAuthReq(params []string) (*AuthReq, error) {
 		RequestID: params[0],
 		Mechanism: params[1],
 	}
+	if err := req.parseParams(params[2:]); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
 
-	for i, p := range params[2:] {
+// parseParams parses request parameters (service, rip, etc.).
+func (req *AuthReq) parseParams(params []string) error {
+	for i, p := range params {
 		parts := strings.SplitN(p, "=", 2)
 		switch parts[0] {
 		case "resp":
 			if len(parts) != 2 {
-				return nil, fmt.Errorf("dovecotsasl: missing value for resp")
+				return fmt.Errorf("dovecotsasl: missing value for resp")
 			}
-			if i != len(params[2:])-1 {
-				return nil, fmt.Errorf("dovecotsasl: resp should be the last parameter")
+			if i != len(params)-1 {
+				return fmt.Errorf("dovecotsasl: resp should be the last parameter")
 			}
 			resp, err := base64.StdEncoding.DecodeString(parts[1])
 			if err != nil {
-				return nil, fmt.Errorf("dovecotsasl: malformed initial response: %v", err)
+				return fmt.Errorf("dovecotsasl: malformed initial response: %v", err)
 			}
 			req.IR = resp
 		case "service":
+			if len(parts) != 2 {
+				return fmt.Errorf("dovecotsasl: missing value for service")
+			}
 			req.Service = parts[1]
 		case "secured":
 			req.Secured = true
@@ -201,31 +373,31 @@ func parseAuthReq(params []string) (*AuthReq, error) {
 			}
 		case "transport":
 			if len(parts) != 2 {
-				return nil, fmt.Errorf("dovecotsasl: missing transport argument")
+				return fmt.Errorf("dovecotsasl: missing transport argument")
 			}
 			req.Transport = parts[1]
 		case "tls_cipher":
 			if len(parts) != 2 {
-				return nil, fmt.Errorf("dovecotsasl: missing tls_cipher argument")
+				return fmt.Errorf("dovecotsasl: missing tls_cipher argument")
 			}
 			req.TLSCipher = parts[1]
 		case "tls_cipher_bits":
 			if len(parts) != 2 {
-				return nil, fmt.Errorf("dovecotsasl: missing tls_cipher_bits argument")
+				return fmt.Errorf("dovecotsasl: missing tls_cipher_bits argument")
 			}
 			bits, err := strconv.Atoi(parts[1])
 			if err != nil {
-				return nil, fmt.Errorf("dovecotsasl: malformed tls_cipher parameter: %v", err)
+				return fmt.Errorf("dovecotsasl: malformed tls_cipher parameter: %v", err)
 			}
 			req.TLSCipherBits = bits
 		case "tls_pfs":
 			if len(parts) != 2 {
-				return nil, fmt.Errorf("dovecotsasl: missing tls_pfs argument")
+				return fmt.Errorf("dovecotsasl: missing tls_pfs argument")
 			}
 			req.TLSPFS = parts[1]
 		case "tls_protocol":
 			if len(parts) != 2 {
-				return nil, fmt.Errorf("dovecotsasl: missing tls_protocol argument")
+				return fmt.Errorf("dovecotsasl: missing tls_protocol argument")
 			}
 			req.TLSProtocol = parts[1]
 		case "valid-client-cert":
@@ -234,50 +406,106 @@ func parseAuthReq(params []string) (*AuthReq, error) {
 			req.NoPenalty = true
 		case "cert_username":
 			if len(parts) != 2 {
-				return nil, fmt.Errorf("dovecotsasl: missing cert_username argument")
+				return fmt.Errorf("dovecotsasl: missing cert_username argument")
 			}
 			req.CertUsername = parts[1]
 		case "client_id":
 			if len(parts) != 2 {
-				return nil, fmt.Errorf("dovecotsasl: missing client_id argument")
+				return fmt.Errorf("dovecotsasl: missing client_id argument")
 			}
 			req.ClientID = parts[1]
+		case "session":
+			if len(parts) != 2 {
+				return fmt.Errorf("dovecotsasl: missing session argument")
+			}
+			req.Session = parts[1]
 		case "lip":
 			if len(parts) != 2 {
-				return nil, fmt.Errorf("dovecotsasl: missing value for lip")
+				return fmt.Errorf("dovecotsasl: missing value for lip")
 			}
 			req.LocalIP = net.ParseIP(parts[1])
 			if req.LocalIP == nil {
-				return nil, fmt.Errorf("dovecotsasl: malformed lip: %v", parts[1])
+				return fmt.Errorf("dovecotsasl: malformed lip: %v", parts[1])
 			}
 		case "lport":
 			if len(parts) != 2 {
-				return nil, fmt.Errorf("dovecotsasl: missing value for lport")
+				return fmt.Errorf("dovecotsasl: missing value for lport")
 			}
 			val, err := strconv.ParseUint(parts[1], 10, 16)
 			if err != nil {
-				return nil, fmt.Errorf("dovecotsasl: malformed lport: %v", parts[1])
+				return fmt.Errorf("dovecotsasl: malformed lport: %v", parts[1])
 			}
 			req.LocalPort = uint16(val)
 		case "rip":
 			if len(parts) != 2 {
-				return nil, fmt.Errorf("dovecotsasl: missing value for rip")
+				return fmt.Errorf("dovecotsasl: missing value for rip")
 			}
 			req.RemoteIP = net.ParseIP(parts[1])
 			if req.RemoteIP == nil {
-				return nil, fmt.Errorf("dovecotsasl: malformed rip: %v", parts[1])
+				return fmt.Errorf("dovecotsasl: malformed rip: %v", parts[1])
 			}
 		case "rport":
 			if len(parts) != 2 {
-				return nil, fmt.Errorf("dovecotsasl: missing value for rport")
+				return fmt.Errorf("dovecotsasl: missing value for rport")
 			}
 			val, err := strconv.ParseUint(parts[1], 10, 16)
 			if err != nil {
-				return nil, fmt.Errorf("dovecotsasl: malformed rport: %v", parts[1])
+				return fmt.Errorf("dovecotsasl: malformed rport: %v", parts[1])
 			}
 			req.RemotePort = uint16(val)
 		}
 	}
+	return nil
+}
 
-	return &req, nil
+// params formats the request parameters for the AUTH command, excluding
+// request ID, mechanism and initial response.
+func (r *AuthReq) params() []string {
+	params := []string{"service=" + r.Service}
+	if r.LocalIP != nil {
+		params = append(params, "lip="+r.LocalIP.String())
+	}
+	if r.RemoteIP != nil {
+		params = append(params, "rip="+r.RemoteIP.String())
+	}
+	if r.LocalPort != 0 {
+		params = append(params, "lport="+strconv.Itoa(int(r.LocalPort)))
+	}
+	if r.RemotePort != 0 {
+		params = append(params, "rport="+strconv.Itoa(int(r.RemotePort)))
+	}
+	if r.Secured {
+		params = append(params, string(ParamSecured(r.SecuredMethod)))
+	}
+	if r.Transport != "" {
+		params = append(params, "transport="+r.Transport)
+	}
+	if r.TLSCipher != "" {
+		params = append(params, "tls_cipher="+r.TLSCipher)
+	}
+	if r.TLSCipherBits != 0 {
+		params = append(params, "tls_cipher_bits="+strconv.Itoa(r.TLSCipherBits))
+	}
+	if r.TLSPFS != "" {
+		params = append(params, "tls_pfs="+r.TLSPFS)
+	}
+	if r.TLSProtocol != "" {
+		params = append(params, "tls_protocol="+r.TLSProtocol)
+	}
+	if r.ValidClientCert {
+		params = append(params, string(ParamValidClientCert))
+	}
+	if r.NoPenalty {
+		params = append(params, string(ParamNoPenalty))
+	}
+	if r.CertUsername != "" {
+		params = append(params, "cert_username="+r.CertUsername)
+	}
+	if r.ClientID != "" {
+		params = append(params, "client_id="+r.ClientID)
+	}
+	if r.Session != "" {
+		params = append(params, "session="+r.Session)
+	}
+	return params
 }
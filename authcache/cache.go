@@ -0,0 +1,322 @@
+// Package authcache implements the passdb result cache, similar to
+// Dovecot's auth_cache.
+//
+// Successful VerifyPlain results are cached together with the HMAC of the
+// password, the plaintext password is never stored. If the password does
+// not match the cached one, the backend is queried again so password
+// changes take effect immediately.
+//
+// Failures are cached using a separate (usually shorter) TTL. Unknown
+// users are cached regardless of the password, password mismatches and
+// other failures are cached only for the same password (the last wrong
+// password is remembered for users with a cached successful result).
+// Internal failures are never cached.
+//
+// LookupCredentials results are cached for all schemes except PLAIN (to
+// avoid keeping plaintext passwords in memory).
+//
+// Entries are flushed by the username, both the requested one and the one
+// returned by the passdb (PassdbResult.User) are recognized. Failed
+// lookups are only known by the requested username, so
+// dovecotsasl.UsernameNormalizer should wrap the cache for CACHE-FLUSH to
+// work with canonical usernames.
+//
+// Passdbs accepting one-time codes (e.g. package totp) must wrap the cache
+// instead of being wrapped by it, cached results would allow code reuse
+// otherwise.
+package authcache
+
+import (
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"strings"
+	"sync"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	"github.com/foxcpp/go-dovecot-sasl/expand"
+)
+
+// Cache wraps a Passdb. It implements dovecotsasl.Passdb and
+// dovecotsasl.CacheFlusher.
+type Cache struct {
+	Passdb dovecotsasl.Passdb
+
+	// Key template, e.g. "%u\t%{service}\t%{rip}". It should include all
+	// variables used by the backend that affect the result.
+	Key string
+
+	// TTL for successful and failed lookups.
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	// Maximum number of entries, least recently used entries are evicted
+	// first.
+	Size int
+
+	initOnce sync.Once
+	hmacKey  []byte
+
+	lock    sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	byUser  map[string]map[string]struct{}
+
+	now func() time.Time
+}
+
+type entry struct {
+	key string
+
+	// Usernames the entry is flushed by: the requested one and the
+	// canonical one from the result, if different.
+	users []string
+
+	expires time.Time
+
+	// Positive entries.
+	res *dovecotsasl.PassdbResult
+
+	// Negative entries.
+	err error
+
+	// HMAC of the password, nil for LookupCredentials entries and unknown
+	// users.
+	passMAC []byte
+
+	// Last wrong password for positive entries.
+	failMAC     []byte
+	failErr     error
+	failExpires time.Time
+}
+
+func New(db dovecotsasl.Passdb) *Cache {
+	return &Cache{
+		Passdb:      db,
+		Key:         "%u",
+		TTL:         time.Hour,
+		NegativeTTL: time.Hour,
+		Size:        10000,
+		now:         time.Now,
+	}
+}
+
+func (c *Cache) init() {
+	c.hmacKey = make([]byte, 32)
+	if _, err := rand.Read(c.hmacKey); err != nil {
+		panic(err)
+	}
+	c.lru = list.New()
+	c.entries = make(map[string]*list.Element)
+	c.byUser = make(map[string]map[string]struct{})
+	if c.now == nil {
+		c.now = time.Now
+	}
+}
+
+func (c *Cache) passMAC(pass string) []byte {
+	h := hmac.New(sha256.New, c.hmacKey)
+	h.Write([]byte(pass))
+	return h.Sum(nil)
+}
+
+// key returns the cache key for the request. kind distinguishes
+// VerifyPlain and LookupCredentials entries.
+func (c *Cache) key(req *dovecotsasl.AuthReq, user, kind string) string {
+	return kind + "\x00" + expand.Expand(c.Key, req.Vars(user), nil)
+}
+
+// get returns the unexpired entry for the key.
+func (c *Cache) get(key string) *entry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := elem.Value.(*entry)
+	if c.now().After(e.expires) {
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return e
+}
+
+func (c *Cache) put(e *entry) {
+	ttl := c.TTL
+	if e.err != nil {
+		ttl = c.NegativeTTL
+	}
+	if ttl <= 0 || c.Size <= 0 {
+		return
+	}
+	e.expires = c.now().Add(ttl)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.entries[e.key]; ok {
+		// Wrong password should not evict the cached successful result,
+		// it is remembered separately instead.
+		if old := elem.Value.(*entry); e.err != nil && e.passMAC != nil && old.err == nil {
+			old.failMAC, old.failErr, old.failExpires = e.passMAC, e.err, e.expires
+			return
+		}
+		c.remove(elem)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for _, user := range e.users {
+		keys := c.byUser[user]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			c.byUser[user] = keys
+		}
+		keys[e.key] = struct{}{}
+	}
+
+	for c.lru.Len() > c.Size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove deletes the entry, c.lock should be held.
+func (c *Cache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*entry)
+	delete(c.entries, e.key)
+	for _, user := range e.users {
+		if keys := c.byUser[user]; keys != nil {
+			delete(keys, e.key)
+			if len(keys) == 0 {
+				delete(c.byUser, user)
+			}
+		}
+	}
+}
+
+// entryUsers returns usernames for the entry with the result res.
+func entryUsers(user string, res *dovecotsasl.PassdbResult) []string {
+	if res != nil && res.User != "" && res.User != user {
+		return []string{user, res.User}
+	}
+	return []string{user}
+}
+
+// FlushUser removes all entries for the user and returns their count.
+func (c *Cache) FlushUser(user string) int {
+	c.initOnce.Do(c.init)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	keys := c.byUser[user]
+	n := len(keys)
+	for key := range keys {
+		c.remove(c.entries[key])
+	}
+	return n
+}
+
+// FlushAll removes all entries and returns their count.
+func (c *Cache) FlushAll() int {
+	c.initOnce.Do(c.init)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := c.lru.Len()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.byUser = make(map[string]map[string]struct{})
+	return n
+}
+
+// Len returns the number of entries in the cache, including expired ones
+// that were not evicted yet.
+func (c *Cache) Len() int {
+	c.initOnce.Do(c.init)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+// copyResult returns a copy of res so the cached value is not modified by
+// callers.
+func copyResult(res *dovecotsasl.PassdbResult) *dovecotsasl.PassdbResult {
+	if res == nil {
+		return &dovecotsasl.PassdbResult{}
+	}
+	cpy := *res
+	if res.Credentials != nil {
+		cpy.Credentials = append([]byte(nil), res.Credentials...)
+	}
+	if res.Extra != nil {
+		cpy.Extra = make(map[string]string, len(res.Extra))
+		for k, v := range res.Extra {
+			cpy.Extra[k] = v
+		}
+	}
+	return &cpy
+}
+
+func (c *Cache) VerifyPlain(ctx context.Context, req *dovecotsasl.AuthReq, user, pass string) (*dovecotsasl.PassdbResult, error) {
+	c.initOnce.Do(c.init)
+	key := c.key(req, user, "pass")
+	mac := c.passMAC(pass)
+
+	if e := c.get(key); e != nil {
+		c.lock.Lock()
+		failed := e.failMAC != nil && hmac.Equal(e.failMAC, mac) && !c.now().After(e.failExpires)
+		failErr := e.failErr
+		c.lock.Unlock()
+
+		switch {
+		case e.err != nil && e.passMAC == nil:
+			return nil, e.err
+		case hmac.Equal(e.passMAC, mac):
+			if e.err != nil {
+				return nil, e.err
+			}
+			return copyResult(e.res), nil
+		case failed:
+			return nil, failErr
+		}
+		// Different password, it might have been changed.
+	}
+
+	res, err := c.Passdb.VerifyPlain(ctx, req, user, pass)
+	switch dovecotsasl.PassdbStatusOf(err) {
+	case dovecotsasl.PassdbOK:
+		c.put(&entry{key: key, users: entryUsers(user, res), res: copyResult(res), passMAC: mac})
+	case dovecotsasl.PassdbInternalFailure:
+	case dovecotsasl.PassdbUserUnknown:
+		c.put(&entry{key: key, users: []string{user}, err: err})
+	default:
+		c.put(&entry{key: key, users: []string{user}, err: err, passMAC: mac})
+	}
+	return res, err
+}
+
+func (c *Cache) LookupCredentials(ctx context.Context, req *dovecotsasl.AuthReq, user, scheme string) (*dovecotsasl.PassdbResult, error) {
+	c.initOnce.Do(c.init)
+	scheme = strings.ToUpper(scheme)
+	if scheme == "PLAIN" {
+		return c.Passdb.LookupCredentials(ctx, req, user, scheme)
+	}
+	key := c.key(req, user, "creds:"+scheme)
+
+	if e := c.get(key); e != nil {
+		if e.err != nil {
+			return nil, e.err
+		}
+		return copyResult(e.res), nil
+	}
+
+	res, err := c.Passdb.LookupCredentials(ctx, req, user, scheme)
+	switch dovecotsasl.PassdbStatusOf(err) {
+	case dovecotsasl.PassdbOK:
+		c.put(&entry{key: key, users: entryUsers(user, res), res: copyResult(res)})
+	case dovecotsasl.PassdbInternalFailure:
+	default:
+		c.put(&entry{key: key, users: []string{user}, err: err})
+	}
+	return res, err
+}
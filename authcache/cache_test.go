@@ -0,0 +1,185 @@
+package authcache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+)
+
+type countingPassdb struct {
+	users map[string]string
+	calls int
+	err   error
+}
+
+func (db *countingPassdb) VerifyPlain(_ context.Context, _ *dovecotsasl.AuthReq, user, pass string) (*dovecotsasl.PassdbResult, error) {
+	db.calls++
+	if db.err != nil {
+		return nil, db.err
+	}
+	stored, ok := db.users[user]
+	if !ok {
+		return nil, dovecotsasl.ErrUserUnknown
+	}
+	if err := dovecotsasl.VerifyPassword(stored, "PLAIN", pass); err != nil {
+		return nil, err
+	}
+	return &dovecotsasl.PassdbResult{Extra: map[string]string{"quota": "1G"}}, nil
+}
+
+func (db *countingPassdb) LookupCredentials(_ context.Context, _ *dovecotsasl.AuthReq, user, scheme string) (*dovecotsasl.PassdbResult, error) {
+	db.calls++
+	stored, ok := db.users[user]
+	if !ok {
+		return nil, dovecotsasl.ErrUserUnknown
+	}
+	creds, err := dovecotsasl.PasswordCredentials(stored, "PLAIN", scheme)
+	if err != nil {
+		return nil, err
+	}
+	return &dovecotsasl.PassdbResult{Credentials: creds}, nil
+}
+
+func TestCache(t *testing.T) {
+	backend := &countingPassdb{users: map[string]string{"foxcpp": "1234"}}
+	c := New(backend)
+	c.TTL = time.Minute
+	c.NegativeTTL = 10 * time.Second
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	verify := func(user, pass string, wantErr error, wantCalls int) {
+		t.Helper()
+		res, err := c.VerifyPlain(ctx, nil, user, pass)
+		if wantErr == nil && err != nil {
+			t.Errorf("VerifyPlain(%s, %s): %v", user, pass, err)
+		}
+		if wantErr != nil && !errors.Is(err, wantErr) {
+			t.Errorf("VerifyPlain(%s, %s): expected %v, got %v", user, pass, wantErr, err)
+		}
+		if err == nil && res.Extra["quota"] != "1G" {
+			t.Errorf("VerifyPlain(%s, %s): unexpected extra fields: %v", user, pass, res.Extra)
+		}
+		if backend.calls != wantCalls {
+			t.Errorf("VerifyPlain(%s, %s): backend called %d times, want %d", user, pass, backend.calls, wantCalls)
+		}
+	}
+
+	verify("foxcpp", "1234", nil, 1)
+	verify("foxcpp", "1234", nil, 1)
+	// Different password is always checked by the backend.
+	verify("foxcpp", "5678", dovecotsasl.ErrPasswordMismatch, 2)
+	verify("foxcpp", "5678", dovecotsasl.ErrPasswordMismatch, 2)
+	verify("nobody", "1234", dovecotsasl.ErrUserUnknown, 3)
+	verify("nobody", "5678", dovecotsasl.ErrUserUnknown, 3)
+
+	// Negative TTL expires first.
+	now = now.Add(30 * time.Second)
+	verify("nobody", "1234", dovecotsasl.ErrUserUnknown, 4)
+	verify("foxcpp", "1234", nil, 4)
+	now = now.Add(time.Minute)
+	verify("foxcpp", "1234", nil, 5)
+
+	// Password change.
+	backend.users["foxcpp"] = "abcd"
+	verify("foxcpp", "abcd", nil, 6)
+	verify("foxcpp", "abcd", nil, 6)
+
+	// Internal failures are not cached.
+	backend.err = dovecotsasl.PassdbInternalError(errors.New("connection refused"))
+	verify("other", "1234", backend.err, 7)
+	verify("other", "1234", backend.err, 8)
+	backend.err = nil
+
+	if n := c.FlushUser("foxcpp"); n != 1 {
+		t.Errorf("FlushUser returned %d, want 1", n)
+	}
+	verify("foxcpp", "abcd", nil, 9)
+	if n := c.FlushAll(); n != 2 {
+		t.Errorf("FlushAll returned %d, want 2", n)
+	}
+	verify("foxcpp", "abcd", nil, 10)
+
+	// PLAIN credentials are not cached, other schemes are.
+	for i := 0; i < 2; i++ {
+		if _, err := c.LookupCredentials(ctx, nil, "foxcpp", "PLAIN"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.LookupCredentials(ctx, nil, "foxcpp", "CRAM-MD5"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if backend.calls != 13 {
+		t.Errorf("backend called %d times, want 13", backend.calls)
+	}
+}
+
+func TestCacheKeyAndSize(t *testing.T) {
+	backend := &countingPassdb{users: map[string]string{"foxcpp": "1234", "other": "1234"}}
+	c := New(backend)
+	c.Key = "%u\t%{service}\t%{rip}"
+	c.Size = 2
+	ctx := context.Background()
+
+	req1 := &dovecotsasl.AuthReq{Service: "imap", RemoteIP: net.IPv4(192, 0, 2, 1)}
+	req2 := &dovecotsasl.AuthReq{Service: "imap", RemoteIP: net.IPv4(192, 0, 2, 2)}
+	for _, req := range []*dovecotsasl.AuthReq{req1, req2, req1, req2} {
+		if _, err := c.VerifyPlain(ctx, req, "foxcpp", "1234"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if backend.calls != 2 {
+		t.Errorf("backend called %d times, want 2", backend.calls)
+	}
+
+	if _, err := c.VerifyPlain(ctx, req1, "other", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Len() != 2 {
+		t.Errorf("cache has %d entries, want 2", c.Len())
+	}
+	// req1 entry for foxcpp was the least recently used one.
+	if _, err := c.VerifyPlain(ctx, req2, "foxcpp", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if backend.calls != 3 {
+		t.Errorf("backend called %d times, want 3", backend.calls)
+	}
+	if _, err := c.VerifyPlain(ctx, req1, "foxcpp", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if backend.calls != 4 {
+		t.Errorf("backend called %d times, want 4", backend.calls)
+	}
+}
+
+func TestCacheFlushCanonicalUser(t *testing.T) {
+	backend := &countingPassdb{users: map[string]string{"foxcpp": "1234"}}
+	c := New(dovecotsasl.NewUsernameNormalizer(backend))
+	ctx := context.Background()
+
+	if _, err := c.VerifyPlain(ctx, nil, "FoxCPP", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.FlushUser("foxcpp"); n != 1 {
+		t.Errorf("FlushUser by the canonical username returned %d, want 1", n)
+	}
+	if n := c.Len(); n != 0 {
+		t.Errorf("%d entries left after flush", n)
+	}
+
+	if _, err := c.VerifyPlain(ctx, nil, "FoxCPP", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.FlushUser("FoxCPP"); n != 1 {
+		t.Errorf("FlushUser by the requested username returned %d, want 1", n)
+	}
+	if backend.calls != 2 {
+		t.Errorf("backend called %d times, want 2", backend.calls)
+	}
+}
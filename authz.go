@@ -0,0 +1,218 @@
+package dovecotsasl
+
+import (
+	"errors"
+	"strings"
+)
+
+// errAuthzNotPermitted is reported if the authenticated user is not
+// allowed to act as the requested authorization identity.
+var errAuthzNotPermitted = AuthFail{
+	Code:   AuthzFail,
+	Reason: "not authorized to act as the requested user",
+}
+
+// authUserField is the extra field containing the authentication identity
+// if it differs from the authorized user.
+const authUserField = "auth_user"
+
+// AuthzRules is a rule-based authorization policy. Its Authorize method
+// can be used as Server.Authorize.
+//
+// Acting as oneself is always permitted.
+type AuthzRules struct {
+	// Users permitted to act as any user in their domain, e.g.
+	// "postmaster@example.org".
+	DomainAdmins []string
+
+	// Users permitted to act as the key user, e.g.
+	// {"sales@example.org": {"alice@example.org", "bob@example.org"}}.
+	Delegations map[string][]string
+}
+
+func domainOf(user string) string {
+	at := strings.LastIndexByte(user, '@')
+	if at == -1 {
+		return ""
+	}
+	return user[at+1:]
+}
+
+// Authorize checks whether authcID is allowed to act as authzID.
+func (r *AuthzRules) Authorize(req *AuthReq, authcID, authzID string) error {
+	if authcID == authzID {
+		return nil
+	}
+	for _, admin := range r.DomainAdmins {
+		if admin != authcID {
+			continue
+		}
+		domain := domainOf(authcID)
+		if domain != "" && strings.EqualFold(domain, domainOf(authzID)) {
+			return nil
+		}
+	}
+	for _, delegate := range r.Delegations[authzID] {
+		if delegate == authcID {
+			return nil
+		}
+	}
+	return errAuthzNotPermitted
+}
+
+// authzFailure converts the error returned by the authorization policy.
+// Passdb errors (e.g. internal failures) and AuthFail are kept as is, all
+// other errors are reported as errAuthzNotPermitted.
+func authzFailure(err error) error {
+	var (
+		af AuthFail
+		pe *PassdbError
+	)
+	if errors.As(err, &af) || errors.As(err, &pe) {
+		return err
+	}
+	return errAuthzNotPermitted
+}
+
+// login is the resolved login of a built-in mechanism.
+type login struct {
+	req *AuthReq
+	// Regular passdb of the mechanism.
+	db Passdb
+
+	// Authentication identity.
+	user string
+	// Authorization identity if it differs from user.
+	target string
+	// Set if target was specified using MasterUsers.Separator.
+	separator bool
+	// Set if user was authenticated by MasterUsers.Passdb.
+	master bool
+}
+
+// resolveLogin splits the master user login and checks whether logging in
+// as authzID can be permitted at all, errAuthzNotPermitted is returned
+// otherwise.
+func (r *AuthReq) resolveLogin(db Passdb, authzID, user string) (*login, error) {
+	l := &login{req: r, db: db, user: user}
+
+	m := r.masterUsers
+	if m != nil && m.Separator != "" && authzID == "" {
+		if i := strings.LastIndex(user, m.Separator); i > 0 && i+len(m.Separator) < len(user) {
+			authzID, l.user = user[:i], user[i+len(m.Separator):]
+			l.separator = true
+		}
+	}
+	r.origUser = l.user
+	if authzID == "" || authzID == l.user {
+		return l, nil
+	}
+	if (m == nil || m.Passdb == nil) && r.authorize == nil {
+		return nil, errAuthzNotPermitted
+	}
+	l.target = authzID
+	return l, nil
+}
+
+// lookup runs f against the passdb that should authenticate the user.
+//
+// If the authorization identity is given, the user is looked up in the
+// master passdb first. Users unknown to it are looked up in the regular
+// passdb and then checked using Server.Authorize, unless the separator was
+// used.
+func (l *login) lookup(f func(db Passdb) (*PassdbResult, error)) (*PassdbResult, error) {
+	if m := l.req.masterUsers; l.target != "" && m != nil && m.Passdb != nil {
+		l.req.masterUser, l.req.loginUser = l.user, l.target
+		res, err := f(m.Passdb)
+		if l.separator || l.req.authorize == nil || !errors.Is(err, ErrUserUnknown) {
+			l.master = err == nil
+			if !l.master {
+				l.req.masterUser, l.req.loginUser = "", ""
+			}
+			return res, err
+		}
+		l.req.masterUser, l.req.loginUser = "", ""
+	}
+	return f(l.db)
+}
+
+func (l *login) verifyPlain(pass string) (*PassdbResult, error) {
+	return l.lookup(func(db Passdb) (*PassdbResult, error) {
+		return db.VerifyPlain(l.req.Context(), l.req, l.user, pass)
+	})
+}
+
+func (l *login) lookupCredentials(scheme string) (*PassdbResult, error) {
+	return l.lookup(func(db Passdb) (*PassdbResult, error) {
+		return db.LookupCredentials(l.req.Context(), l.req, l.user, scheme)
+	})
+}
+
+// lookupTarget checks that the authorization identity exists and returns
+// its passdb result, if available.
+//
+// If the passdb does not tell whether the user exists (e.g. LDAP with
+// authentication binds), the user is looked up in Server.Userdb and
+// rejected if there is none.
+func (l *login) lookupTarget() (*PassdbResult, error) {
+	res, err := l.db.LookupCredentials(l.req.Context(), l.req, l.target, "PLAIN")
+	if PassdbStatusOf(err) != PassdbSchemeNotAvailable {
+		return res, err
+	}
+	if PassdbUserFound(err) {
+		// User exists, but the password is not available in plaintext.
+		return nil, nil
+	}
+	if l.req.userdb == nil {
+		return nil, ErrUserUnknown
+	}
+	if _, err := l.req.userdb.LookupUser(l.req.Context(), l.req, l.target); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// success reports the successful authentication with result res. If the
+// authorization identity is given, the policy is checked and the target
+// user is reported instead.
+func (l *login) success(cb FuncSASLCallback, res *PassdbResult) error {
+	if l.target == "" {
+		passdbSuccess(cb, l.user, res)
+		return nil
+	}
+
+	authcID := l.user
+	if res.User != "" {
+		authcID = res.User
+	}
+	authorize, field := l.req.authorize, authUserField
+	if l.master {
+		authorize, field = l.req.masterUsers.Authorize, masterUserField
+	} else if authorize == nil {
+		return errAuthzNotPermitted
+	}
+	if authorize != nil {
+		if err := authorize(l.req, authcID, l.target); err != nil {
+			return authzFailure(err)
+		}
+	}
+
+	targetRes, err := l.lookupTarget()
+	if err != nil {
+		return err
+	}
+
+	user := l.target
+	extra := make(map[string]string)
+	if targetRes != nil {
+		if targetRes.User != "" {
+			user = targetRes.User
+		}
+		for k, v := range targetRes.Extra {
+			extra[k] = v
+		}
+	}
+	extra[field] = authcID
+	cb(user, extra)
+	return nil
+}
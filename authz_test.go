@@ -0,0 +1,156 @@
+package dovecotsasl
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+)
+
+func TestAuthzRules(t *testing.T) {
+	rules := &AuthzRules{
+		DomainAdmins: []string{"postmaster@example.org"},
+		Delegations:  map[string][]string{"sales@example.com": {"alice@example.org"}},
+	}
+
+	cases := []struct {
+		authcID, authzID string
+		ok               bool
+	}{
+		{"alice@example.org", "alice@example.org", true},
+		{"postmaster@example.org", "alice@example.org", true},
+		{"postmaster@example.org", "bob@Example.ORG", true},
+		{"postmaster@example.org", "sales@example.com", false},
+		{"alice@example.org", "sales@example.com", true},
+		{"bob@example.org", "sales@example.com", false},
+		{"alice@example.org", "bob@example.org", false},
+	}
+	for _, c := range cases {
+		err := rules.Authorize(nil, c.authcID, c.authzID)
+		if c.ok && err != nil {
+			t.Errorf("%s as %s: unexpected error: %v", c.authcID, c.authzID, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s as %s: expected an error", c.authcID, c.authzID)
+		}
+	}
+}
+
+func TestAuthz(t *testing.T) {
+	s := NewServer()
+	s.AddPassdbMechanisms(testPassdb{
+		"alice@example.org":      "1234",
+		"bob@example.org":        "5678",
+		"postmaster@example.org": "admin",
+		"sales@example.com":      "sales",
+	})
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectAuthzFail := func(name string, err error) {
+		t.Helper()
+		var af AuthFail
+		if !errors.As(err, &af) || af.Code != AuthzFail {
+			t.Errorf("%s: expected authz_fail, got %v", name, err)
+		}
+	}
+
+	// No policy, only the same user is permitted.
+	if _, err := cl.Do("imap", sasl.NewPlainClient("alice@example.org", "alice@example.org", "1234")); err != nil {
+		t.Error(err)
+	}
+	_, err = cl.Do("imap", sasl.NewPlainClient("bob@example.org", "alice@example.org", "1234"))
+	expectAuthzFail("no policy", err)
+
+	s.Authorize = (&AuthzRules{
+		DomainAdmins: []string{"postmaster@example.org"},
+		Delegations:  map[string][]string{"sales@example.com": {"alice@example.org"}},
+	}).Authorize
+
+	res, err := cl.Do("imap", sasl.NewPlainClient("sales@example.com", "alice@example.org", "1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.UserID != "sales@example.com" || res.Extra["auth_user"] != "alice@example.org" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	_, res, err = cl.Authenticate("imap", Credentials{AuthzID: "bob@example.org", Username: "postmaster@example.org", Password: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.UserID != "bob@example.org" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	_, err = cl.Do("imap", sasl.NewPlainClient("sales@example.com", "bob@example.org", "5678"))
+	expectAuthzFail("PLAIN", err)
+	_, _, err = cl.Authenticate("imap", Credentials{AuthzID: "sales@example.com", Username: "bob@example.org", Password: "5678"})
+	expectAuthzFail("SCRAM", err)
+
+	// Policy is checked only after the successful authentication.
+	_, err = cl.Do("imap", sasl.NewPlainClient("sales@example.com", "bob@example.org", "wrong"))
+	var af AuthFail
+	if !errors.As(err, &af) || af.Code == AuthzFail {
+		t.Errorf("wrong password: expected authentication failure, got %v", err)
+	}
+}
+
+// bindPassdb never returns credentials, like LDAP with authentication
+// binds, so it can not tell whether the user exists.
+type bindPassdb struct {
+	testPassdb
+}
+
+func (db bindPassdb) LookupCredentials(context.Context, *AuthReq, string, string) (*PassdbResult, error) {
+	return nil, ErrSchemeNotAvailable
+}
+
+func TestAuthzTargetExists(t *testing.T) {
+	users := testPassdb{
+		"postmaster@example.org": "admin",
+		"bob@example.org":        "5678",
+		"hashed@example.org":     "{SHA512-CRYPT}$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+	}
+
+	s := NewServer()
+	s.AddPassdbMechanisms(users)
+	s.Authorize = (&AuthzRules{DomainAdmins: []string{"postmaster@example.org"}}).Authorize
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cl.Do("imap", sasl.NewPlainClient("hashed@example.org", "postmaster@example.org", "admin")); err != nil {
+		t.Errorf("user without plaintext password: %v", err)
+	}
+	if _, err := cl.Do("imap", sasl.NewPlainClient("nobody@example.org", "postmaster@example.org", "admin")); err == nil {
+		t.Error("unknown user is accepted")
+	}
+
+	s.AddPassdbMechanisms(bindPassdb{users})
+	if _, err := cl.Do("imap", sasl.NewPlainClient("bob@example.org", "postmaster@example.org", "admin")); err == nil {
+		t.Error("user is accepted without userdb")
+	}
+
+	s.Userdb = testUserdb{"bob@example.org": {"home": "/home/bob"}}
+	if _, err := cl.Do("imap", sasl.NewPlainClient("bob@example.org", "postmaster@example.org", "admin")); err != nil {
+		t.Errorf("user known to userdb: %v", err)
+	}
+	if _, err := cl.Do("imap", sasl.NewPlainClient("nobody@example.org", "postmaster@example.org", "admin")); err == nil {
+		t.Error("unknown user is accepted")
+	}
+}
@@ -0,0 +1,328 @@
+package dovecotsasl
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// ChainResult is the action taken by PassdbChain after a passdb lookup,
+// mirrors Dovecot's result_success, result_failure and result_internalfail
+// settings.
+type ChainResult int
+
+const (
+	// ResultDefault is return-ok for success and continue for failures.
+	ResultDefault ChainResult = iota
+
+	// ResultContinue proceeds to the next passdb without changing the
+	// authentication state. If the password was verified, the following
+	// passdbs skip password verification.
+	ResultContinue
+
+	// ResultContinueOK sets the authentication state to success and
+	// proceeds to the next passdb. The following passdbs skip password
+	// verification.
+	ResultContinueOK
+
+	// ResultContinueFail sets the authentication state to failure and
+	// proceeds to the next passdb.
+	ResultContinueFail
+
+	// ResultReturnOK stops and returns success.
+	ResultReturnOK
+
+	// ResultReturnFail stops and returns failure.
+	ResultReturnFail
+)
+
+func (r ChainResult) String() string {
+	switch r {
+	case ResultDefault:
+		return "default"
+	case ResultContinue:
+		return "continue"
+	case ResultContinueOK:
+		return "continue-ok"
+	case ResultContinueFail:
+		return "continue-fail"
+	case ResultReturnOK:
+		return "return-ok"
+	case ResultReturnFail:
+		return "return-fail"
+	}
+	return fmt.Sprintf("ChainResult(%d)", int(r))
+}
+
+// ParseChainResult parses the Dovecot action name (e.g. "continue-ok").
+func ParseChainResult(s string) (ChainResult, error) {
+	switch s {
+	case "", "default":
+		return ResultDefault, nil
+	case "continue":
+		return ResultContinue, nil
+	case "continue-ok":
+		return ResultContinueOK, nil
+	case "continue-fail":
+		return ResultContinueFail, nil
+	case "return-ok":
+		return ResultReturnOK, nil
+	case "return-fail":
+		return ResultReturnFail, nil
+	}
+	return 0, fmt.Errorf("dovecotsasl: unknown passdb result action: %s", s)
+}
+
+// ChainSkip controls when a passdb in the chain is skipped, mirrors
+// Dovecot's skip setting.
+type ChainSkip int
+
+const (
+	SkipNever ChainSkip = iota
+
+	// SkipAuthenticated skips the passdb if the authentication state is
+	// already success.
+	SkipAuthenticated
+
+	// SkipUnauthenticated skips the passdb if the authentication state is
+	// not success yet.
+	SkipUnauthenticated
+)
+
+func (s ChainSkip) String() string {
+	switch s {
+	case SkipNever:
+		return "never"
+	case SkipAuthenticated:
+		return "authenticated"
+	case SkipUnauthenticated:
+		return "unauthenticated"
+	}
+	return fmt.Sprintf("ChainSkip(%d)", int(s))
+}
+
+// ParseChainSkip parses the Dovecot skip value (never, authenticated,
+// unauthenticated).
+func ParseChainSkip(s string) (ChainSkip, error) {
+	switch s {
+	case "", "never":
+		return SkipNever, nil
+	case "authenticated":
+		return SkipAuthenticated, nil
+	case "unauthenticated":
+		return SkipUnauthenticated, nil
+	}
+	return 0, fmt.Errorf("dovecotsasl: unknown passdb skip value: %s", s)
+}
+
+// ChainEntry is a passdb in PassdbChain.
+type ChainEntry struct {
+	// Name used in log messages.
+	Name string
+
+	Passdb Passdb
+
+	ResultSuccess      ChainResult
+	ResultFailure      ChainResult
+	ResultInternalFail ChainResult
+
+	Skip ChainSkip
+
+	// Master passdbs are used only for master user logins and are ignored
+	// by normal lookups, see PassdbChain.Masters.
+	Master bool
+}
+
+// action returns the configured action for the lookup status.
+func (e *ChainEntry) action(status PassdbStatus) ChainResult {
+	var r ChainResult
+	switch status {
+	case PassdbOK:
+		r = e.ResultSuccess
+		if r == ResultDefault {
+			r = ResultReturnOK
+		}
+	case PassdbInternalFailure:
+		r = e.ResultInternalFail
+	default:
+		r = e.ResultFailure
+	}
+	if r == ResultDefault {
+		r = ResultContinue
+	}
+	return r
+}
+
+// PassdbChain evaluates multiple passdbs in order using Dovecot rules.
+// It implements Passdb.
+//
+// The initial authentication state is failure. Extra fields returned by
+// successful lookups are merged, later passdbs override earlier ones.
+// Username changed by a passdb (PassdbResult.User) is used for the
+// following lookups.
+//
+// Once the password is verified, the following passdbs are queried using
+// LookupCredentials with the PLAIN scheme just to get extra fields,
+// ErrSchemeNotAvailable is considered a success in this case.
+//
+// If the final state is failure and some passdb failed internally, the
+// internal failure is returned.
+type PassdbChain struct {
+	Entries []ChainEntry
+
+	// Log receives debug messages about each step and the passdb that
+	// decided the result.
+	Log *log.Logger
+}
+
+func NewPassdbChain(entries ...ChainEntry) *PassdbChain {
+	return &PassdbChain{
+		Entries: entries,
+		Log:     log.New(ioutil.Discard, "", 0),
+	}
+}
+
+// Masters returns the chain of master passdbs. Master flag is cleared in
+// the returned entries.
+func (c *PassdbChain) Masters() *PassdbChain {
+	masters := &PassdbChain{Log: c.Log}
+	for _, e := range c.Entries {
+		if e.Master {
+			e.Master = false
+			masters.Entries = append(masters.Entries, e)
+		}
+	}
+	return masters
+}
+
+func (c *PassdbChain) debugf(format string, args ...interface{}) {
+	if c.Log != nil {
+		c.Log.Printf(format, args...)
+	}
+}
+
+// lookupFunc runs a single passdb lookup. verified is true if the password
+// was already verified by a previous passdb.
+type lookupFunc func(db Passdb, user string, verified bool) (*PassdbResult, error)
+
+func (c *PassdbChain) run(user string, lookup lookupFunc) (*PassdbResult, error) {
+	var (
+		success     bool
+		verified    bool
+		attempted   bool
+		decidedBy   string
+		lastErr     error
+		internalErr error
+
+		res = &PassdbResult{
+			User:  user,
+			Extra: make(map[string]string),
+		}
+	)
+
+	for i := range c.Entries {
+		e := &c.Entries[i]
+		if e.Master {
+			continue
+		}
+		if (e.Skip == SkipAuthenticated && success) || (e.Skip == SkipUnauthenticated && !success) {
+			c.debugf("passdb chain: %s: skipping %s (skip=%v)", res.User, e.Name, e.Skip)
+			continue
+		}
+
+		r, err := lookup(e.Passdb, res.User, verified)
+		status := PassdbStatusOf(err)
+		action := e.action(status)
+		c.debugf("passdb chain: %s: %s: %v, %v", res.User, e.Name, status, action)
+
+		if err == nil {
+			if r == nil {
+				r = &PassdbResult{}
+			}
+			if r.User != "" {
+				res.User = r.User
+			}
+			if r.Credentials != nil {
+				res.Credentials = r.Credentials
+			}
+			for k, v := range r.Extra {
+				res.Extra[k] = v
+			}
+		} else {
+			lastErr = err
+			if status == PassdbInternalFailure {
+				internalErr = err
+			}
+		}
+		attempted = true
+		decidedBy = e.Name
+
+		switch action {
+		case ResultContinue:
+			if err == nil {
+				verified = true
+			}
+			continue
+		case ResultContinueOK:
+			success = true
+			verified = true
+			continue
+		case ResultContinueFail:
+			success = false
+			if err == nil {
+				lastErr = ErrPasswordMismatch
+			}
+			continue
+		case ResultReturnOK:
+			success = true
+		case ResultReturnFail:
+			success = false
+			if err == nil {
+				lastErr = ErrPasswordMismatch
+			}
+		}
+		break
+	}
+
+	if !success {
+		switch {
+		case internalErr != nil:
+			lastErr = internalErr
+		case !attempted:
+			lastErr = ErrUserUnknown
+		case lastErr == nil:
+			lastErr = ErrPasswordMismatch
+		}
+		c.debugf("passdb chain: %s: failed, decided by %s: %v", res.User, decidedBy, lastErr)
+		return nil, lastErr
+	}
+	c.debugf("passdb chain: %s: succeeded, decided by %s", res.User, decidedBy)
+	return res, nil
+}
+
+func (c *PassdbChain) VerifyPlain(ctx context.Context, req *AuthReq, user, pass string) (*PassdbResult, error) {
+	return c.run(user, func(db Passdb, user string, verified bool) (*PassdbResult, error) {
+		if !verified {
+			return db.VerifyPlain(ctx, req, user, pass)
+		}
+		r, err := db.LookupCredentials(ctx, req, user, "PLAIN")
+		if PassdbStatusOf(err) == PassdbSchemeNotAvailable {
+			return &PassdbResult{}, nil
+		}
+		if r != nil {
+			r.Credentials = nil
+		}
+		return r, err
+	})
+}
+
+func (c *PassdbChain) LookupCredentials(ctx context.Context, req *AuthReq, user, scheme string) (*PassdbResult, error) {
+	return c.run(user, func(db Passdb, user string, verified bool) (*PassdbResult, error) {
+		r, err := db.LookupCredentials(ctx, req, user, scheme)
+		if verified && PassdbStatusOf(err) == PassdbSchemeNotAvailable {
+			return &PassdbResult{}, nil
+		}
+		return r, err
+	})
+}
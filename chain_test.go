@@ -0,0 +1,155 @@
+package dovecotsasl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+type failingPassdb struct {
+	err   error
+	calls int
+}
+
+func (db *failingPassdb) VerifyPlain(context.Context, *AuthReq, string, string) (*PassdbResult, error) {
+	db.calls++
+	return nil, db.err
+}
+
+func (db *failingPassdb) LookupCredentials(context.Context, *AuthReq, string, string) (*PassdbResult, error) {
+	db.calls++
+	return nil, db.err
+}
+
+// extraPassdb returns a fixed set of extra fields for password lookups.
+type extraPassdb map[string]string
+
+func (db extraPassdb) VerifyPlain(context.Context, *AuthReq, string, string) (*PassdbResult, error) {
+	return nil, ErrPasswordMismatch
+}
+
+func (db extraPassdb) LookupCredentials(context.Context, *AuthReq, string, string) (*PassdbResult, error) {
+	return &PassdbResult{Extra: db}, nil
+}
+
+func TestPassdbChain(t *testing.T) {
+	ctx := context.Background()
+	ldap := testPassdb{"ldapuser": "1234"}
+	file := testPassdb{"fileuser": "5678", "disabled": "disabled"}
+
+	t.Run("fallback", func(t *testing.T) {
+		var logBuf bytes.Buffer
+		chain := NewPassdbChain(
+			ChainEntry{Name: "ldap", Passdb: ldap},
+			ChainEntry{Name: "file", Passdb: file},
+		)
+		chain.Log = log.New(&logBuf, "", 0)
+
+		if _, err := chain.VerifyPlain(ctx, nil, "ldapuser", "1234"); err != nil {
+			t.Error(err)
+		}
+		res, err := chain.VerifyPlain(ctx, nil, "fileuser", "5678")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.User != "fileuser" || res.Extra["quota"] != "1G" {
+			t.Errorf("unexpected result: %+v", res)
+		}
+		if !strings.Contains(logBuf.String(), "fileuser: succeeded, decided by file") {
+			t.Errorf("deciding passdb is not logged:\n%s", logBuf.String())
+		}
+
+		if _, err := chain.VerifyPlain(ctx, nil, "fileuser", "1234"); !errors.Is(err, ErrPasswordMismatch) {
+			t.Errorf("expected password mismatch, got %v", err)
+		}
+		if _, err := chain.VerifyPlain(ctx, nil, "disabled", "1234"); !errors.Is(err, ErrUserDisabled) {
+			t.Errorf("expected disabled user, got %v", err)
+		}
+		if _, err := chain.VerifyPlain(ctx, nil, "nobody", "1234"); !errors.Is(err, ErrUserUnknown) {
+			t.Errorf("expected unknown user, got %v", err)
+		}
+
+		creds, err := chain.LookupCredentials(ctx, nil, "fileuser", "PLAIN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(creds.Credentials) != "5678" {
+			t.Errorf("got credentials %q, want %q", creds.Credentials, "5678")
+		}
+	})
+
+	t.Run("internal failure", func(t *testing.T) {
+		broken := &failingPassdb{err: PassdbInternalError(errors.New("connection refused"))}
+		chain := NewPassdbChain(
+			ChainEntry{Name: "ldap", Passdb: broken},
+			ChainEntry{Name: "file", Passdb: file},
+		)
+		if _, err := chain.VerifyPlain(ctx, nil, "fileuser", "5678"); err != nil {
+			t.Errorf("no fallback on internal failure: %v", err)
+		}
+		if _, err := chain.VerifyPlain(ctx, nil, "fileuser", "1234"); PassdbStatusOf(err) != PassdbInternalFailure {
+			t.Errorf("expected internal failure, got %v", err)
+		}
+
+		chain.Entries[0].ResultInternalFail = ResultReturnFail
+		if _, err := chain.VerifyPlain(ctx, nil, "fileuser", "5678"); PassdbStatusOf(err) != PassdbInternalFailure {
+			t.Errorf("expected internal failure with return-fail, got %v", err)
+		}
+	})
+
+	t.Run("return-fail", func(t *testing.T) {
+		next := &failingPassdb{err: ErrUserUnknown}
+		chain := NewPassdbChain(
+			ChainEntry{Name: "file", Passdb: file, ResultFailure: ResultReturnFail},
+			ChainEntry{Name: "next", Passdb: next},
+		)
+		if _, err := chain.VerifyPlain(ctx, nil, "fileuser", "1234"); !errors.Is(err, ErrPasswordMismatch) {
+			t.Errorf("expected password mismatch, got %v", err)
+		}
+		if next.calls != 0 {
+			t.Errorf("passdb after return-fail is used")
+		}
+	})
+
+	t.Run("continue-ok", func(t *testing.T) {
+		chain := NewPassdbChain(
+			ChainEntry{Name: "file", Passdb: file, ResultSuccess: ResultContinueOK},
+			ChainEntry{Name: "extra", Passdb: extraPassdb{"home": "/home/fileuser"}, Skip: SkipUnauthenticated},
+		)
+		res, err := chain.VerifyPlain(ctx, nil, "fileuser", "5678")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Extra["home"] != "/home/fileuser" || res.Extra["quota"] != "1G" {
+			t.Errorf("extra fields are not merged: %v", res.Extra)
+		}
+		if _, err := chain.VerifyPlain(ctx, nil, "fileuser", "1234"); !errors.Is(err, ErrPasswordMismatch) {
+			t.Errorf("expected password mismatch, got %v", err)
+		}
+	})
+
+	t.Run("continue-fail", func(t *testing.T) {
+		chain := NewPassdbChain(
+			ChainEntry{Name: "file", Passdb: file, ResultSuccess: ResultContinueFail},
+		)
+		if _, err := chain.VerifyPlain(ctx, nil, "fileuser", "5678"); !errors.Is(err, ErrPasswordMismatch) {
+			t.Errorf("expected password mismatch, got %v", err)
+		}
+	})
+
+	t.Run("master", func(t *testing.T) {
+		chain := NewPassdbChain(
+			ChainEntry{Name: "masters", Passdb: testPassdb{"admin": "admin"}, Master: true},
+			ChainEntry{Name: "file", Passdb: file},
+		)
+		if _, err := chain.VerifyPlain(ctx, nil, "admin", "admin"); !errors.Is(err, ErrUserUnknown) {
+			t.Errorf("master passdb is used for normal lookups: %v", err)
+		}
+		if _, err := chain.Masters().VerifyPlain(ctx, nil, "admin", "admin"); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,294 @@
+// Package checkpassword implements passdb and userdb backend using an
+// external program following the checkpassword interface.
+//
+// The program is started as
+//
+//	Path [Args...] ReplyPath
+//
+// and reads "user\0password\0timestamp\0" from file descriptor 3. Exit
+// codes are interpreted as follows:
+//   - 0: success;
+//   - 1: password mismatch;
+//   - 2: unknown user (Dovecot extension);
+//   - 111: temporary failure;
+//   - anything else: internal failure.
+//
+// On success the program is expected to execute ReplyPath, which in turn
+// may write tab-separated key=value fields to file descriptor 4. Dovecot's
+// checkpassword-reply does exactly that using USER, HOME and EXTRA
+// environment variables (EXTRA lists names of other variables to send), so
+// existing scripts can be used unchanged. The default ReplyPath is "true"
+// which returns no fields.
+//
+// Request information is passed in the environment: SERVICE, TCPLOCALIP,
+// TCPLOCALPORT, TCPREMOTEIP, TCPREMOTEPORT and AUTH_* variables (AUTH_USER,
+// AUTH_DOMAIN, AUTH_SECURED, ...). CREDENTIALS_LOOKUP=1 is set for
+// credentials lookups (the program should reply with the "password" field)
+// and AUTHORIZED=1 is set for userdb lookups.
+//
+// See https://doc.dovecot.org/configuration_manual/authentication/checkpassword/.
+package checkpassword
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+)
+
+const (
+	exitOK         = 0
+	exitMismatch   = 1
+	exitUnknown    = 2
+	exitTemporary  = 111
+	maxReplyLength = 64 * 1024
+)
+
+// DB is the checkpassword backend. It implements dovecotsasl.Passdb.
+type DB struct {
+	// Path to the checkpassword program and additional arguments passed
+	// before ReplyPath.
+	Path string
+	Args []string
+
+	// Program executed by the checkpassword program on success.
+	ReplyPath string
+
+	// Additional environment variables in "key=value" form. The environment
+	// of the current process is not inherited.
+	Env []string
+
+	// Scheme to use for passwords without {SCHEME} prefix in credentials
+	// lookups.
+	DefaultScheme string
+
+	// Maximum time the program is allowed to run.
+	Timeout time.Duration
+
+	// Maximum number of programs running at the same time.
+	MaxProcs int
+
+	semOnce sync.Once
+	sem     chan struct{}
+}
+
+func New(path string, args ...string) *DB {
+	return &DB{
+		Path:          path,
+		Args:          args,
+		ReplyPath:     "true",
+		DefaultScheme: "PLAIN",
+		Timeout:       30 * time.Second,
+		MaxProcs:      16,
+	}
+}
+
+func (db *DB) env(req *dovecotsasl.AuthReq, user string) []string {
+	env := []string{"PATH=/usr/local/bin:/usr/bin:/bin"}
+	if req != nil {
+		env = append(env, "SERVICE="+req.Service)
+		if req.LocalIP != nil {
+			env = append(env, "TCPLOCALIP="+req.LocalIP.String())
+		}
+		if req.LocalPort != 0 {
+			env = append(env, "TCPLOCALPORT="+strconv.Itoa(int(req.LocalPort)))
+		}
+		if req.RemoteIP != nil {
+			env = append(env, "TCPREMOTEIP="+req.RemoteIP.String())
+		}
+		if req.RemotePort != 0 {
+			env = append(env, "TCPREMOTEPORT="+strconv.Itoa(int(req.RemotePort)))
+		}
+	}
+	for k, v := range req.Vars(user) {
+		if v == "" {
+			continue
+		}
+		env = append(env, "AUTH_"+strings.ToUpper(k)+"="+v)
+	}
+	return append(env, db.Env...)
+}
+
+func parseReply(reply []byte) map[string]string {
+	fields := make(map[string]string)
+	for _, f := range strings.Split(strings.TrimRight(string(reply), "\n"), "\t") {
+		if f == "" {
+			continue
+		}
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) == 1 {
+			fields[parts[0]] = ""
+			continue
+		}
+		fields[parts[0]] = parts[1]
+	}
+	return fields
+}
+
+// run executes the program and returns reply fields.
+func (db *DB) run(ctx context.Context, req *dovecotsasl.AuthReq, user, pass string, extraEnv ...string) (map[string]string, error) {
+	db.semOnce.Do(func() {
+		if db.MaxProcs > 0 {
+			db.sem = make(chan struct{}, db.MaxProcs)
+		}
+	})
+	if db.sem != nil {
+		select {
+		case db.sem <- struct{}{}:
+			defer func() { <-db.sem }()
+		case <-ctx.Done():
+			return nil, dovecotsasl.PassdbInternalError(ctx.Err())
+		}
+	}
+
+	if db.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, db.Timeout)
+		defer cancel()
+	}
+
+	credsR, credsW, err := os.Pipe()
+	if err != nil {
+		return nil, dovecotsasl.PassdbInternalError(err)
+	}
+	defer credsR.Close()
+	defer credsW.Close()
+	replyR, replyW, err := os.Pipe()
+	if err != nil {
+		return nil, dovecotsasl.PassdbInternalError(err)
+	}
+	defer replyR.Close()
+	defer replyW.Close()
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		return nil, dovecotsasl.PassdbInternalError(err)
+	}
+	defer stderrR.Close()
+	defer stderrW.Close()
+
+	args := append(append([]string{}, db.Args...), db.ReplyPath)
+	cmd := exec.CommandContext(ctx, db.Path, args...)
+	cmd.Env = append(db.env(req, user), extraEnv...)
+	cmd.ExtraFiles = []*os.File{credsR, replyW}
+	cmd.Stderr = stderrW
+
+	if err := cmd.Start(); err != nil {
+		return nil, dovecotsasl.PassdbInternalError(fmt.Errorf("checkpassword: %w", err))
+	}
+	credsR.Close()
+	replyW.Close()
+	stderrW.Close()
+
+	go func() {
+		credsW.Write([]byte(user + "\x00" + pass + "\x00" + strconv.FormatInt(time.Now().Unix(), 10) + "\x00"))
+		credsW.Close()
+	}()
+
+	// Children of the program may keep descriptors open, do not wait for
+	// them forever.
+	if deadline, ok := ctx.Deadline(); ok {
+		replyR.SetReadDeadline(deadline)
+		stderrR.SetReadDeadline(deadline)
+	}
+	stderrCh := make(chan string, 1)
+	go func() {
+		msg, _ := ioutil.ReadAll(io.LimitReader(stderrR, maxReplyLength))
+		stderrCh <- strings.TrimSpace(string(msg))
+	}()
+	reply, readErr := ioutil.ReadAll(io.LimitReader(replyR, maxReplyLength))
+	err = cmd.Wait()
+	stderr := <-stderrCh
+
+	if ctx.Err() != nil {
+		return nil, dovecotsasl.PassdbInternalError(fmt.Errorf("checkpassword: %s: %w", db.Path, ctx.Err()))
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, dovecotsasl.PassdbInternalError(fmt.Errorf("checkpassword: %s: %w", db.Path, err))
+	}
+	switch code := cmd.ProcessState.ExitCode(); code {
+	case exitOK:
+	case exitMismatch:
+		return nil, dovecotsasl.ErrPasswordMismatch
+	case exitUnknown:
+		return nil, dovecotsasl.ErrUserUnknown
+	case exitTemporary:
+		return nil, dovecotsasl.PassdbInternalError(fmt.Errorf("checkpassword: %s: temporary failure: %s",
+			db.Path, stderr))
+	default:
+		return nil, dovecotsasl.PassdbInternalError(fmt.Errorf("checkpassword: %s: exit code %d: %s",
+			db.Path, code, stderr))
+	}
+	if readErr != nil {
+		return nil, dovecotsasl.PassdbInternalError(fmt.Errorf("checkpassword: %s: reading reply: %w", db.Path, readErr))
+	}
+	return parseReply(reply), nil
+}
+
+func passdbResult(fields map[string]string) *dovecotsasl.PassdbResult {
+	res := &dovecotsasl.PassdbResult{
+		User:  fields["user"],
+		Extra: make(map[string]string),
+	}
+	for k, v := range fields {
+		if k == "user" || k == "password" {
+			continue
+		}
+		res.Extra[k] = v
+	}
+	return res
+}
+
+func (db *DB) VerifyPlain(ctx context.Context, req *dovecotsasl.AuthReq, user, pass string) (*dovecotsasl.PassdbResult, error) {
+	fields, err := db.run(ctx, req, user, pass)
+	if err != nil {
+		return nil, err
+	}
+	return passdbResult(fields), nil
+}
+
+func (db *DB) LookupCredentials(ctx context.Context, req *dovecotsasl.AuthReq, user, scheme string) (*dovecotsasl.PassdbResult, error) {
+	fields, err := db.run(ctx, req, user, "", "CREDENTIALS_LOOKUP=1")
+	if err != nil {
+		return nil, err
+	}
+	password, ok := fields["password"]
+	if !ok || password == "" {
+		return nil, dovecotsasl.ErrCredentialsUnavailable
+	}
+	res := passdbResult(fields)
+	res.Credentials, err = dovecotsasl.PasswordCredentials(password, db.DefaultScheme, scheme)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// LookupUser runs the program with AUTHORIZED=1 and returns reply fields
+// as userdb fields ("userdb_" prefix is removed).
+func (db *DB) LookupUser(ctx context.Context, req *dovecotsasl.AuthReq, user string) (map[string]string, error) {
+	fields, err := db.run(ctx, req, user, "", "AUTHORIZED=1")
+	if err != nil {
+		return nil, err
+	}
+	userFields := make(map[string]string, len(fields))
+	for k, v := range fields {
+		switch {
+		case k == "user" || k == "password":
+		case strings.HasPrefix(k, "userdb_"):
+			userFields[strings.TrimPrefix(k, "userdb_")] = v
+		default:
+			userFields[k] = v
+		}
+	}
+	return userFields, nil
+}
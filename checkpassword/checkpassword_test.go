@@ -0,0 +1,118 @@
+package checkpassword
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+)
+
+const testScript = `#!/bin/sh
+creds=$(tr '\0' '\n' <&3)
+user=$(echo "$creds" | sed -n 1p)
+pass=$(echo "$creds" | sed -n 2p)
+
+case "$user" in
+foxcpp@example.org)
+	if [ "$CREDENTIALS_LOOKUP" = 1 ]; then
+		printf 'password={PLAIN}1234' >&4
+		exit 0
+	fi
+	if [ "$AUTHORIZED" = 1 ]; then
+		printf 'userdb_home=/home/foxcpp\tuserdb_uid=1000' >&4
+		exit 0
+	fi
+	[ "$pass" = 1234 ] || exit 1
+	printf 'user=foxcpp@example.org\trip=%s\tservice=%s\tsecured=%s' "$TCPREMOTEIP" "$SERVICE" "$AUTH_SECURED" >&4
+	exec "$1"
+	;;
+nopass@example.org)
+	printf 'nopassword=y' >&4
+	exit 0
+	;;
+temp@example.org)
+	echo "backend is down" >&2
+	exit 111
+	;;
+slow@example.org)
+	sleep 5
+	;;
+*)
+	exit 2
+	;;
+esac
+`
+
+func TestCheckpassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpassword-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpassword")
+	if err := ioutil.WriteFile(path, []byte(testScript), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	db := New(path)
+	db.Timeout = 500 * time.Millisecond
+	ctx := context.Background()
+	req := &dovecotsasl.AuthReq{
+		Service:  "imap",
+		RemoteIP: net.IPv4(192, 0, 2, 1),
+		Secured:  true,
+	}
+
+	res, err := db.VerifyPlain(ctx, req, "foxcpp@example.org", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.User != "foxcpp@example.org" || res.Extra["rip"] != "192.0.2.1" ||
+		res.Extra["service"] != "imap" || res.Extra["secured"] != "secured" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	if _, err := db.VerifyPlain(ctx, req, "foxcpp@example.org", "5678"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("expected password mismatch, got %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, req, "nobody@example.org", "1234"); !errors.Is(err, dovecotsasl.ErrUserUnknown) {
+		t.Errorf("expected unknown user, got %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, req, "temp@example.org", "1234"); dovecotsasl.PassdbStatusOf(err) != dovecotsasl.PassdbInternalFailure {
+		t.Errorf("expected internal failure, got %v", err)
+	}
+
+	start := time.Now()
+	if _, err := db.VerifyPlain(ctx, req, "slow@example.org", "1234"); dovecotsasl.PassdbStatusOf(err) != dovecotsasl.PassdbInternalFailure {
+		t.Errorf("expected internal failure on timeout, got %v", err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("timeout is not enforced")
+	}
+
+	creds, err := db.LookupCredentials(ctx, req, "foxcpp@example.org", "PLAIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(creds.Credentials) != "1234" {
+		t.Errorf("got credentials %q, want %q", creds.Credentials, "1234")
+	}
+	_, err = db.LookupCredentials(ctx, req, "nopass@example.org", "PLAIN")
+	if dovecotsasl.PassdbStatusOf(err) != dovecotsasl.PassdbSchemeNotAvailable || !dovecotsasl.PassdbUserFound(err) {
+		t.Errorf("expected unavailable credentials for existing user, got %v", err)
+	}
+
+	fields, err := db.LookupUser(ctx, req, "foxcpp@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["home"] != "/home/foxcpp" || fields["uid"] != "1000" {
+		t.Errorf("unexpected userdb fields: %v", fields)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
@@ -102,6 +103,52 @@ const (
 	ParamNoPenalty       Parameter = "no-penalty"
 )
 
+// start sends the AUTH command and returns the request ID. params should
+// not contain the initial response, ir is sent if it is not nil.
+func (c *Client) start(mech string, ir []byte, params []string) (string, error) {
+	c.rid++
+	rid := strconv.Itoa(c.rid)
+
+	args := make([]string, 0, len(params)+3)
+	args = append(args, rid, mech)
+	args = append(args, params...)
+	if ir != nil {
+		args = append(args, "resp="+base64.StdEncoding.EncodeToString(ir))
+	}
+	return rid, c.c.Writeln("AUTH", args...)
+}
+
+// cont sends the response to the server challenge.
+func (c *Client) cont(rid string, resp []byte) error {
+	return c.c.Writeln("CONT", rid, base64.StdEncoding.EncodeToString(resp))
+}
+
+// reply reads the server reply (OK, FAIL or CONT) for the request.
+func (c *Client) reply(rid string) (string, []string, error) {
+	for {
+		cmd, params, err := c.c.Readln()
+		if err != nil {
+			return "", nil, err
+		}
+		switch cmd {
+		case "OK", "FAIL", "CONT":
+		default:
+			// Ignore unknown commands as required by spec.
+			continue
+		}
+		if len(params) == 0 {
+			return "", nil, fmt.Errorf("dovecotsasl: missing reply params")
+		}
+		if params[0] != rid {
+			return "", nil, fmt.Errorf("dovecotsasl: request ID mismatch, sent %s, received %s", rid, params[0])
+		}
+		if cmd == "CONT" && len(params) < 2 {
+			return "", nil, fmt.Errorf("dovecotsasl: missing challenge param")
+		}
+		return cmd, params, nil
+	}
+}
+
 // Do preforms SASL authentication using Dovecot SASL server and provided
 // sasl.Client implementation.
 func (c *Client) Do(service string, cl sasl.Client, extraParams ...Parameter) (*AuthOK, error) {
@@ -113,59 +160,88 @@ func (c *Client) Do(service string, cl sasl.Client, extraParams ...Parameter) (*
 		return nil, fmt.Errorf("dovecotsasl: unsupported mechanism: %v", mech)
 	}
 
-	c.rid++
-	rid := strconv.Itoa(c.rid)
-
 	params := make([]string, 0, 8)
-	params = append(params, rid, mech, "service="+service)
+	params = append(params, "service="+service)
 	for _, p := range extraParams {
 		params = append(params, string(p))
 	}
-	if ir != nil {
-		params = append(params, "resp="+base64.StdEncoding.EncodeToString(ir))
-	}
 
-	if err := c.c.Writeln("AUTH", params...); err != nil {
+	rid, err := c.start(mech, ir, params)
+	if err != nil {
 		return nil, err
 	}
 
 	for {
-		cmd, params, err := c.c.Readln()
+		cmd, params, err := c.reply(rid)
 		if err != nil {
 			return nil, err
 		}
-		if len(params) == 0 {
-			return nil, fmt.Errorf("dovecotsasl: missing reply params")
-		}
-		if params[0] != rid {
-			return nil, fmt.Errorf("dovecotsasl: request ID mismatch, sent %s, received %s", rid, params[0])
-		}
 		switch cmd {
 		case "FAIL":
 			return nil, parseFail(params)
 		case "CONT":
-			if len(params) < 2 {
-				return nil, fmt.Errorf("dovecotsasl: missing challenge param")
-			}
 			challenge, err := base64.StdEncoding.DecodeString(params[1])
 			if err != nil {
 				return nil, fmt.Errorf("dovecotsasl: malformed challenge: %v", err)
 			}
 			response, err := cl.Next(challenge)
 			if err != nil {
+				if isOAuthError(err) {
+					// Error challenge should be acknowledged by the
+					// client, server then fails the request.
+					c.finishOAuthError(rid)
+				}
 				return nil, err
 			}
-			err = c.c.Writeln("CONT", rid, base64.StdEncoding.EncodeToString(response))
-			if err != nil {
+			if err := c.cont(rid, response); err != nil {
 				return nil, err
 			}
 		case "OK":
 			ao := parseOk(params)
+			if resp, ok := ao.Extra["resp"]; ok {
+				// Additional data with success (e.g. SCRAM server
+				// signature), let mechanism verify it.
+				delete(ao.Extra, "resp")
+				final, err := base64.StdEncoding.DecodeString(resp)
+				if err != nil {
+					return nil, fmt.Errorf("dovecotsasl: malformed success data: %v", err)
+				}
+				if _, err := cl.Next(final); err != nil {
+					return nil, err
+				}
+			}
+			if m, ok := cl.(mutualAuthClient); ok && !m.serverVerified() {
+				return nil, errors.New("dovecotsasl: server did not prove its identity")
+			}
 			return &ao, nil
 		}
 	}
 }
 
+// mutualAuthClient is implemented by mechanisms that authenticate the
+// server too (SCRAM). The success is accepted only once the final server
+// message is verified, so it can not be skipped by sending OK early.
+type mutualAuthClient interface {
+	serverVerified() bool
+}
+
+func isOAuthError(err error) bool {
+	var (
+		bearerErr  *sasl.OAuthBearerError
+		xoauth2Err *sasl.Xoauth2Error
+	)
+	return errors.As(err, &bearerErr) || errors.As(err, &xoauth2Err)
+}
+
+// finishOAuthError acknowledges the OAUTHBEARER/XOAUTH2 error challenge and
+// reads the final reply.
+func (c *Client) finishOAuthError(rid string) {
+	if err := c.cont(rid, []byte{0x01}); err != nil {
+		return
+	}
+	c.reply(rid)
+}
+
 func (c *Client) ConnInfo() ConnInfo {
 	return c.info
 }
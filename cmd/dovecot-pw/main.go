@@ -0,0 +1,104 @@
+// Command dovecot-pw generates and verifies password hashes in the same
+// formats as "doveadm pw".
+//
+// Usage:
+//
+//	dovecot-pw [-l] [-p plaintext] [-r rounds] [-s scheme] [-t hash] [-V]
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/foxcpp/go-dovecot-sasl/pwscheme"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func readPassword(confirm bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Enter new password: ")
+	pass, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Retype new password: ")
+		again, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(again) != string(pass) {
+			return "", errors.New("passwords don't match")
+		}
+	}
+	return string(pass), nil
+}
+
+func main() {
+	list := flag.Bool("l", false, "List known password schemes")
+	plain := flag.String("p", "", "Plaintext password, read from stdin if not specified")
+	rounds := flag.Int("r", 0, "Number of rounds (for schemes that support it)")
+	scheme := flag.String("s", "SHA512-CRYPT", "Password scheme")
+	test := flag.String("t", "", "Verify the password against the specified hash")
+	verify := flag.Bool("V", false, "Verify the generated hash")
+	flag.Parse()
+
+	if *list {
+		fmt.Println(strings.Join(pwscheme.Names(), " "))
+		return
+	}
+
+	pass := *plain
+	if pass == "" {
+		var err error
+		pass, err = readPassword(*test == "")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *test != "" {
+		ok, err := pwscheme.Verify(*test, *scheme, pass)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		if !ok {
+			fmt.Fprintln(os.Stderr, "Password mismatch")
+			os.Exit(1)
+		}
+		fmt.Println(*test, "(verified)")
+		return
+	}
+
+	hash, err := pwscheme.GenerateRounds(*scheme, pass, *rounds)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	if *verify {
+		ok, err := pwscheme.Verify(hash, *scheme, pass)
+		if err != nil || !ok {
+			fmt.Fprintln(os.Stderr, "Error: generated hash does not verify:", err)
+			os.Exit(2)
+		}
+		fmt.Println(hash, "(verified)")
+		return
+	}
+	fmt.Println(hash)
+}
@@ -6,12 +6,50 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
 )
 
 type conn struct {
 	C net.Conn
 	W *bufio.Writer
 	R *bufio.Scanner
+
+	// Lines read in background, see watch.
+	lines     chan line
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type line struct {
+	cmd    string
+	params []string
+	err    error
+}
+
+// watch starts reading lines in background, so the closed connection is
+// noticed while a request is being processed. onClose is called once the
+// connection is closed or fails. Readln returns lines read in background
+// after that.
+func (c *conn) watch(onClose func()) {
+	c.lines = make(chan line, 16)
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.lines)
+		for {
+			cmd, params, err := c.readln()
+			if err != nil {
+				onClose()
+			}
+			select {
+			case c.lines <- line{cmd, params, err}:
+			case <-c.done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
 }
 
 func (c *conn) Writeln(cmd string, params ...string) error {
@@ -76,13 +114,23 @@ func tabUnescape(s string) []string {
 		}
 		partBuilder.WriteByte(byte(b))
 	}
-	if partBuilder.Len() > 0 {
-		parts = append(parts, partBuilder.String())
-	}
+	// Last field may be empty (e.g. empty CONT response).
+	parts = append(parts, partBuilder.String())
 	return parts
 }
 
 func (c *conn) Readln() (string, []string, error) {
+	if c.lines != nil {
+		l, ok := <-c.lines
+		if !ok {
+			return "", nil, io.EOF
+		}
+		return l.cmd, l.params, l.err
+	}
+	return c.readln()
+}
+
+func (c *conn) readln() (string, []string, error) {
 	if !c.R.Scan() {
 		if err := c.R.Err(); err != nil {
 			return "", nil, err
@@ -110,5 +158,8 @@ func (c *conn) ReadlnExpect(expectCmd string, atleastParams int) ([]string, erro
 }
 
 func (c *conn) Close() error {
+	if c.done != nil {
+		c.closeOnce.Do(func() { close(c.done) })
+	}
 	return c.C.Close()
 }
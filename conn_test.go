@@ -0,0 +1,26 @@
+package dovecotsasl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTabUnescape(t *testing.T) {
+	cases := []struct {
+		line   string
+		fields []string
+	}{
+		{"CONT\t1\tdGVzdA==", []string{"CONT", "1", "dGVzdA=="}},
+		// Empty response to a challenge.
+		{"CONT\t1\t", []string{"CONT", "1", ""}},
+		{"OK\t1\t\t", []string{"OK", "1", "", ""}},
+		{"FAIL", []string{"FAIL"}},
+		{"", []string{""}},
+		{"USER\ta\x01\tb\tc\x01\x01", []string{"USER", "a\tb", "c\x01"}},
+	}
+	for _, c := range cases {
+		if fields := tabUnescape(c.line); !reflect.DeepEqual(fields, c.fields) {
+			t.Errorf("tabUnescape(%q) = %q, want %q", c.line, fields, c.fields)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package dovecotsasl
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+type cramMD5Client struct {
+	username string
+	password string
+	done     bool
+}
+
+func newCRAMMD5Client(username, password string) sasl.Client {
+	return &cramMD5Client{username: username, password: password}
+}
+
+func (c *cramMD5Client) Start() (string, []byte, error) {
+	return "CRAM-MD5", nil, nil
+}
+
+func (c *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	if c.done {
+		return nil, errors.New("dovecotsasl: unexpected CRAM-MD5 challenge")
+	}
+	c.done = true
+
+	mac := hmac.New(md5.New, []byte(c.password))
+	mac.Write(challenge)
+	return []byte(c.username + " " + hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// cramMD5ContextLen is the length of CRAM-MD5 credentials: outer and inner
+// MD5 states, 4 little-endian 32-bit words each.
+const cramMD5ContextLen = 32
+
+// md5FromState restores the MD5 state after processing exactly one block.
+func md5FromState(state []byte) (hash.Hash, error) {
+	// Format used by crypto/md5: magic, state in big-endian, block buffer,
+	// length.
+	marshaled := make([]byte, 0, 4+16+md5.BlockSize+8)
+	marshaled = append(marshaled, "md5\x01"...)
+	for i := 0; i < 4; i++ {
+		word := binary.LittleEndian.Uint32(state[i*4:])
+		marshaled = append(marshaled, byte(word>>24), byte(word>>16), byte(word>>8), byte(word))
+	}
+	marshaled = append(marshaled, make([]byte, md5.BlockSize)...)
+	marshaled = append(marshaled, 0, 0, 0, 0, 0, 0, 0, md5.BlockSize)
+
+	h := md5.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(marshaled); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// cramMD5Digest computes HMAC-MD5 of the challenge using the precomputed
+// context instead of the plaintext secret.
+func cramMD5Digest(context, challenge []byte) ([]byte, error) {
+	if len(context) != cramMD5ContextLen {
+		return nil, fmt.Errorf("dovecotsasl: malformed CRAM-MD5 credentials: length %d", len(context))
+	}
+	outer, err := md5FromState(context[:16])
+	if err != nil {
+		return nil, err
+	}
+	inner, err := md5FromState(context[16:])
+	if err != nil {
+		return nil, err
+	}
+
+	inner.Write(challenge)
+	outer.Write(inner.Sum(nil))
+	return outer.Sum(nil), nil
+}
+
+// CRAMMD5Handler returns the CRAM-MD5 mechanism implementation that uses
+// credentials from db.
+func CRAMMD5Handler(db Passdb) FuncSASLHandler {
+	return func(req *AuthReq, cb FuncSASLCallback) sasl.Server {
+		return &cramMD5Server{db: db, req: req, cb: cb}
+	}
+}
+
+type cramMD5Server struct {
+	db  Passdb
+	req *AuthReq
+	cb  FuncSASLCallback
+
+	challenge []byte
+}
+
+func cramMD5Challenge() ([]byte, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return []byte(fmt.Sprintf("<%d.%d@%s>", n, time.Now().Unix(), hostname)), nil
+}
+
+func (s *cramMD5Server) Next(response []byte) ([]byte, bool, error) {
+	if s.challenge == nil {
+		if len(response) != 0 {
+			return nil, false, errors.New("dovecotsasl: unexpected CRAM-MD5 initial response")
+		}
+		challenge, err := cramMD5Challenge()
+		if err != nil {
+			return nil, false, err
+		}
+		s.challenge = challenge
+		return challenge, false, nil
+	}
+
+	idx := strings.LastIndexByte(string(response), ' ')
+	if idx <= 0 {
+		return nil, false, errors.New("dovecotsasl: malformed CRAM-MD5 response")
+	}
+	user := string(response[:idx])
+	digest, err := hex.DecodeString(string(response[idx+1:]))
+	if err != nil {
+		return nil, false, errors.New("dovecotsasl: malformed CRAM-MD5 digest")
+	}
+	if _, user, _, err = s.req.prepCredentials("", user, ""); err != nil {
+		return nil, false, err
+	}
+
+	l, err := s.req.resolveLogin(s.db, "", user)
+	if err != nil {
+		return nil, false, err
+	}
+	res, err := l.lookupCredentials("CRAM-MD5")
+	if err != nil {
+		return nil, false, err
+	}
+	expected, err := cramMD5Digest(res.Credentials, s.challenge)
+	if err != nil {
+		return nil, false, PassdbInternalError(err)
+	}
+	if !hmac.Equal(expected, digest) {
+		return nil, false, ErrPasswordMismatch
+	}
+
+	if err := l.success(s.cb, res); err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
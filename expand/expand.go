@@ -0,0 +1,470 @@
+// Package expand implements Dovecot variable expansion used in
+// configuration templates.
+//
+// Variables are referenced using the short (%u) or long (%{user}) form.
+// Variable values are usually obtained from dovecotsasl.AuthReq.Vars.
+//
+// Short form may include modifiers and the offset/width specification
+// before the variable letter: %[[-]offset.][width]<modifiers><var>, e.g.
+// %Lu (lowercased username) or %1.2n (two characters of username starting
+// from the second one). Modifiers can be used with the long form too
+// (%L{user}). Supported modifiers:
+//   - L, U: lowercase, uppercase;
+//   - E: escape ", ' and \ using \;
+//   - X: convert the base-10 number to hexadecimal;
+//   - R: reverse;
+//   - D: convert the domain into LDAP DN (sub.example.org ->
+//     sub,dc=example,dc=org);
+//   - T: trim trailing whitespace;
+//   - H, N: 32-bit hash as hexadecimal, width is used as a modulo
+//     (%256Hu is between 0 and ff). N uses MD5, H uses Dovecot's string hash.
+//
+// Long form also supports functions:
+//   - %{md5:user}, %{sha1:user}, %{sha256:user} and other hashes (sha224,
+//     sha384, sha512), lowercase hex by default. Options can be specified
+//     after the hash name: %{sha256;rounds=2,format=base64:user}, format
+//     is one of hex, hex-uc or base64, salt is prepended to the value
+//     before hashing;
+//   - %{env:NAME}: environment variable;
+//   - %{hostname}: system hostname.
+//
+// %% is expanded into a single %.
+package expand
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Short variable names and their long equivalents.
+var shortVars = map[byte]string{
+	'u': "user",
+	'n': "username",
+	'd': "domain",
+	's': "service",
+	'l': "lip",
+	'r': "rip",
+	'a': "lport",
+	'b': "rport",
+	'm': "mech",
+	'c': "secured",
+	'k': "cert",
+}
+
+// knownVars are long variable names accepted by Check in addition to
+// shortVars values.
+var knownVars = map[string]bool{
+	"client_id":     true,
+	"orig_user":     true,
+	"orig_username": true,
+	"orig_domain":   true,
+	"master_user":   true,
+	"login_user":    true,
+	"session":       true,
+}
+
+var hashFuncs = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+const modifierChars = "LUEXRDTHN"
+
+// token is a parsed variable reference.
+type token struct {
+	offset, width int
+	hasWidth      bool
+	modifiers     string
+
+	// Variable name (long form) or function name.
+	name string
+	// Function options and argument, if any.
+	opts, arg string
+	isFunc    bool
+}
+
+// TokenAt returns the whole variable reference starting at tmpl[i] (which
+// should be '%'), e.g. "%Lu" or "%{rip}". Empty string is returned if
+// there is no valid reference at i.
+func TokenAt(tmpl string, i int) string {
+	_, end, err := parseToken(tmpl, i)
+	if err != nil {
+		return ""
+	}
+	return tmpl[i:end]
+}
+
+// parseToken parses the variable reference at tmpl[i] ('%') and returns it
+// together with the index of the first byte after it.
+func parseToken(tmpl string, i int) (token, int, error) {
+	var t token
+	j := i + 1
+
+	// [[-]offset.][width]
+	num := func() (int, bool) {
+		start := j
+		if j < len(tmpl) && tmpl[j] == '-' {
+			j++
+		}
+		for j < len(tmpl) && tmpl[j] >= '0' && tmpl[j] <= '9' {
+			j++
+		}
+		if start == j || (j == start+1 && tmpl[start] == '-') {
+			j = start
+			return 0, false
+		}
+		n, _ := strconv.Atoi(tmpl[start:j])
+		return n, true
+	}
+	if n, ok := num(); ok {
+		if j < len(tmpl) && tmpl[j] == '.' {
+			j++
+			t.offset = n
+			w, ok := num()
+			if !ok || w < 0 {
+				return t, 0, fmt.Errorf("expand: missing width after offset at %d", i)
+			}
+			t.width, t.hasWidth = w, true
+		} else {
+			if n < 0 {
+				return t, 0, fmt.Errorf("expand: negative width at %d", i)
+			}
+			t.width, t.hasWidth = n, true
+		}
+	}
+
+	for j < len(tmpl) && strings.IndexByte(modifierChars, tmpl[j]) != -1 {
+		t.modifiers += string(tmpl[j])
+		j++
+	}
+	if j == len(tmpl) {
+		return t, 0, fmt.Errorf("expand: incomplete variable at %d", i)
+	}
+
+	if tmpl[j] != '{' {
+		name, ok := shortVars[tmpl[j]]
+		if !ok {
+			return t, 0, fmt.Errorf("expand: unknown variable: %%%c", tmpl[j])
+		}
+		t.name = name
+		return t, j + 1, nil
+	}
+
+	end := strings.IndexByte(tmpl[j:], '}')
+	if end == -1 {
+		return t, 0, fmt.Errorf("expand: unterminated variable at %d", i)
+	}
+	body := tmpl[j+1 : j+end]
+	if body == "" {
+		return t, 0, fmt.Errorf("expand: empty variable name at %d", i)
+	}
+	if colon := strings.IndexByte(body, ':'); colon != -1 {
+		t.isFunc = true
+		t.name, t.arg = body[:colon], body[colon+1:]
+		if semi := strings.IndexByte(t.name, ';'); semi != -1 {
+			t.name, t.opts = t.name[:semi], t.name[semi+1:]
+		}
+	} else {
+		t.name = body
+		if t.name == "hostname" {
+			t.isFunc = true
+		}
+	}
+	return t, j + end + 1, nil
+}
+
+// Expand substitutes variables in tmpl. Values are passed through escape
+// if it is not nil. Unknown variables expand to an empty string, malformed
+// references are copied as is. Use Check to report such problems.
+func Expand(tmpl string, vars map[string]string, escape func(string) string) string {
+	var b strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' {
+			b.WriteByte(tmpl[i])
+			continue
+		}
+		if i+1 < len(tmpl) && tmpl[i+1] == '%' {
+			b.WriteByte('%')
+			i++
+			continue
+		}
+
+		t, end, err := parseToken(tmpl, i)
+		if err != nil {
+			b.WriteByte('%')
+			continue
+		}
+		val, _ := t.value(vars)
+		if escape != nil {
+			val = escape(val)
+		}
+		b.WriteString(val)
+		i = end - 1
+	}
+	return b.String()
+}
+
+// Check reports syntax errors, unknown variables and functions in tmpl.
+func Check(tmpl string) error {
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' {
+			continue
+		}
+		if i+1 < len(tmpl) && tmpl[i+1] == '%' {
+			i++
+			continue
+		}
+		t, end, err := parseToken(tmpl, i)
+		if err != nil {
+			return err
+		}
+		if _, err := t.value(nil); err != nil {
+			return err
+		}
+		i = end - 1
+	}
+	return nil
+}
+
+// IsKnown reports whether name is a variable name recognized by Check.
+func IsKnown(name string) bool {
+	if knownVars[name] {
+		return true
+	}
+	for _, long := range shortVars {
+		if long == name {
+			return true
+		}
+	}
+	return false
+}
+
+// value evaluates the token. With nil vars, only the validity is checked.
+func (t token) value(vars map[string]string) (string, error) {
+	var val string
+	switch {
+	case !t.isFunc:
+		if vars == nil && !IsKnown(t.name) {
+			return "", fmt.Errorf("expand: unknown variable: %s", t.name)
+		}
+		val = vars[t.name]
+	case t.name == "hostname":
+		val, _ = os.Hostname()
+	case t.name == "env":
+		val = os.Getenv(t.arg)
+	case hashFuncs[t.name] != nil:
+		if vars == nil && !IsKnown(t.arg) {
+			return "", fmt.Errorf("expand: unknown variable: %s", t.arg)
+		}
+		var err error
+		val, err = hashValue(t.name, t.opts, vars[t.arg])
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("expand: unknown function: %s", t.name)
+	}
+
+	for _, m := range t.modifiers {
+		val = modify(byte(m), val, t.width)
+	}
+	if strings.ContainsAny(t.modifiers, "HN") {
+		return val, nil
+	}
+	return t.truncate(val), nil
+}
+
+func (t token) truncate(val string) string {
+	if t.offset == 0 && !t.hasWidth {
+		return val
+	}
+	offset := t.offset
+	if offset < 0 {
+		offset += len(val)
+		if offset < 0 {
+			offset = 0
+		}
+	}
+	if offset > len(val) {
+		return ""
+	}
+	val = val[offset:]
+	if t.hasWidth && t.width < len(val) {
+		val = val[:t.width]
+	}
+	return val
+}
+
+func hashValue(name, opts, val string) (string, error) {
+	rounds := 1
+	format := "hex"
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("expand: malformed %s option: %s", name, opt)
+		}
+		switch parts[0] {
+		case "rounds":
+			n, err := strconv.Atoi(parts[1])
+			if err != nil || n < 1 {
+				return "", fmt.Errorf("expand: invalid %s rounds: %s", name, parts[1])
+			}
+			rounds = n
+		case "salt":
+			val = parts[1] + val
+		case "format":
+			switch parts[1] {
+			case "hex", "hex-uc", "base64":
+				format = parts[1]
+			default:
+				return "", fmt.Errorf("expand: unknown %s format: %s", name, parts[1])
+			}
+		default:
+			return "", fmt.Errorf("expand: unknown %s option: %s", name, parts[0])
+		}
+	}
+
+	sum := []byte(val)
+	for i := 0; i < rounds; i++ {
+		h := hashFuncs[name]()
+		h.Write(sum)
+		sum = h.Sum(nil)
+	}
+	switch format {
+	case "hex-uc":
+		return strings.ToUpper(hex.EncodeToString(sum)), nil
+	case "base64":
+		return base64.StdEncoding.EncodeToString(sum), nil
+	default:
+		return hex.EncodeToString(sum), nil
+	}
+}
+
+// strHash is Dovecot's str_hash.
+func strHash(s string) uint32 {
+	var h uint32
+	for i := 0; i < len(s); i++ {
+		h = (h << 4) + uint32(s[i])
+		if g := h & 0xf0000000; g != 0 {
+			h ^= g >> 24
+			h ^= g
+		}
+	}
+	return h
+}
+
+func modify(m byte, val string, width int) string {
+	switch m {
+	case 'L':
+		return strings.ToLower(val)
+	case 'U':
+		return strings.ToUpper(val)
+	case 'E':
+		return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `'`, `\'`).Replace(val)
+	case 'X':
+		n, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return ""
+		}
+		return strconv.FormatUint(n, 16)
+	case 'R':
+		r := []rune(val)
+		for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+			r[i], r[j] = r[j], r[i]
+		}
+		return string(r)
+	case 'D':
+		return strings.Replace(val, ".", ",dc=", -1)
+	case 'T':
+		return strings.TrimRightFunc(val, unicode.IsSpace)
+	case 'H', 'N':
+		var h uint32
+		if m == 'H' {
+			h = strHash(val)
+		} else {
+			sum := md5.Sum([]byte(val))
+			h = binary.BigEndian.Uint32(sum[:4])
+		}
+		if width > 0 {
+			h %= uint32(width)
+		}
+		return strconv.FormatUint(uint64(h), 16)
+	}
+	return val
+}
+
+// EscapeSQL escapes the value for use inside a single-quoted SQL string
+// literal with standard-conforming strings (SQLite, PostgreSQL), where
+// backslash is not special.
+func EscapeSQL(s string) string {
+	return strings.Replace(s, "'", "''", -1)
+}
+
+// EscapeMySQL escapes the value for use inside a single- or double-quoted
+// MySQL string literal. Single quotes are doubled, so the result is also
+// safe inside single quotes with the NO_BACKSLASH_ESCAPES mode (though
+// backslashes are then kept doubled).
+func EscapeMySQL(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		"'", "''",
+		`"`, `\"`,
+		"\x00", `\0`,
+		"\n", `\n`,
+		"\r", `\r`,
+		"\x1a", `\Z`,
+	).Replace(s)
+}
+
+// EscapeLDAPFilter escapes the value for use in an LDAP search filter as
+// defined in RFC 4515.
+func EscapeLDAPFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == 0 || c == '(' || c == ')' || c == '*' || c == '\\' || c > 0x7f {
+			fmt.Fprintf(&b, `\%02x`, c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// EscapeLDAPDN escapes the value for use in a DN attribute value as
+// defined in RFC 4514.
+func EscapeLDAPDN(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == 0:
+			b.WriteString(`\00`)
+			continue
+		case strings.IndexByte(`,+"\<>;=`, c) != -1,
+			(c == ' ' || c == '#') && i == 0,
+			c == ' ' && i == len(s)-1:
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
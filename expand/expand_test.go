@@ -0,0 +1,115 @@
+package expand
+
+import (
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{
+		"user":     "FoxCpp@Example.org",
+		"username": "FoxCpp",
+		"domain":   "Example.org",
+		"service":  "imap",
+		"rip":      "192.0.2.1",
+		"lport":    "255",
+	}
+
+	cases := []struct {
+		tmpl string
+		out  string
+	}{
+		{"%u", "FoxCpp@Example.org"},
+		{"/var/vmail/%d/%n", "/var/vmail/Example.org/FoxCpp"},
+		{"%{rip}:%{service}", "192.0.2.1:imap"},
+		{"%Lu", "foxcpp@example.org"},
+		{"%L{domain}", "example.org"},
+		{"%Un", "FOXCPP"},
+		{"%1n", "F"},
+		{"%1.2n", "ox"},
+		{"%-3.3n", "Cpp"},
+		{"%Rn", "ppCxoF"},
+		{"%Xa", "ff"},
+		{"%Dd", "Example,dc=org"},
+		{"%{sha256:user}", "5b1907696ac9720a4ebf19257e93d9d881dfca31aa11bb81e095dff68edf7636"},
+		{"%{md5;format=hex-uc:username}", "4C020FD9CFF262FA4F7C4D683A8072C8"},
+		{"%%u", "%u"},
+		{"%{unknown}", ""},
+		{"100%", "100%"},
+		{"%{rip", "%{rip"},
+	}
+	for _, c := range cases {
+		if out := Expand(c.tmpl, vars, nil); out != c.out {
+			t.Errorf("Expand(%q) = %q, want %q", c.tmpl, out, c.out)
+		}
+	}
+}
+
+func TestExpandHash(t *testing.T) {
+	vars := map[string]string{"user": "foxcpp"}
+	if out := Expand("%{sha256;salt=fox:username}", map[string]string{"username": "cpp"}, nil); out != "ad47fd17789f255d374dc1d8342f9139950a1eb6edf5283c957431bbb3d901f6" {
+		t.Errorf("unexpected salted sha256: %q", out)
+	}
+	if out := Expand("%{sha1;rounds=2,format=base64:user}", vars, nil); len(out) != 28 {
+		t.Errorf("unexpected base64 sha1: %q", out)
+	}
+	if out := Expand("%256Hu", vars, nil); len(out) > 2 {
+		t.Errorf("%%256Hu should be below 0x100: %q", out)
+	}
+	if Expand("%Nu", vars, nil) != Expand("%Nu", vars, nil) {
+		t.Errorf("%%Nu is not stable")
+	}
+}
+
+func TestExpandEscape(t *testing.T) {
+	vars := map[string]string{"user": "o'brien", "username": "a*(b)\\"}
+
+	if out := Expand("SELECT * FROM users WHERE user = '%u'", vars, EscapeSQL); out != "SELECT * FROM users WHERE user = 'o''brien'" {
+		t.Errorf("unexpected SQL: %q", out)
+	}
+	if out := EscapeMySQL("x\\' OR 1=1 -- \n"); out != `x\\'' OR 1=1 -- \n` {
+		t.Errorf("unexpected MySQL string: %q", out)
+	}
+	if out := EscapeMySQL(`x" OR 1=1 -- `); out != `x\" OR 1=1 -- ` {
+		t.Errorf("unexpected MySQL string: %q", out)
+	}
+	if out := Expand("(uid=%n)", vars, EscapeLDAPFilter); out != `(uid=a\2a\28b\29\5c)` {
+		t.Errorf("unexpected LDAP filter: %q", out)
+	}
+	if out := EscapeLDAPDN(" a,b+c "); out != `\ a\,b\+c\ ` {
+		t.Errorf("unexpected LDAP DN: %q", out)
+	}
+	if out := Expand("%Eu", vars, nil); out != `o\'brien` {
+		t.Errorf("unexpected E modifier result: %q", out)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	valid := []string{
+		"%u", "%Lu", "%1.2n", "%{rip}", "%{orig_user}", "%{sha256:user}",
+		"%{sha512;rounds=5000,salt=x:username}", "%{env:HOME}", "%{hostname}", "100%%",
+	}
+	for _, tmpl := range valid {
+		if err := Check(tmpl); err != nil {
+			t.Errorf("Check(%q): %v", tmpl, err)
+		}
+	}
+
+	invalid := []string{
+		"%q", "%{unknown}", "%{rip", "%{}", "%L", "%1.", "%{rot13:user}",
+		"%{sha256:unknown}", "%{sha256;format=octal:user}", "%{sha256;rounds=0:user}",
+	}
+	for _, tmpl := range invalid {
+		if err := Check(tmpl); err == nil {
+			t.Errorf("Check(%q): expected an error", tmpl)
+		}
+	}
+}
+
+func TestTokenAt(t *testing.T) {
+	tmpl := "a=%Lu b=%{rip} c=%1.2n d=%{x"
+	for i, want := range map[int]string{2: "%Lu", 8: "%{rip}", 17: "%1.2n", 25: ""} {
+		if got := TokenAt(tmpl, i); got != want {
+			t.Errorf("TokenAt(%d) = %q, want %q", i, got, want)
+		}
+	}
+}
@@ -2,4 +2,13 @@ module github.com/foxcpp/go-dovecot-sasl
 
 go 1.14
 
-require github.com/emersion/go-sasl v0.0.0-20191210011802-430746ea8b9b
+require (
+	github.com/emersion/go-sasl v0.0.0-20191210011802-430746ea8b9b
+	github.com/go-asn1-ber/asn1-ber v1.5.1
+	github.com/go-ldap/ldap/v3 v3.2.4
+	github.com/mattn/go-sqlite3 v1.14.6
+	github.com/yuin/gopher-lua v0.0.0-20200816102855-ee81675732da
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/net v0.0.0-20201224014010-6772e930b67b
+	golang.org/x/text v0.3.5
+)
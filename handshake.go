@@ -70,7 +70,7 @@ func (mech Mechanism) format(name string) []string {
 		params = append(params, "mutual-auth")
 	}
 	if mech.Private {
-		params = append(params, "mutual-auth")
+		params = append(params, "private")
 	}
 	return params
 }
@@ -0,0 +1,331 @@
+// Package imapdb implements passdb backend that verifies passwords by
+// logging into a remote IMAP server, similar to Dovecot's IMAP passdb.
+package imapdb
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	"github.com/foxcpp/go-dovecot-sasl/expand"
+)
+
+// DB is the IMAP backend. It implements dovecotsasl.Passdb.
+//
+// A new connection is used for each verification.
+type DB struct {
+	// Server address (host:port).
+	Addr string
+
+	// Use implicit TLS (IMAPS).
+	TLS bool
+
+	// Upgrade the connection using STARTTLS.
+	StartTLS bool
+
+	// TLS configuration for TLS and StartTLS.
+	TLSConfig *tls.Config
+
+	// Login method: "LOGIN" (LOGIN command) or "PLAIN" (AUTHENTICATE PLAIN).
+	// If the server does not permit it (LOGINDISABLED or no AUTH=PLAIN
+	// capability), verification fails with an internal failure.
+	Mech string
+
+	// Template used to build the remote username, %u by default.
+	UsernameFormat string
+
+	// Timeout for the whole login.
+	Timeout time.Duration
+}
+
+func New(addr string) *DB {
+	return &DB{
+		Addr:           addr,
+		Mech:           "LOGIN",
+		UsernameFormat: "%u",
+		Timeout:        30 * time.Second,
+	}
+}
+
+type imapConn struct {
+	net.Conn
+	r   *bufio.Reader
+	tag int
+}
+
+func (c *imapConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *imapConn) writeLine(line string) error {
+	_, err := c.Write([]byte(line + "\r\n"))
+	return err
+}
+
+// status is the tagged command completion.
+type status struct {
+	kind string // OK, NO, BAD
+	text string
+}
+
+// readStatus skips untagged responses until the tagged one (or continuation
+// request if cont is true).
+func (c *imapConn) readStatus(tag string, cont bool) (status, error) {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return status{}, err
+		}
+		if cont && strings.HasPrefix(line, "+") {
+			return status{kind: "+", text: strings.TrimSpace(line[1:])}, nil
+		}
+		if !strings.HasPrefix(line, tag+" ") {
+			if strings.HasPrefix(line, "* BYE") {
+				return status{}, fmt.Errorf("imapdb: server closed connection: %s", line)
+			}
+			continue
+		}
+		parts := strings.SplitN(line[len(tag)+1:], " ", 2)
+		st := status{kind: strings.ToUpper(parts[0])}
+		if len(parts) == 2 {
+			st.text = parts[1]
+		}
+		return st, nil
+	}
+}
+
+func (c *imapConn) command(cmd string) (string, error) {
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+	return tag, c.writeLine(tag + " " + cmd)
+}
+
+// quote formats the IMAP quoted string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// needsLiteral reports whether s can not be sent as a quoted string:
+// quoted strings are limited to 7-bit characters.
+func needsLiteral(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// commandArgs sends the command with string arguments, using synchronizing
+// literals for values that can not be quoted. If the server rejects a
+// literal, its tagged status is returned.
+func (c *imapConn) commandArgs(cmd string, args ...string) (string, *status, error) {
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+	line := tag + " " + cmd
+	for _, arg := range args {
+		if !needsLiteral(arg) {
+			line += " " + quote(arg)
+			continue
+		}
+		if err := c.writeLine(line + fmt.Sprintf(" {%d}", len(arg))); err != nil {
+			return "", nil, err
+		}
+		st, err := c.readStatus(tag, true)
+		if err != nil {
+			return "", nil, err
+		}
+		if st.kind != "+" {
+			return tag, &st, nil
+		}
+		line = arg
+	}
+	return tag, nil, c.writeLine(line)
+}
+
+// capabilities runs the CAPABILITY command and returns the capabilities in
+// upper case.
+func (c *imapConn) capabilities() (map[string]bool, error) {
+	tag, err := c.command("CAPABILITY")
+	if err != nil {
+		return nil, err
+	}
+	caps := make(map[string]bool)
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(strings.ToUpper(line), "* CAPABILITY ") {
+			for _, capa := range strings.Fields(line[len("* CAPABILITY "):]) {
+				caps[strings.ToUpper(capa)] = true
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "* BYE") {
+			return nil, fmt.Errorf("imapdb: server closed connection: %s", line)
+		}
+		if !strings.HasPrefix(line, tag+" ") {
+			continue
+		}
+		if !strings.HasPrefix(strings.ToUpper(line[len(tag)+1:]), "OK") {
+			return nil, fmt.Errorf("imapdb: CAPABILITY failed: %s", line[len(tag)+1:])
+		}
+		return caps, nil
+	}
+}
+
+func (db *DB) dial(ctx context.Context) (*imapConn, error) {
+	dialer := &net.Dialer{}
+	netConn, err := dialer.DialContext(ctx, "tcp", db.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		netConn.SetDeadline(deadline)
+	}
+
+	tlsConfig := db.TLSConfig
+	if tlsConfig == nil {
+		host, _, _ := net.SplitHostPort(db.Addr)
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+	if db.TLS {
+		netConn = tls.Client(netConn, tlsConfig)
+	}
+
+	c := &imapConn{Conn: netConn, r: bufio.NewReader(netConn)}
+	greeting, err := c.readLine()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		c.Close()
+		return nil, fmt.Errorf("imapdb: unexpected greeting: %s", greeting)
+	}
+
+	if db.StartTLS && !db.TLS {
+		tag, err := c.command("STARTTLS")
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		st, err := c.readStatus(tag, false)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		if st.kind != "OK" {
+			c.Close()
+			return nil, fmt.Errorf("imapdb: STARTTLS failed: %s %s", st.kind, st.text)
+		}
+		tlsConn := tls.Client(c.Conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.Conn = tlsConn
+		c.r = bufio.NewReader(tlsConn)
+	}
+	return c, nil
+}
+
+// login runs the login command and returns its completion status. An
+// error is returned if the server does not permit the login method, so
+// the rejection is not mistaken for wrong credentials.
+func (db *DB) login(c *imapConn, user, pass string) (status, error) {
+	caps, err := c.capabilities()
+	if err != nil {
+		return status{}, err
+	}
+
+	switch strings.ToUpper(db.Mech) {
+	case "PLAIN":
+		if !caps["AUTH=PLAIN"] {
+			return status{}, errors.New("imapdb: server does not support AUTHENTICATE PLAIN")
+		}
+		tag, err := c.command("AUTHENTICATE PLAIN")
+		if err != nil {
+			return status{}, err
+		}
+		st, err := c.readStatus(tag, true)
+		if err != nil || st.kind != "+" {
+			return st, err
+		}
+		ir := base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + pass))
+		if err := c.writeLine(ir); err != nil {
+			return status{}, err
+		}
+		return c.readStatus(tag, false)
+	case "LOGIN", "":
+		if caps["LOGINDISABLED"] {
+			return status{}, errors.New("imapdb: LOGIN is disabled by the server")
+		}
+		tag, st, err := c.commandArgs("LOGIN", user, pass)
+		if err != nil {
+			return status{}, err
+		}
+		if st != nil {
+			return *st, nil
+		}
+		return c.readStatus(tag, false)
+	default:
+		return status{}, fmt.Errorf("imapdb: unsupported login method: %s", db.Mech)
+	}
+}
+
+func (db *DB) VerifyPlain(ctx context.Context, req *dovecotsasl.AuthReq, user, pass string) (*dovecotsasl.PassdbResult, error) {
+	remoteUser := expand.Expand(db.UsernameFormat, req.Vars(user), nil)
+	if pass == "" || strings.ContainsAny(remoteUser+pass, "\r\n\x00") {
+		return nil, dovecotsasl.ErrPasswordMismatch
+	}
+
+	if db.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, db.Timeout)
+		defer cancel()
+	}
+
+	c, err := db.dial(ctx)
+	if err != nil {
+		return nil, dovecotsasl.PassdbInternalError(fmt.Errorf("imapdb: %w", err))
+	}
+	defer c.Close()
+
+	st, err := db.login(c, remoteUser, pass)
+	if err != nil {
+		return nil, dovecotsasl.PassdbInternalError(fmt.Errorf("imapdb: %w", err))
+	}
+	switch st.kind {
+	case "OK":
+		if tag, err := c.command("LOGOUT"); err == nil {
+			c.readStatus(tag, false)
+		}
+		return &dovecotsasl.PassdbResult{}, nil
+	case "NO":
+		// Temporary failures are signaled using response codes (RFC 5530).
+		if strings.HasPrefix(st.text, "[UNAVAILABLE]") || strings.HasPrefix(st.text, "[SERVERBUG]") {
+			return nil, dovecotsasl.PassdbInternalError(fmt.Errorf("imapdb: login failed: %s", st.text))
+		}
+		return nil, dovecotsasl.ErrPasswordMismatch
+	default:
+		return nil, dovecotsasl.PassdbInternalError(fmt.Errorf("imapdb: login failed: %s %s", st.kind, st.text))
+	}
+}
+
+// LookupCredentials always returns dovecotsasl.ErrSchemeNotAvailable.
+func (db *DB) LookupCredentials(context.Context, *dovecotsasl.AuthReq, string, string) (*dovecotsasl.PassdbResult, error) {
+	return nil, dovecotsasl.ErrSchemeNotAvailable
+}
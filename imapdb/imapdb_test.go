@@ -0,0 +1,136 @@
+package imapdb
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	"github.com/foxcpp/go-dovecot-sasl/imapdb/imaptest"
+)
+
+func testTLSConfig(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	client = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	return server, client
+}
+
+func TestIMAPLogin(t *testing.T) {
+	srv, err := imaptest.NewServer(map[string]string{
+		"foxcpp@example.org": `{PLAIN}1234 "quoted" \`,
+		"jürgen@example.org": "{PLAIN}päss wörd",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ctx := context.Background()
+
+	for _, mech := range []string{"LOGIN", "PLAIN"} {
+		db := New(srv.Addr())
+		db.Mech = mech
+
+		if _, err := db.VerifyPlain(ctx, nil, "foxcpp@example.org", `1234 "quoted" \`); err != nil {
+			t.Errorf("%s: %v", mech, err)
+		}
+		if _, err := db.VerifyPlain(ctx, nil, "foxcpp@example.org", "5678"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+			t.Errorf("%s: expected password mismatch, got %v", mech, err)
+		}
+		if _, err := db.VerifyPlain(ctx, nil, "jürgen@example.org", "päss wörd"); err != nil {
+			t.Errorf("%s: non-ASCII credentials: %v", mech, err)
+		}
+		if _, err := db.VerifyPlain(ctx, nil, "jürgen@example.org", "pass wörd"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+			t.Errorf("%s: expected password mismatch for non-ASCII credentials, got %v", mech, err)
+		}
+		if _, err := db.VerifyPlain(ctx, nil, "foxcpp@example.org", "1234\r\na2 LOGOUT"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+			t.Errorf("%s: expected password mismatch for CRLF, got %v", mech, err)
+		}
+		if _, err := db.VerifyPlain(ctx, nil, "nobody@example.org", "1234"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+			t.Errorf("%s: expected password mismatch for unknown user, got %v", mech, err)
+		}
+	}
+
+	srv.Unavailable = true
+	if _, err := New(srv.Addr()).VerifyPlain(ctx, nil, "foxcpp@example.org", "1234"); dovecotsasl.PassdbStatusOf(err) != dovecotsasl.PassdbInternalFailure {
+		t.Errorf("expected internal failure, got %v", err)
+	}
+}
+
+func TestIMAPLoginNotPermitted(t *testing.T) {
+	srv, err := imaptest.NewServer(map[string]string{"foxcpp": "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.LoginDisabled = true
+	srv.NoAuthPlain = true
+
+	// Rejected login methods are not wrong credentials.
+	for _, mech := range []string{"LOGIN", "PLAIN"} {
+		db := New(srv.Addr())
+		db.Mech = mech
+		if _, err := db.VerifyPlain(context.Background(), nil, "foxcpp", "1234"); dovecotsasl.PassdbStatusOf(err) != dovecotsasl.PassdbInternalFailure {
+			t.Errorf("%s: expected internal failure, got %v", mech, err)
+		}
+	}
+	if srv.Logins() != 0 {
+		t.Errorf("login is attempted although it is not permitted")
+	}
+}
+
+func TestIMAPStartTLS(t *testing.T) {
+	srv, err := imaptest.NewServer(map[string]string{"foxcpp": "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	var clientCfg *tls.Config
+	srv.TLSConfig, clientCfg = testTLSConfig(t)
+
+	db := New(srv.Addr())
+	db.StartTLS = true
+	db.TLSConfig = clientCfg
+	db.UsernameFormat = "%n"
+	if _, err := db.VerifyPlain(context.Background(), nil, "foxcpp@example.org", "1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, db.TLSConfig = testTLSConfig(t)
+	if _, err := db.VerifyPlain(context.Background(), nil, "foxcpp@example.org", "1234"); dovecotsasl.PassdbStatusOf(err) != dovecotsasl.PassdbInternalFailure {
+		t.Errorf("expected internal failure due to untrusted certificate, got %v", err)
+	}
+}
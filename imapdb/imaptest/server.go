@@ -0,0 +1,319 @@
+// Package imaptest provides an in-process fake IMAP server for testing
+// IMAP login clients.
+//
+// Only commands needed for authentication are implemented: CAPABILITY,
+// NOOP, STARTTLS, LOGIN, AUTHENTICATE PLAIN and LOGOUT.
+package imaptest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/foxcpp/go-dovecot-sasl/pwscheme"
+)
+
+// Server is the fake IMAP server.
+//
+// Users maps usernames to passwords (plaintext or in Dovecot
+// "{SCHEME}hash" format).
+type Server struct {
+	// Allow STARTTLS using this configuration.
+	TLSConfig *tls.Config
+
+	// Reply to all logins with NO [UNAVAILABLE].
+	Unavailable bool
+
+	// Advertise LOGINDISABLED and reject LOGIN commands.
+	LoginDisabled bool
+
+	// Do not advertise AUTH=PLAIN and reject AUTHENTICATE PLAIN.
+	NoAuthPlain bool
+
+	usersLock sync.RWMutex
+	users     map[string]string
+
+	l     net.Listener
+	wg    sync.WaitGroup
+	conns sync.Map
+
+	loginsLock sync.Mutex
+	logins     int
+}
+
+// NewServer starts the server listening on a random local TCP port.
+func NewServer(users map[string]string) (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		users: make(map[string]string),
+		l:     l,
+	}
+	for user, pass := range users {
+		s.users[user] = pass
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the host:port address of the server.
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// SetUser adds or updates the user.
+func (s *Server) SetUser(user, pass string) {
+	s.usersLock.Lock()
+	defer s.usersLock.Unlock()
+	s.users[user] = pass
+}
+
+// Logins returns the number of login attempts processed so far.
+func (s *Server) Logins() int {
+	s.loginsLock.Lock()
+	defer s.loginsLock.Unlock()
+	return s.logins
+}
+
+func (s *Server) Close() error {
+	err := s.l.Close()
+	s.conns.Range(func(k, _ interface{}) bool {
+		k.(net.Conn).Close()
+		return true
+	})
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.conns.Store(conn, struct{}{})
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *Server) checkLogin(user, pass string) bool {
+	s.loginsLock.Lock()
+	s.logins++
+	s.loginsLock.Unlock()
+
+	s.usersLock.RLock()
+	stored, ok := s.users[user]
+	s.usersLock.RUnlock()
+	if !ok {
+		return false
+	}
+	ok, err := pwscheme.Verify(stored, "PLAIN", pass)
+	return ok && err == nil
+}
+
+// parseAString parses IMAP atom or quoted string, returning the rest of
+// the line. Literals are handled by the caller.
+func parseAString(s string) (string, string, error) {
+	if s == "" {
+		return "", "", errors.New("missing argument")
+	}
+	if s[0] != '"' {
+		idx := strings.IndexByte(s, ' ')
+		if idx == -1 {
+			return s, "", nil
+		}
+		return s[:idx], s[idx+1:], nil
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", errors.New("unterminated quoted string")
+			}
+			b.WriteByte(s[i])
+		case '"':
+			return b.String(), strings.TrimPrefix(s[i+1:], " "), nil
+		default:
+			if s[i] >= 0x80 {
+				return "", "", errors.New("8-bit characters in quoted string")
+			}
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", errors.New("unterminated quoted string")
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer func() {
+		s.conns.Delete(conn)
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	write := func(line string) error {
+		_, err := conn.Write([]byte(line + "\r\n"))
+		return err
+	}
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	// readAString parses the astring at the start of s, reading the
+	// synchronizing literal if s ends with it.
+	readAString := func(s string) (string, string, error) {
+		if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+			return parseAString(s)
+		}
+		n, err := strconv.Atoi(s[1 : len(s)-1])
+		if err != nil || n < 0 {
+			return "", "", errors.New("malformed literal")
+		}
+		if err := write("+ Ready for literal data"); err != nil {
+			return "", "", err
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", "", err
+		}
+		rest, err := readLine()
+		if err != nil {
+			return "", "", err
+		}
+		return string(buf), strings.TrimPrefix(rest, " "), nil
+	}
+	loginResult := func(tag string, ok bool) error {
+		switch {
+		case s.Unavailable:
+			return write(tag + " NO [UNAVAILABLE] Backend is down")
+		case ok:
+			return write(tag + " OK Logged in")
+		default:
+			return write(tag + " NO [AUTHENTICATIONFAILED] Authentication failed")
+		}
+	}
+
+	if err := write("* OK IMAP4rev1 fake server ready"); err != nil {
+		return
+	}
+	for {
+		line, err := readLine()
+		if err != nil {
+			return
+		}
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 2 {
+			if err := write("* BAD Missing command"); err != nil {
+				return
+			}
+			continue
+		}
+		tag, cmd, args := parts[0], strings.ToUpper(parts[1]), ""
+		if len(parts) == 3 {
+			args = parts[2]
+		}
+
+		switch cmd {
+		case "CAPABILITY":
+			caps := "IMAP4rev1"
+			if !s.NoAuthPlain {
+				caps += " AUTH=PLAIN"
+			}
+			if s.LoginDisabled {
+				caps += " LOGINDISABLED"
+			}
+			if s.TLSConfig != nil {
+				caps += " STARTTLS"
+			}
+			err = write("* CAPABILITY " + caps)
+			if err == nil {
+				err = write(tag + " OK Done")
+			}
+		case "NOOP":
+			err = write(tag + " OK Done")
+		case "LOGOUT":
+			write("* BYE Logging out")
+			write(tag + " OK Done")
+			return
+		case "STARTTLS":
+			if s.TLSConfig == nil {
+				err = write(tag + " BAD STARTTLS is not supported")
+				break
+			}
+			if err := write(tag + " OK Begin TLS negotiation now"); err != nil {
+				return
+			}
+			tlsConn := tls.Server(conn, s.TLSConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			s.conns.Delete(conn)
+			s.conns.Store(tlsConn, struct{}{})
+			conn = tlsConn
+			r = bufio.NewReader(conn)
+		case "LOGIN":
+			user, rest, uerr := readAString(args)
+			pass, _, perr := "", "", uerr
+			if uerr == nil {
+				pass, _, perr = readAString(rest)
+			}
+			if uerr != nil || perr != nil {
+				err = write(tag + " BAD Malformed arguments")
+				break
+			}
+			if s.LoginDisabled {
+				err = write(tag + " NO [PRIVACYREQUIRED] LOGIN is disabled")
+				break
+			}
+			err = loginResult(tag, s.checkLogin(user, pass))
+		case "AUTHENTICATE":
+			argParts := strings.SplitN(args, " ", 2)
+			if strings.ToUpper(argParts[0]) != "PLAIN" || s.NoAuthPlain {
+				err = write(tag + " NO Unsupported mechanism")
+				break
+			}
+			resp := ""
+			if len(argParts) == 2 {
+				resp = argParts[1]
+			} else {
+				if err := write("+ "); err != nil {
+					return
+				}
+				if resp, err = readLine(); err != nil {
+					return
+				}
+			}
+			if resp == "*" {
+				err = write(tag + " BAD Authentication aborted")
+				break
+			}
+			decoded, derr := base64.StdEncoding.DecodeString(resp)
+			fields := strings.Split(string(decoded), "\x00")
+			if derr != nil || len(fields) != 3 {
+				err = write(tag + " BAD Malformed response")
+				break
+			}
+			err = loginResult(tag, (fields[0] == "" || fields[0] == fields[1]) && s.checkLogin(fields[1], fields[2]))
+		default:
+			err = write(tag + " BAD Unknown command")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// Package ldapdb implements passdb and userdb backend using an LDAP
+// directory, similar to Dovecot's LDAP driver.
+//
+// Two passdb modes are supported:
+//   - password lookup: the entry is found using PassFilter and the password
+//     is read from the attribute mapped to "password" field;
+//   - authentication bind (AuthBind = true): the password is verified by
+//     binding as the user. User DN is built from AuthBindUserDN template or
+//     found using PassFilter.
+//
+// See https://doc.dovecot.org/configuration_manual/authentication/ldap/.
+package ldapdb
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	"github.com/foxcpp/go-dovecot-sasl/expand"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// DB is the LDAP backend. It implements dovecotsasl.Passdb.
+type DB struct {
+	// Server URL, ldap://, ldaps:// and ldapi:// schemes are supported.
+	URL string
+
+	// Upgrade ldap:// connections using StartTLS.
+	StartTLS bool
+
+	// TLS configuration for ldaps:// and StartTLS.
+	TLSConfig *tls.Config
+
+	// Credentials used for lookups. Anonymous bind is used if empty.
+	BindDN       string
+	BindPassword string
+
+	// Search base and scope (ldap.ScopeWholeSubtree by default).
+	Base  string
+	Scope int
+
+	// Filter used for passdb lookups, e.g. (&(objectClass=posixAccount)(uid=%u)).
+	PassFilter string
+
+	// Filter used for userdb lookups. PassFilter is used if empty.
+	UserFilter string
+
+	// Mapping of LDAP attributes to passdb fields, "password" and "user"
+	// fields are handled specially, the rest are extra fields.
+	PassAttrs map[string]string
+
+	// Mapping of LDAP attributes to userdb fields.
+	UserAttrs map[string]string
+
+	// Verify passwords by binding as the user.
+	AuthBind bool
+
+	// DN template for authentication binds, e.g.
+	// uid=%n,ou=people,dc=example,dc=org. If empty, DN is found using
+	// PassFilter.
+	AuthBindUserDN string
+
+	// Scheme to use for passwords without {SCHEME} prefix.
+	DefaultScheme string
+
+	// Maximum number of connections for lookups and for authentication
+	// binds (separately).
+	PoolSize int
+
+	// Timeout for connection establishment and requests.
+	Timeout time.Duration
+
+	initOnce   sync.Once
+	lookupPool *pool
+	bindPool   *pool
+}
+
+func New(url string) *DB {
+	db := &DB{
+		URL:           url,
+		Scope:         ldap.ScopeWholeSubtree,
+		PassAttrs:     map[string]string{"userPassword": "password"},
+		UserAttrs:     map[string]string{"homeDirectory": "home", "uidNumber": "uid", "gidNumber": "gid"},
+		DefaultScheme: "CRYPT",
+		PoolSize:      8,
+		Timeout:       10 * time.Second,
+	}
+	return db
+}
+
+// init creates connection pools. Configuration fields should not be changed
+// after the first lookup.
+func (db *DB) init() {
+	db.lookupPool = newPool(db.PoolSize, func() (*ldap.Conn, error) {
+		conn, err := db.dial()
+		if err != nil {
+			return nil, err
+		}
+		if db.BindDN != "" {
+			err = conn.Bind(db.BindDN, db.BindPassword)
+		} else {
+			err = conn.UnauthenticatedBind("")
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	})
+	db.bindPool = newPool(db.PoolSize, db.dial)
+}
+
+func (db *DB) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(db.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: db.Timeout}),
+		ldap.DialWithTLSConfig(db.TLSConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(db.Timeout)
+	if db.StartTLS {
+		if err := conn.StartTLS(db.TLSConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// EscapeDN escapes the value for use in a DN attribute value as defined in
+// RFC 4514.
+func EscapeDN(s string) string {
+	return expand.EscapeLDAPDN(s)
+}
+
+func (db *DB) search(ctx context.Context, filterTmpl string, attrMap map[string]string, req *dovecotsasl.AuthReq, user string) (*ldap.Entry, error) {
+	db.initOnce.Do(db.init)
+
+	vars := req.Vars(user)
+	filter := expand.Expand(filterTmpl, vars, expand.EscapeLDAPFilter)
+
+	attrs := make([]string, 0, len(attrMap))
+	for attr := range attrMap {
+		attrs = append(attrs, attr)
+	}
+
+	conn, err := db.lookupPool.get(ctx)
+	if err != nil {
+		return nil, dovecotsasl.PassdbInternalError(err)
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		expand.Expand(db.Base, vars, EscapeDN), db.Scope, ldap.NeverDerefAliases,
+		2, int(db.Timeout/time.Second), false, filter, attrs, nil))
+	db.lookupPool.put(conn, err != nil && !isResultError(err))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, dovecotsasl.ErrUserUnknown
+		}
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return nil, dovecotsasl.PassdbInternalError(errors.New("ldapdb: multiple entries match the filter"))
+		}
+		return nil, dovecotsasl.PassdbInternalError(err)
+	}
+	switch len(res.Entries) {
+	case 0:
+		return nil, dovecotsasl.ErrUserUnknown
+	case 1:
+		return res.Entries[0], nil
+	default:
+		return nil, dovecotsasl.PassdbInternalError(errors.New("ldapdb: multiple entries match the filter"))
+	}
+}
+
+// isResultError reports whether err is an LDAP result code (the connection
+// is still usable) rather than a network failure.
+func isResultError(err error) bool {
+	var lerr *ldap.Error
+	if !errors.As(err, &lerr) {
+		return false
+	}
+	return lerr.ResultCode < ldap.ErrorNetwork
+}
+
+// mapAttrs converts entry attributes into fields. Multiple values are
+// joined using comma.
+func mapAttrs(e *ldap.Entry, attrMap map[string]string) map[string]string {
+	fields := make(map[string]string)
+	for attr, field := range attrMap {
+		values := e.GetAttributeValues(attr)
+		if len(values) == 0 {
+			continue
+		}
+		fields[field] = strings.Join(values, ",")
+	}
+	return fields
+}
+
+func passdbResult(fields map[string]string) *dovecotsasl.PassdbResult {
+	res := &dovecotsasl.PassdbResult{
+		User:  fields["user"],
+		Extra: make(map[string]string),
+	}
+	for k, v := range fields {
+		if k == "user" || k == "password" {
+			continue
+		}
+		res.Extra[k] = v
+	}
+	return res
+}
+
+func (db *DB) authBind(ctx context.Context, req *dovecotsasl.AuthReq, user, pass string) (*dovecotsasl.PassdbResult, error) {
+	if pass == "" {
+		// Empty password would be an anonymous bind.
+		return nil, dovecotsasl.ErrPasswordMismatch
+	}
+
+	var (
+		dn  string
+		res = &dovecotsasl.PassdbResult{}
+	)
+	if db.AuthBindUserDN != "" {
+		dn = expand.Expand(db.AuthBindUserDN, req.Vars(user), EscapeDN)
+	} else {
+		e, err := db.search(ctx, db.PassFilter, db.PassAttrs, req, user)
+		if err != nil {
+			return nil, err
+		}
+		dn = e.DN
+		res = passdbResult(mapAttrs(e, db.PassAttrs))
+	}
+
+	db.initOnce.Do(db.init)
+	conn, err := db.bindPool.get(ctx)
+	if err != nil {
+		return nil, dovecotsasl.PassdbInternalError(err)
+	}
+	err = conn.Bind(dn, pass)
+	db.bindPool.put(conn, err != nil && !isResultError(err))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, dovecotsasl.ErrPasswordMismatch
+		}
+		return nil, dovecotsasl.PassdbInternalError(fmt.Errorf("ldapdb: bind as %s: %w", dn, err))
+	}
+	return res, nil
+}
+
+func (db *DB) VerifyPlain(ctx context.Context, req *dovecotsasl.AuthReq, user, pass string) (*dovecotsasl.PassdbResult, error) {
+	if db.AuthBind {
+		return db.authBind(ctx, req, user, pass)
+	}
+
+	e, err := db.search(ctx, db.PassFilter, db.PassAttrs, req, user)
+	if err != nil {
+		return nil, err
+	}
+	fields := mapAttrs(e, db.PassAttrs)
+	res := passdbResult(fields)
+	if _, ok := res.Extra["nopassword"]; ok {
+		return res, nil
+	}
+	password, ok := fields["password"]
+	if !ok {
+		return nil, dovecotsasl.ErrPasswordMismatch
+	}
+	if err := dovecotsasl.VerifyPassword(password, db.DefaultScheme, pass); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (db *DB) LookupCredentials(ctx context.Context, req *dovecotsasl.AuthReq, user, scheme string) (*dovecotsasl.PassdbResult, error) {
+	if db.AuthBind {
+		return nil, dovecotsasl.ErrSchemeNotAvailable
+	}
+
+	e, err := db.search(ctx, db.PassFilter, db.PassAttrs, req, user)
+	if err != nil {
+		return nil, err
+	}
+	fields := mapAttrs(e, db.PassAttrs)
+	password, ok := fields["password"]
+	if !ok {
+		return nil, dovecotsasl.ErrCredentialsUnavailable
+	}
+	res := passdbResult(fields)
+	res.Credentials, err = dovecotsasl.PasswordCredentials(password, db.DefaultScheme, scheme)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// LookupUser returns userdb fields for the user using UserFilter and
+// UserAttrs.
+func (db *DB) LookupUser(ctx context.Context, req *dovecotsasl.AuthReq, user string) (map[string]string, error) {
+	filter := db.UserFilter
+	if filter == "" {
+		filter = db.PassFilter
+	}
+	e, err := db.search(ctx, filter, db.UserAttrs, req, user)
+	if err != nil {
+		return nil, err
+	}
+	return mapAttrs(e, db.UserAttrs), nil
+}
+
+// Close closes all pooled connections.
+func (db *DB) Close() error {
+	if db.lookupPool != nil {
+		db.lookupPool.close()
+	}
+	if db.bindPool != nil {
+		db.bindPool.close()
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package ldapdb
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	"github.com/foxcpp/go-dovecot-sasl/ldapdb/ldaptest"
+)
+
+func testServer(t *testing.T) *ldaptest.Server {
+	t.Helper()
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{
+			DN: "cn=admin,dc=example,dc=org",
+			Attrs: map[string][]string{
+				"cn":           {"admin"},
+				"userPassword": {"secret"},
+			},
+		},
+		ldaptest.Entry{
+			DN: "uid=foxcpp,ou=people,dc=example,dc=org",
+			Attrs: map[string][]string{
+				"objectClass":   {"posixAccount"},
+				"uid":           {"foxcpp"},
+				"mail":          {"foxcpp@example.org"},
+				"userPassword":  {"{PLAIN}1234"},
+				"homeDirectory": {"/home/foxcpp"},
+				"uidNumber":     {"1000"},
+				"mailQuota":     {"1G"},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func testDB(srv *ldaptest.Server) *DB {
+	db := New(srv.URL())
+	db.BindDN = "cn=admin,dc=example,dc=org"
+	db.BindPassword = "secret"
+	db.Base = "dc=example,dc=org"
+	db.PassFilter = "(&(objectClass=posixAccount)(mail=%u))"
+	db.PassAttrs = map[string]string{
+		"userPassword": "password",
+		"mail":         "user",
+		"mailQuota":    "quota",
+	}
+	db.PoolSize = 2
+	return db
+}
+
+func TestLookup(t *testing.T) {
+	srv := testServer(t)
+	defer srv.Close()
+	db := testDB(srv)
+	defer db.Close()
+	ctx := context.Background()
+
+	res, err := db.VerifyPlain(ctx, nil, "foxcpp@example.org", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.User != "foxcpp@example.org" || res.Extra["quota"] != "1G" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	if _, err := db.VerifyPlain(ctx, nil, "foxcpp@example.org", "5678"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("expected password mismatch, got %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, nil, "nobody@example.org", "1234"); !errors.Is(err, dovecotsasl.ErrUserUnknown) {
+		t.Errorf("expected unknown user, got %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, nil, "*", "1234"); !errors.Is(err, dovecotsasl.ErrUserUnknown) {
+		t.Errorf("filter value is not escaped, got %v", err)
+	}
+
+	creds, err := db.LookupCredentials(ctx, nil, "foxcpp@example.org", "PLAIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(creds.Credentials) != "1234" {
+		t.Errorf("got credentials %q, want %q", creds.Credentials, "1234")
+	}
+
+	fields, err := db.LookupUser(ctx, nil, "foxcpp@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["home"] != "/home/foxcpp" || fields["uid"] != "1000" {
+		t.Errorf("unexpected userdb fields: %v", fields)
+	}
+
+	// Lookup connection is reused.
+	binds := srv.Binds()
+	if _, err := db.VerifyPlain(ctx, nil, "foxcpp@example.org", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Binds() != binds {
+		t.Errorf("lookup connection is not pooled")
+	}
+}
+
+func TestAuthBind(t *testing.T) {
+	srv := testServer(t)
+	defer srv.Close()
+	ctx := context.Background()
+
+	for _, template := range []string{"", "uid=%n,ou=people,dc=example,dc=org"} {
+		db := testDB(srv)
+		db.AuthBind = true
+		db.AuthBindUserDN = template
+
+		user := "foxcpp@example.org"
+		if template != "" {
+			user = "foxcpp"
+		}
+		if _, err := db.VerifyPlain(ctx, nil, user, "1234"); err != nil {
+			t.Errorf("template %q: %v", template, err)
+		}
+		if _, err := db.VerifyPlain(ctx, nil, user, "5678"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+			t.Errorf("template %q: expected password mismatch, got %v", template, err)
+		}
+		if _, err := db.VerifyPlain(ctx, nil, user, ""); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+			t.Errorf("template %q: empty password accepted: %v", template, err)
+		}
+		if _, err := db.LookupCredentials(ctx, nil, user, "PLAIN"); !errors.Is(err, dovecotsasl.ErrSchemeNotAvailable) {
+			t.Errorf("template %q: expected scheme not available, got %v", template, err)
+		}
+		db.Close()
+	}
+}
+
+func testTLSConfig(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	client = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	return server, client
+}
+
+func TestStartTLS(t *testing.T) {
+	srv := testServer(t)
+	defer srv.Close()
+	srv.TLSConfig, _ = testTLSConfig(t)
+	_, clientCfg := testTLSConfig(t)
+
+	// Untrusted certificate.
+	db := testDB(srv)
+	db.StartTLS = true
+	db.TLSConfig = clientCfg
+	if _, err := db.VerifyPlain(context.Background(), nil, "foxcpp@example.org", "1234"); dovecotsasl.PassdbStatusOf(err) != dovecotsasl.PassdbInternalFailure {
+		t.Errorf("expected internal failure due to untrusted certificate, got %v", err)
+	}
+	db.Close()
+
+	srv.TLSConfig, clientCfg = testTLSConfig(t)
+	db = testDB(srv)
+	db.StartTLS = true
+	db.TLSConfig = clientCfg
+	defer db.Close()
+	if _, err := db.VerifyPlain(context.Background(), nil, "foxcpp@example.org", "1234"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,373 @@
+// Package ldaptest provides an in-process fake LDAP server for testing
+// LDAP clients.
+//
+// Only the subset of LDAPv3 needed for authentication is implemented:
+// simple bind, search (equality, presence, substring, AND, OR and NOT
+// filters), unbind and StartTLS.
+package ldaptest
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/foxcpp/go-dovecot-sasl/pwscheme"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Entry is a directory entry.
+//
+// Bind is allowed if the password matches the "userPassword" attribute
+// (plaintext or in Dovecot "{SCHEME}hash" format).
+type Entry struct {
+	DN    string
+	Attrs map[string][]string
+}
+
+// Server is the fake LDAP server.
+type Server struct {
+	// Allow StartTLS using this configuration.
+	TLSConfig *tls.Config
+
+	entriesLock sync.RWMutex
+	entries     []Entry
+
+	l     net.Listener
+	wg    sync.WaitGroup
+	conns sync.Map
+
+	bindsLock sync.Mutex
+	binds     int
+}
+
+// NewServer starts the server listening on a random local TCP port.
+func NewServer(entries ...Entry) (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		entries: entries,
+		l:       l,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// URL returns the ldap:// URL of the server.
+func (s *Server) URL() string {
+	return "ldap://" + s.l.Addr().String()
+}
+
+// AddEntry adds the entry to the directory.
+func (s *Server) AddEntry(e Entry) {
+	s.entriesLock.Lock()
+	defer s.entriesLock.Unlock()
+	s.entries = append(s.entries, e)
+}
+
+// Binds returns the number of bind requests processed so far.
+func (s *Server) Binds() int {
+	s.bindsLock.Lock()
+	defer s.bindsLock.Unlock()
+	return s.binds
+}
+
+func (s *Server) Close() error {
+	err := s.l.Close()
+	s.conns.Range(func(k, _ interface{}) bool {
+		k.(net.Conn).Close()
+		return true
+	})
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.conns.Store(conn, struct{}{})
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer func() {
+		s.conns.Delete(conn)
+		conn.Close()
+	}()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if len(packet.Children) < 2 {
+			return
+		}
+		msgID := packet.Children[0].Value
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			s.bindsLock.Lock()
+			s.binds++
+			s.bindsLock.Unlock()
+			code := s.bind(op)
+			if err := writeResult(conn, msgID, ldap.ApplicationBindResponse, code); err != nil {
+				return
+			}
+		case ldap.ApplicationUnbindRequest:
+			return
+		case ldap.ApplicationSearchRequest:
+			if err := s.search(conn, msgID, op); err != nil {
+				return
+			}
+		case ldap.ApplicationExtendedRequest:
+			if len(op.Children) == 0 || string(op.Children[0].Data.Bytes()) != "1.3.6.1.4.1.1466.20037" || s.TLSConfig == nil {
+				if err := writeResult(conn, msgID, ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError); err != nil {
+					return
+				}
+				continue
+			}
+			if err := writeResult(conn, msgID, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess); err != nil {
+				return
+			}
+			tlsConn := tls.Server(conn, s.TLSConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			s.conns.Delete(conn)
+			s.conns.Store(tlsConn, struct{}{})
+			conn = tlsConn
+		default:
+			return
+		}
+	}
+}
+
+func envelope(msgID interface{}, op *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, "MessageID"))
+	packet.AppendChild(op)
+	return packet
+}
+
+func writeResult(conn net.Conn, msgID interface{}, tag ber.Tag, code uint16) error {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	_, err := conn.Write(envelope(msgID, op).Bytes())
+	return err
+}
+
+func packetString(p *ber.Packet) string {
+	if s, ok := p.Value.(string); ok {
+		return s
+	}
+	if p.Data != nil {
+		return p.Data.String()
+	}
+	return ""
+}
+
+func (s *Server) findEntry(dn string) *Entry {
+	s.entriesLock.RLock()
+	defer s.entriesLock.RUnlock()
+	for i := range s.entries {
+		if strings.EqualFold(s.entries[i].DN, dn) {
+			e := s.entries[i]
+			return &e
+		}
+	}
+	return nil
+}
+
+func (s *Server) bind(op *ber.Packet) uint16 {
+	if len(op.Children) < 3 {
+		return ldap.LDAPResultProtocolError
+	}
+	dn := packetString(op.Children[1])
+	if op.Children[2].Tag != 0 {
+		return ldap.LDAPResultAuthMethodNotSupported
+	}
+	password := packetString(op.Children[2])
+	if dn == "" && password == "" {
+		// Anonymous bind.
+		return ldap.LDAPResultSuccess
+	}
+	if password == "" {
+		return ldap.LDAPResultUnwillingToPerform
+	}
+
+	e := s.findEntry(dn)
+	if e == nil {
+		return ldap.LDAPResultInvalidCredentials
+	}
+	for _, stored := range e.Attrs["userPassword"] {
+		if ok, err := pwscheme.Verify(stored, "PLAIN", password); err == nil && ok {
+			return ldap.LDAPResultSuccess
+		}
+	}
+	return ldap.LDAPResultInvalidCredentials
+}
+
+func attrValues(e *Entry, name string) []string {
+	for k, v := range e.Attrs {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+func matchFilter(e *Entry, f *ber.Packet) bool {
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, child := range f.Children {
+			if !matchFilter(e, child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range f.Children {
+			if matchFilter(e, child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(f.Children) == 1 && !matchFilter(e, f.Children[0])
+	case ldap.FilterEqualityMatch:
+		if len(f.Children) != 2 {
+			return false
+		}
+		want := packetString(f.Children[1])
+		for _, v := range attrValues(e, packetString(f.Children[0])) {
+			if strings.EqualFold(v, want) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		name := packetString(f)
+		return strings.EqualFold(name, "objectClass") || len(attrValues(e, name)) != 0
+	case ldap.FilterSubstrings:
+		if len(f.Children) != 2 {
+			return false
+		}
+		for _, v := range attrValues(e, packetString(f.Children[0])) {
+			if matchSubstrings(strings.ToLower(v), f.Children[1].Children) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func matchSubstrings(v string, parts []*ber.Packet) bool {
+	for _, part := range parts {
+		sub := strings.ToLower(packetString(part))
+		switch part.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(v, sub) {
+				return false
+			}
+			v = v[len(sub):]
+		case ldap.FilterSubstringsAny:
+			idx := strings.Index(v, sub)
+			if idx == -1 {
+				return false
+			}
+			v = v[idx+len(sub):]
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(v, sub) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func inScope(dn, base string, scope int64) bool {
+	dn, base = strings.ToLower(dn), strings.ToLower(base)
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return dn == base
+	case ldap.ScopeSingleLevel:
+		idx := strings.IndexByte(dn, ',')
+		return idx != -1 && dn[idx+1:] == base
+	default:
+		return base == "" || dn == base || strings.HasSuffix(dn, ","+base)
+	}
+}
+
+func (s *Server) search(conn net.Conn, msgID interface{}, op *ber.Packet) error {
+	if len(op.Children) < 8 {
+		return writeResult(conn, msgID, ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError)
+	}
+	base := packetString(op.Children[0])
+	scope, _ := op.Children[1].Value.(int64)
+	filter := op.Children[6]
+	var attrs []string
+	for _, a := range op.Children[7].Children {
+		attrs = append(attrs, packetString(a))
+	}
+
+	s.entriesLock.RLock()
+	entries := append([]Entry(nil), s.entries...)
+	s.entriesLock.RUnlock()
+
+	for i := range entries {
+		e := &entries[i]
+		if !inScope(e.DN, base, scope) || !matchFilter(e, filter) {
+			continue
+		}
+
+		resp := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+		resp.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "objectName"))
+		attrList := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+		for name, values := range e.Attrs {
+			if len(attrs) != 0 && !containsFold(attrs, name) {
+				continue
+			}
+			attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+			attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+			vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+			for _, v := range values {
+				vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+			}
+			attr.AppendChild(vals)
+			attrList.AppendChild(attr)
+		}
+		resp.AppendChild(attrList)
+		if _, err := conn.Write(envelope(msgID, resp).Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return writeResult(conn, msgID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) || v == "*" {
+			return true
+		}
+	}
+	return false
+}
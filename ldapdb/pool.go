@@ -0,0 +1,80 @@
+package ldapdb
+
+import (
+	"context"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// pool is a bounded pool of LDAP connections.
+type pool struct {
+	dial func() (*ldap.Conn, error)
+	idle chan *ldap.Conn
+	sem  chan struct{}
+}
+
+func newPool(size int, dial func() (*ldap.Conn, error)) *pool {
+	if size <= 0 {
+		size = 1
+	}
+	return &pool{
+		dial: dial,
+		idle: make(chan *ldap.Conn, size),
+		sem:  make(chan struct{}, size),
+	}
+}
+
+// get returns an idle connection or dials a new one, blocking if the limit
+// is reached.
+func (p *pool) get(ctx context.Context) (*ldap.Conn, error) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		select {
+		case conn := <-p.idle:
+			if conn.IsClosing() {
+				conn.Close()
+				continue
+			}
+			return conn, nil
+		default:
+		}
+		break
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+	return conn, nil
+}
+
+// put returns the connection to the pool. Broken connections are closed.
+func (p *pool) put(conn *ldap.Conn, broken bool) {
+	defer func() { <-p.sem }()
+	if broken {
+		conn.Close()
+		return
+	}
+	select {
+	case p.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (p *pool) close() {
+	for {
+		select {
+		case conn := <-p.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
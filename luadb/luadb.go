@@ -0,0 +1,509 @@
+// Package luadb implements passdb and userdb backend using Lua scripts,
+// similar to Dovecot's Lua driver.
+//
+// The script may define the following functions:
+//
+//	auth_passdb_lookup(req) -> result, fields
+//	auth_password_verify(req, password) -> result, fields
+//	auth_userdb_lookup(req) -> result, fields
+//
+// result is one of dovecot.auth.PASSDB_RESULT_* (or USERDB_RESULT_*)
+// constants, fields is either a table or a string of space-separated
+// key=value pairs. For auth_passdb_lookup, "password" field contains the
+// stored password and "user" field changes the username, the rest are
+// extra fields.
+//
+// If auth_password_verify is not defined, plaintext passwords are verified
+// against the password returned by auth_passdb_lookup.
+//
+// req is a table with user, username, domain, service, mech, rip, lip,
+// rport, lport, secured fields and the following methods:
+//
+//	req:password_verify(stored, plain) -> result, error
+//	req:log_debug(msg), req:log_info(msg), req:log_warning(msg), req:log_error(msg)
+//
+// See https://doc.dovecot.org/configuration_manual/authentication/lua_based_authentication/.
+package luadb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Result codes exposed to scripts as dovecot.auth.PASSDB_RESULT_* and
+// dovecot.auth.USERDB_RESULT_*.
+const (
+	PassdbResultInternalFailure    = -1
+	PassdbResultSchemeNotAvailable = -2
+	PassdbResultUserUnknown        = -3
+	PassdbResultUserDisabled       = -4
+	PassdbResultPassExpired        = -5
+	PassdbResultNextStep           = -6
+	PassdbResultPasswordMismatch   = 0
+	PassdbResultOK                 = 1
+
+	UserdbResultInternalFailure = -1
+	UserdbResultUserUnknown     = 0
+	UserdbResultOK              = 1
+)
+
+// DB is the Lua backend. It implements dovecotsasl.Passdb.
+//
+// The script is reloaded when the file is changed (checked on each lookup)
+// or when Reload is called, see also ReloadOnSIGHUP.
+type DB struct {
+	// Path to the script.
+	Path string
+
+	// Scheme to use for passwords without {SCHEME} prefix.
+	DefaultScheme string
+
+	// Number of idle Lua states kept for reuse. Each state handles one
+	// request at a time.
+	PoolSize int
+
+	// Logger used by req:log_* functions.
+	Log *log.Logger
+
+	lock    sync.Mutex
+	proto   *lua.FunctionProto
+	modTime time.Time
+	size    int64
+	gen     int
+	idle    chan *luaState
+}
+
+type luaState struct {
+	L   *lua.LState
+	gen int
+}
+
+// New loads the script.
+func New(path string) (*DB, error) {
+	db := &DB{
+		Path:          path,
+		DefaultScheme: "PLAIN",
+		PoolSize:      8,
+		Log:           log.New(ioutil.Discard, "", 0),
+	}
+	if err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload compiles the script again. Running lookups are not affected.
+func (db *DB) Reload() error {
+	info, err := os.Stat(db.Path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(db.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	chunk, err := parse.Parse(f, db.Path)
+	if err != nil {
+		return fmt.Errorf("luadb: %w", err)
+	}
+	proto, err := lua.Compile(chunk, db.Path)
+	if err != nil {
+		return fmt.Errorf("luadb: %w", err)
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.proto = proto
+	db.modTime = info.ModTime()
+	db.size = info.Size()
+	db.gen++
+	if db.idle == nil {
+		size := db.PoolSize
+		if size <= 0 {
+			size = 1
+		}
+		db.idle = make(chan *luaState, size)
+	}
+	// Idle states use the old script.
+	for {
+		select {
+		case st := <-db.idle:
+			st.L.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// ReloadOnSIGHUP reloads the script when SIGHUP is received. Reload errors
+// are logged and the old script is kept. Call the returned function to
+// stop.
+func (db *DB) ReloadOnSIGHUP() (stop func()) {
+	sig := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-sig:
+				if err := db.Reload(); err != nil {
+					db.Log.Println("luadb: reload failed:", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sig)
+		close(done)
+	}
+}
+
+// reloadIfChanged reloads the script if the file was modified.
+func (db *DB) reloadIfChanged() error {
+	info, err := os.Stat(db.Path)
+	if err != nil {
+		return err
+	}
+	db.lock.Lock()
+	changed := !info.ModTime().Equal(db.modTime) || info.Size() != db.size
+	db.lock.Unlock()
+	if !changed {
+		return nil
+	}
+	if err := db.Reload(); err != nil {
+		// Do not retry until the file is changed again.
+		db.lock.Lock()
+		db.modTime = info.ModTime()
+		db.size = info.Size()
+		db.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (db *DB) newState(proto *lua.FunctionProto, gen int) (*luaState, error) {
+	L := lua.NewState()
+	L.SetGlobal("dovecot", db.dovecotModule(L))
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("luadb: %w", err)
+	}
+	if fn := L.GetGlobal("script_init"); fn.Type() == lua.LTFunction {
+		if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}); err != nil {
+			L.Close()
+			return nil, fmt.Errorf("luadb: script_init: %w", err)
+		}
+		L.Pop(1)
+	}
+	return &luaState{L: L, gen: gen}, nil
+}
+
+func (db *DB) dovecotModule(L *lua.LState) *lua.LTable {
+	auth := L.NewTable()
+	for name, val := range map[string]int{
+		"PASSDB_RESULT_INTERNAL_FAILURE":     PassdbResultInternalFailure,
+		"PASSDB_RESULT_SCHEME_NOT_AVAILABLE": PassdbResultSchemeNotAvailable,
+		"PASSDB_RESULT_USER_UNKNOWN":         PassdbResultUserUnknown,
+		"PASSDB_RESULT_USER_DISABLED":        PassdbResultUserDisabled,
+		"PASSDB_RESULT_PASS_EXPIRED":         PassdbResultPassExpired,
+		"PASSDB_RESULT_NEXT":                 PassdbResultNextStep,
+		"PASSDB_RESULT_PASSWORD_MISMATCH":    PassdbResultPasswordMismatch,
+		"PASSDB_RESULT_OK":                   PassdbResultOK,
+		"USERDB_RESULT_INTERNAL_FAILURE":     UserdbResultInternalFailure,
+		"USERDB_RESULT_USER_UNKNOWN":         UserdbResultUserUnknown,
+		"USERDB_RESULT_OK":                   UserdbResultOK,
+	} {
+		auth.RawSetString(name, lua.LNumber(val))
+	}
+	mod := L.NewTable()
+	mod.RawSetString("auth", auth)
+	return mod
+}
+
+// getState returns a Lua state with the current script loaded.
+func (db *DB) getState(ctx context.Context) (*luaState, error) {
+	if err := db.reloadIfChanged(); err != nil {
+		db.Log.Println("luadb: reload failed, using the old script:", err)
+	}
+
+	db.lock.Lock()
+	proto, gen, idle := db.proto, db.gen, db.idle
+	db.lock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case st := <-idle:
+		if st.gen == gen {
+			return st, nil
+		}
+		st.L.Close()
+	default:
+	}
+	return db.newState(proto, gen)
+}
+
+func (db *DB) putState(st *luaState) {
+	db.lock.Lock()
+	gen, idle := db.gen, db.idle
+	db.lock.Unlock()
+	if st.gen != gen {
+		st.L.Close()
+		return
+	}
+	select {
+	case idle <- st:
+	default:
+		st.L.Close()
+	}
+}
+
+func (db *DB) reqTable(L *lua.LState, req *dovecotsasl.AuthReq, user string) *lua.LTable {
+	t := L.NewTable()
+	for k, v := range req.Vars(user) {
+		t.RawSetString(k, lua.LString(v))
+	}
+	t.RawSetString("secured", lua.LBool(req != nil && req.Secured))
+
+	logFn := func(prefix string) *lua.LFunction {
+		return L.NewFunction(func(L *lua.LState) int {
+			db.Log.Printf("luadb: %s: %s (user=%s)", prefix, L.CheckString(2), user)
+			return 0
+		})
+	}
+	t.RawSetString("log_debug", logFn("debug"))
+	t.RawSetString("log_info", logFn("info"))
+	t.RawSetString("log_warning", logFn("warning"))
+	t.RawSetString("log_error", logFn("error"))
+	t.RawSetString("password_verify", L.NewFunction(func(L *lua.LState) int {
+		stored, plain := L.CheckString(2), L.CheckString(3)
+		err := dovecotsasl.VerifyPassword(stored, db.DefaultScheme, plain)
+		switch {
+		case err == nil:
+			L.Push(lua.LNumber(PassdbResultOK))
+			L.Push(lua.LNil)
+		case errors.Is(err, dovecotsasl.ErrPasswordMismatch):
+			L.Push(lua.LNumber(PassdbResultPasswordMismatch))
+			L.Push(lua.LNil)
+		default:
+			L.Push(lua.LNumber(PassdbResultInternalFailure))
+			L.Push(lua.LString(err.Error()))
+		}
+		return 2
+	}))
+	return t
+}
+
+// parseFields converts the table or "k=v k2=v2" string into fields.
+func parseFields(v lua.LValue) map[string]string {
+	fields := make(map[string]string)
+	switch v := v.(type) {
+	case *lua.LTable:
+		v.ForEach(func(k, val lua.LValue) {
+			if val == lua.LNil {
+				return
+			}
+			fields[k.String()] = val.String()
+		})
+	case lua.LString:
+		for _, f := range strings.Fields(string(v)) {
+			parts := strings.SplitN(f, "=", 2)
+			if len(parts) == 1 {
+				fields[parts[0]] = ""
+				continue
+			}
+			fields[parts[0]] = parts[1]
+		}
+	}
+	return fields
+}
+
+// call runs the script function. ok is false if it is not defined.
+func (db *DB) call(ctx context.Context, fnName string, req *dovecotsasl.AuthReq, user string, args ...lua.LValue) (code int, fields map[string]string, ok bool, err error) {
+	st, err := db.getState(ctx)
+	if err != nil {
+		return 0, nil, false, dovecotsasl.PassdbInternalError(err)
+	}
+	L := st.L
+	broken := false
+	defer func() {
+		if broken {
+			L.Close()
+			return
+		}
+		db.putState(st)
+	}()
+
+	fn := L.GetGlobal(fnName)
+	if fn.Type() != lua.LTFunction {
+		return 0, nil, false, nil
+	}
+
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	args = append([]lua.LValue{db.reqTable(L, req, user)}, args...)
+	if err := L.CallByParam(lua.P{Fn: fn, NRet: 2, Protect: true}, args...); err != nil {
+		// State might be left in inconsistent state (e.g. after
+		// cancellation).
+		broken = true
+		return 0, nil, true, dovecotsasl.PassdbInternalError(fmt.Errorf("luadb: %s: %w", fnName, err))
+	}
+	ret, fieldsVal := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+
+	num, isNum := ret.(lua.LNumber)
+	if !isNum {
+		return 0, nil, true, dovecotsasl.PassdbInternalError(fmt.Errorf("luadb: %s: result is not a number", fnName))
+	}
+	fields = parseFields(fieldsVal)
+	return int(num), fields, true, nil
+}
+
+// passdbError converts the script result code into the error.
+func passdbError(code int, fields map[string]string) error {
+	var status dovecotsasl.PassdbStatus
+	switch code {
+	case PassdbResultOK:
+		return nil
+	case PassdbResultPasswordMismatch:
+		status = dovecotsasl.PassdbPasswordMismatch
+	case PassdbResultUserUnknown, PassdbResultNextStep:
+		status = dovecotsasl.PassdbUserUnknown
+	case PassdbResultUserDisabled:
+		status = dovecotsasl.PassdbUserDisabled
+	case PassdbResultPassExpired:
+		status = dovecotsasl.PassdbPassExpired
+	case PassdbResultSchemeNotAvailable:
+		status = dovecotsasl.PassdbSchemeNotAvailable
+	default:
+		return dovecotsasl.PassdbInternalError(fmt.Errorf("luadb: script failure: %s", fields["error"]))
+	}
+	return &dovecotsasl.PassdbError{
+		Status: status,
+		Reason: fields["reason"],
+	}
+}
+
+func passdbResult(fields map[string]string) *dovecotsasl.PassdbResult {
+	res := &dovecotsasl.PassdbResult{
+		User:  fields["user"],
+		Extra: make(map[string]string),
+	}
+	for k, v := range fields {
+		if k == "user" || k == "password" {
+			continue
+		}
+		res.Extra[k] = v
+	}
+	return res
+}
+
+func (db *DB) VerifyPlain(ctx context.Context, req *dovecotsasl.AuthReq, user, pass string) (*dovecotsasl.PassdbResult, error) {
+	code, fields, ok, err := db.call(ctx, "auth_password_verify", req, user, lua.LString(pass))
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if err := passdbError(code, fields); err != nil {
+			return nil, err
+		}
+		return passdbResult(fields), nil
+	}
+
+	code, fields, ok, err = db.call(ctx, "auth_passdb_lookup", req, user)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, dovecotsasl.PassdbInternalError(errors.New("luadb: script does not define auth_passdb_lookup or auth_password_verify"))
+	}
+	if err := passdbError(code, fields); err != nil {
+		return nil, err
+	}
+	res := passdbResult(fields)
+	if _, ok := res.Extra["nopassword"]; ok {
+		return res, nil
+	}
+	password, ok := fields["password"]
+	if !ok || password == "" {
+		return nil, dovecotsasl.ErrPasswordMismatch
+	}
+	if err := dovecotsasl.VerifyPassword(password, db.DefaultScheme, pass); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (db *DB) LookupCredentials(ctx context.Context, req *dovecotsasl.AuthReq, user, scheme string) (*dovecotsasl.PassdbResult, error) {
+	code, fields, ok, err := db.call(ctx, "auth_passdb_lookup", req, user)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, dovecotsasl.ErrSchemeNotAvailable
+	}
+	if err := passdbError(code, fields); err != nil {
+		return nil, err
+	}
+	password, ok := fields["password"]
+	if !ok || password == "" {
+		return nil, dovecotsasl.ErrCredentialsUnavailable
+	}
+	res := passdbResult(fields)
+	res.Credentials, err = dovecotsasl.PasswordCredentials(password, db.DefaultScheme, scheme)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// LookupUser runs auth_userdb_lookup and returns the resulting fields.
+func (db *DB) LookupUser(ctx context.Context, req *dovecotsasl.AuthReq, user string) (map[string]string, error) {
+	code, fields, ok, err := db.call(ctx, "auth_userdb_lookup", req, user)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, dovecotsasl.PassdbInternalError(errors.New("luadb: script does not define auth_userdb_lookup"))
+	}
+	switch code {
+	case UserdbResultOK:
+		return fields, nil
+	case UserdbResultUserUnknown:
+		return nil, dovecotsasl.ErrUserUnknown
+	default:
+		return nil, dovecotsasl.PassdbInternalError(fmt.Errorf("luadb: script failure: %s", fields["error"]))
+	}
+}
+
+// Close releases idle Lua states.
+func (db *DB) Close() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for {
+		select {
+		case st := <-db.idle:
+			st.L.Close()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package luadb
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+)
+
+const testScript = `
+local users = {
+	["foxcpp@example.org"] = "{PLAIN}1234",
+	["blocked@example.org"] = "{PLAIN}1234",
+}
+
+function auth_passdb_lookup(req)
+	if req.user == "blocked@example.org" then
+		return dovecot.auth.PASSDB_RESULT_USER_DISABLED, ""
+	end
+	if req.user == "nopass@example.org" then
+		return dovecot.auth.PASSDB_RESULT_OK, "nopassword=y"
+	end
+	local password = users[req.user]
+	if password == nil then
+		return dovecot.auth.PASSDB_RESULT_USER_UNKNOWN, ""
+	end
+	return dovecot.auth.PASSDB_RESULT_OK, {password = password, rip = req.rip, service = req.service}
+end
+
+function auth_userdb_lookup(req)
+	if users[req.user] == nil then
+		return dovecot.auth.USERDB_RESULT_USER_UNKNOWN, ""
+	end
+	return dovecot.auth.USERDB_RESULT_OK, "home=/home/" .. req.username .. " uid=1000"
+end
+`
+
+const testVerifyScript = `
+function auth_password_verify(req, password)
+	if not req.secured then
+		return dovecot.auth.PASSDB_RESULT_PASSWORD_MISMATCH, "reason=insecure"
+	end
+	local res, err = req:password_verify("{SHA256}XohImNooBHFR0OVvjcYpJ3NgPQ1qq73WKhHvch0VQtg=", password)
+	return res, {quota = "1G"}
+end
+`
+
+func writeScript(t *testing.T, path, script string, mtime time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(script), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLua(t *testing.T) {
+	dir, err := ioutil.TempDir("", "luadb-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "auth.lua")
+	now := time.Now()
+	writeScript(t, path, testScript, now)
+
+	db, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	req := &dovecotsasl.AuthReq{
+		Service:  "imap",
+		RemoteIP: net.IPv4(192, 0, 2, 1),
+	}
+
+	res, err := db.VerifyPlain(ctx, req, "foxcpp@example.org", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Extra["rip"] != "192.0.2.1" || res.Extra["service"] != "imap" {
+		t.Errorf("unexpected extra fields: %v", res.Extra)
+	}
+	if _, ok := res.Extra["password"]; ok {
+		t.Errorf("password is returned as an extra field")
+	}
+	if _, err := db.VerifyPlain(ctx, req, "foxcpp@example.org", "5678"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("expected password mismatch, got %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, req, "nobody@example.org", "1234"); !errors.Is(err, dovecotsasl.ErrUserUnknown) {
+		t.Errorf("expected unknown user, got %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, req, "blocked@example.org", "1234"); !errors.Is(err, dovecotsasl.ErrUserDisabled) {
+		t.Errorf("expected disabled user, got %v", err)
+	}
+
+	creds, err := db.LookupCredentials(ctx, req, "foxcpp@example.org", "PLAIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(creds.Credentials) != "1234" {
+		t.Errorf("got credentials %q, want %q", creds.Credentials, "1234")
+	}
+	_, err = db.LookupCredentials(ctx, req, "nopass@example.org", "PLAIN")
+	if dovecotsasl.PassdbStatusOf(err) != dovecotsasl.PassdbSchemeNotAvailable || !dovecotsasl.PassdbUserFound(err) {
+		t.Errorf("expected unavailable credentials for existing user, got %v", err)
+	}
+
+	fields, err := db.LookupUser(ctx, req, "foxcpp@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["home"] != "/home/foxcpp" || fields["uid"] != "1000" {
+		t.Errorf("unexpected userdb fields: %v", fields)
+	}
+
+	// Reload on change.
+	writeScript(t, path, testVerifyScript, now.Add(time.Second))
+	if _, err := db.VerifyPlain(ctx, req, "foxcpp@example.org", "password"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("expected password mismatch for insecure connection, got %v", err)
+	}
+	req.Secured = true
+	res, err = db.VerifyPlain(ctx, req, "foxcpp@example.org", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Extra["quota"] != "1G" {
+		t.Errorf("unexpected extra fields: %v", res.Extra)
+	}
+
+	// Broken script is not loaded.
+	writeScript(t, path, "function (", now.Add(2*time.Second))
+	if _, err := db.VerifyPlain(ctx, req, "foxcpp@example.org", "password"); err != nil {
+		t.Errorf("old script is not used after failed reload: %v", err)
+	}
+}
@@ -0,0 +1,284 @@
+package dovecotsasl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CacheFlusher is implemented by caches that can be flushed using the
+// master CACHE-FLUSH command (e.g. authcache.Cache).
+type CacheFlusher interface {
+	// FlushUser removes all entries for the user and returns their count.
+	FlushUser(user string) int
+
+	// FlushAll removes all entries and returns their count.
+	FlushAll() int
+}
+
+// MasterServer implements the server side of Dovecot auth master protocol
+// (auth-master socket) used by doveadm and mail processes.
+//
+// Only the USER and CACHE-FLUSH commands are supported.
+type MasterServer struct {
+	// Cache is flushed by the CACHE-FLUSH command.
+	Cache CacheFlusher
+
+	// Userdb is used for USER lookups.
+	Userdb Userdb
+
+	Log *log.Logger
+
+	l []net.Listener
+}
+
+func NewMasterServer() *MasterServer {
+	return &MasterServer{
+		Log: log.New(ioutil.Discard, "", 0),
+	}
+}
+
+func (s *MasterServer) Serve(l net.Listener) error {
+	s.l = append(s.l, l)
+	for {
+		netConn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handleConn(netConn)
+	}
+}
+
+func (s *MasterServer) handleConn(netConn net.Conn) {
+	c := conn{
+		C: netConn,
+		W: bufio.NewWriter(netConn),
+		R: bufio.NewScanner(netConn),
+	}
+	defer c.Close()
+
+	if err := c.Writeln("VERSION", "1", "0"); err != nil {
+		s.Log.Println("I/O error:", err)
+		return
+	}
+	if err := c.Writeln("SPID", strconv.Itoa(os.Getpid())); err != nil {
+		s.Log.Println("I/O error:", err)
+		return
+	}
+
+	version, err := c.ReadlnExpect("VERSION", 2)
+	if err != nil {
+		s.Log.Println("Protocol error:", err)
+		return
+	}
+	if version[0] != "1" {
+		s.Log.Printf("Protocol error: incompatible master client version: %s.%s", version[0], version[1])
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.watch(cancel)
+
+	for {
+		cmd, params, err := c.Readln()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.Log.Println("I/O error:", err)
+			}
+			return
+		}
+		if err := s.handleCmd(ctx, &c, cmd, params); err != nil {
+			s.Log.Println("Protocol error:", err)
+			return
+		}
+	}
+}
+
+func (s *MasterServer) handleCmd(ctx context.Context, c *conn, cmd string, params []string) error {
+	switch cmd {
+	case "USER":
+		// USER <id> <user> [<param> ...]
+		if len(params) < 2 {
+			return fmt.Errorf("dovecotsasl: not enough params for %s: %v", cmd, len(params))
+		}
+		return s.handleUser(ctx, c, params[0], params[1], params[2:])
+	case "CACHE-FLUSH":
+		// CACHE-FLUSH <id> [<user> ...]
+		if len(params) < 1 {
+			return fmt.Errorf("dovecotsasl: not enough params for %s: %v", cmd, len(params))
+		}
+		count := 0
+		if s.Cache != nil {
+			if len(params) == 1 {
+				count = s.Cache.FlushAll()
+			}
+			for _, user := range params[1:] {
+				count += s.Cache.FlushUser(user)
+			}
+		}
+		return c.Writeln("OK", params[0], strconv.Itoa(count))
+	default:
+		return fmt.Errorf("dovecotsasl: unknown master command: %v", cmd)
+	}
+}
+
+func (s *MasterServer) handleUser(ctx context.Context, c *conn, id, user string, params []string) error {
+	req := &AuthReq{RequestID: id, ctx: ctx}
+	if err := req.parseParams(params); err != nil {
+		return err
+	}
+	if s.Userdb == nil {
+		return c.Writeln("FAIL", id, "reason=userdb is not configured")
+	}
+
+	fields, err := s.Userdb.LookupUser(ctx, req, user)
+	switch PassdbStatusOf(err) {
+	case PassdbOK:
+	case PassdbUserUnknown:
+		return c.Writeln("NOTFOUND", id)
+	default:
+		s.Log.Printf("userdb lookup failed: %v (user=%s, service=%s)", err, user, req.Service)
+		return c.Writeln("FAIL", id, "reason=userdb lookup failed")
+	}
+
+	if canonical, ok := fields["user"]; ok && canonical != "" {
+		user = canonical
+	}
+	reply := []string{id, user}
+	for k, v := range fields {
+		if k == "" || k == "user" || strings.ContainsAny(k, "=\t\n") {
+			continue
+		}
+		if v == "" {
+			reply = append(reply, k)
+			continue
+		}
+		reply = append(reply, k+"="+v)
+	}
+	return c.Writeln("USER", reply...)
+}
+
+func (s *MasterServer) Close() error {
+	for _, l := range s.l {
+		l.Close()
+	}
+	return nil
+}
+
+// MasterClient is the client for Dovecot auth master protocol. It is not
+// safe for concurrent use.
+type MasterClient struct {
+	c      conn
+	nextID uint32
+}
+
+// NewMasterClient performs the handshake on netConn.
+func NewMasterClient(netConn net.Conn) (*MasterClient, error) {
+	cl := &MasterClient{
+		c: conn{
+			C: netConn,
+			W: bufio.NewWriter(netConn),
+			R: bufio.NewScanner(netConn),
+		},
+	}
+
+	version, err := cl.c.ReadlnExpect("VERSION", 2)
+	if err != nil {
+		return nil, err
+	}
+	if version[0] != "1" {
+		return nil, fmt.Errorf("dovecotsasl: incompatible master server version: %s.%s", version[0], version[1])
+	}
+	if _, err := cl.c.ReadlnExpect("SPID", 1); err != nil {
+		return nil, err
+	}
+	if err := cl.c.Writeln("VERSION", "1", "0"); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+func (cl *MasterClient) id() string {
+	cl.nextID++
+	return strconv.FormatUint(uint64(cl.nextID), 10)
+}
+
+// CacheFlush flushes the auth cache entries for the specified users or the
+// whole cache if no users are specified. The number of removed entries is
+// returned.
+func (cl *MasterClient) CacheFlush(users ...string) (int, error) {
+	id := cl.id()
+	if err := cl.c.Writeln("CACHE-FLUSH", append([]string{id}, users...)...); err != nil {
+		return 0, err
+	}
+	params, err := cl.c.ReadlnExpect("OK", 2)
+	if err != nil {
+		return 0, err
+	}
+	if params[0] != id {
+		return 0, fmt.Errorf("dovecotsasl: unexpected request ID: %v", params[0])
+	}
+	return strconv.Atoi(params[1])
+}
+
+// LookupUser requests userdb fields for the user. If the userdb changed
+// the username, the new one is returned in the "user" field.
+//
+// ErrUserUnknown is returned if the user does not exist.
+func (cl *MasterClient) LookupUser(user string, params ...Parameter) (map[string]string, error) {
+	id := cl.id()
+	args := []string{id, user}
+	for _, p := range params {
+		args = append(args, string(p))
+	}
+	if err := cl.c.Writeln("USER", args...); err != nil {
+		return nil, err
+	}
+
+	cmd, reply, err := cl.c.Readln()
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) == 0 || reply[0] != id {
+		return nil, fmt.Errorf("dovecotsasl: unexpected reply to USER: %v %v", cmd, reply)
+	}
+	switch cmd {
+	case "USER":
+		if len(reply) < 2 {
+			return nil, fmt.Errorf("dovecotsasl: not enough params for %s: %v", cmd, len(reply))
+		}
+		fields := make(map[string]string, len(reply)-2)
+		for _, p := range reply[2:] {
+			parts := strings.SplitN(p, "=", 2)
+			if len(parts) == 1 {
+				fields[parts[0]] = ""
+				continue
+			}
+			fields[parts[0]] = parts[1]
+		}
+		if reply[1] != user {
+			fields["user"] = reply[1]
+		}
+		return fields, nil
+	case "NOTFOUND":
+		return nil, ErrUserUnknown
+	case "FAIL":
+		return nil, PassdbInternalError(parseFail(reply))
+	default:
+		return nil, fmt.Errorf("dovecotsasl: unexpected reply to USER: %v", cmd)
+	}
+}
+
+func (cl *MasterClient) Close() error {
+	return cl.c.Close()
+}
@@ -0,0 +1,54 @@
+package dovecotsasl
+
+import (
+	"testing"
+)
+
+type testFlusher struct {
+	flushed []string
+}
+
+func (f *testFlusher) FlushUser(user string) int {
+	f.flushed = append(f.flushed, user)
+	return 1
+}
+
+func (f *testFlusher) FlushAll() int {
+	f.flushed = append(f.flushed, "*")
+	return 10
+}
+
+func TestMasterCacheFlush(t *testing.T) {
+	flusher := &testFlusher{}
+	s := NewMasterServer()
+	s.Cache = flusher
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewMasterClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	n, err := cl.CacheFlush("foxcpp", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got count %d, want 2", n)
+	}
+	n, err = cl.CacheFlush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Errorf("got count %d, want 10", n)
+	}
+
+	if len(flusher.flushed) != 3 || flusher.flushed[0] != "foxcpp" || flusher.flushed[1] != "other" || flusher.flushed[2] != "*" {
+		t.Errorf("unexpected flushes: %v", flusher.flushed)
+	}
+}
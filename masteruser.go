@@ -0,0 +1,35 @@
+package dovecotsasl
+
+// MasterUsers configures master user logins, similar to Dovecot's master
+// passdbs and auth_master_user_separator.
+//
+// A master user logs in as another (target) user using its own password.
+// The target user is specified either using the authorization identity
+// (PLAIN and SCRAM) or by joining it with the master username using
+// Separator ("user*master" for all mechanisms).
+//
+// The master user is authenticated against Passdb. On success, Authorize
+// is called and the target user is looked up in the regular passdb of the
+// mechanism to check that it exists. The target user is reported as the
+// authenticated user and the master username is added to extra fields as
+// master_user.
+//
+// If Server.Authorize is set, users unknown to Passdb that specify the
+// authorization identity are authenticated against the regular passdb and
+// checked using Server.Authorize instead.
+type MasterUsers struct {
+	// Passdb with master users, e.g. PassdbChain.Masters().
+	Passdb Passdb
+
+	// Separator between the target and master usernames. Empty disables
+	// the login using the separator.
+	Separator string
+
+	// Authorize checks whether master is allowed to log in as user. If
+	// nil, master users can log in as any user. A returned error is
+	// reported to the client as the authz_fail failure.
+	Authorize func(req *AuthReq, master, user string) error
+}
+
+// masterUserField is the extra field containing the master username.
+const masterUserField = "master_user"
@@ -0,0 +1,143 @@
+package dovecotsasl
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+)
+
+func TestMasterUsers(t *testing.T) {
+	chain := NewPassdbChain(
+		ChainEntry{Name: "masters", Passdb: testPassdb{"support": "master"}, Master: true},
+		ChainEntry{Name: "users", Passdb: testPassdb{"foxcpp": "1234", "boss": "5678"}},
+	)
+
+	s := NewServer()
+	s.AddPassdbMechanisms(chain)
+	s.MasterUsers = &MasterUsers{
+		Passdb:    chain.Masters(),
+		Separator: "*",
+		Authorize: func(req *AuthReq, master, user string) error {
+			if user == "boss" {
+				return errAuthzNotPermitted
+			}
+			return nil
+		},
+	}
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, res *AuthOK, err error) {
+		t.Helper()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			return
+		}
+		if res.UserID != "foxcpp" || res.Extra["master_user"] != "support" {
+			t.Errorf("%s: unexpected result: %+v", name, res)
+		}
+		if res.Extra["quota"] != "1G" {
+			t.Errorf("%s: target user extra fields are not returned: %+v", name, res)
+		}
+	}
+
+	res, err := cl.Do("imap", sasl.NewPlainClient("foxcpp", "support", "master"))
+	check("PLAIN authzid", res, err)
+	res, err = cl.Do("imap", sasl.NewLoginClient("foxcpp*support", "master"))
+	check("LOGIN separator", res, err)
+	res, err = cl.Do("imap", newCRAMMD5Client("foxcpp*support", "master"))
+	check("CRAM-MD5 separator", res, err)
+	_, res, err = cl.Authenticate("imap", Credentials{AuthzID: "foxcpp", Username: "support", Password: "master"})
+	check("SCRAM authzid", res, err)
+
+	if _, err := cl.Do("imap", sasl.NewPlainClient("foxcpp", "support", "1234")); err == nil {
+		t.Error("master user logged in with a wrong password")
+	}
+	if _, err := cl.Do("imap", sasl.NewPlainClient("support", "foxcpp", "1234")); err == nil {
+		t.Error("regular user logged in as a master user")
+	}
+	if _, err := cl.Do("imap", sasl.NewPlainClient("boss", "support", "master")); err == nil {
+		t.Error("policy is not checked")
+	}
+	_, err = cl.Do("imap", sasl.NewPlainClient("nobody", "support", "master"))
+	var af AuthFail
+	if !errors.As(err, &af) {
+		t.Errorf("expected authentication failure for unknown target user, got %v", err)
+	}
+
+	// Master passdb is not used for regular logins.
+	if _, err := cl.Do("imap", sasl.NewPlainClient("", "support", "master")); err == nil {
+		t.Error("master user logged in as itself")
+	}
+
+	// Regular users are checked using Server.Authorize.
+	s.Authorize = func(req *AuthReq, authcID, authzID string) error { return nil }
+	res, err = cl.Do("imap", sasl.NewPlainClient("boss", "foxcpp", "1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.UserID != "boss" || res.Extra["auth_user"] != "foxcpp" || res.Extra["master_user"] != "" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	if _, err := cl.Do("imap", sasl.NewLoginClient("boss*foxcpp", "1234")); err == nil {
+		t.Error("regular user logged in using the master user separator")
+	}
+}
+
+// varsPassdb records request variables seen by VerifyPlain.
+type varsPassdb struct {
+	Passdb
+	vars chan map[string]string
+}
+
+func (db varsPassdb) VerifyPlain(ctx context.Context, req *AuthReq, user, pass string) (*PassdbResult, error) {
+	db.vars <- req.Vars(user)
+	return db.Passdb.VerifyPlain(ctx, req, user, pass)
+}
+
+func TestRequestVars(t *testing.T) {
+	masters := varsPassdb{testPassdb{"support": "master"}, make(chan map[string]string, 10)}
+	users := varsPassdb{testPassdb{"foxcpp": "1234"}, make(chan map[string]string, 10)}
+
+	s := NewServer()
+	s.AddPassdbMechanisms(NewUsernameNormalizer(users))
+	s.MasterUsers = &MasterUsers{Passdb: masters, Separator: "*"}
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if _, err := cl.Do("imap", sasl.NewPlainClient("", "FoxCPP", "1234"), Parameter("session=s3ss10n")); err != nil {
+		t.Fatal(err)
+	}
+	vars := <-users.vars
+	if vars["user"] != "foxcpp" || vars["orig_user"] != "FoxCPP" || vars["session"] != "s3ss10n" {
+		t.Errorf("unexpected variables: %v", vars)
+	}
+	if _, ok := vars["master_user"]; ok {
+		t.Errorf("master_user is set for a regular login: %v", vars)
+	}
+
+	if _, err := cl.Do("imap", sasl.NewPlainClient("", "foxcpp*support", "master")); err != nil {
+		t.Fatal(err)
+	}
+	vars = <-masters.vars
+	if vars["user"] != "support" || vars["master_user"] != "support" || vars["login_user"] != "foxcpp" {
+		t.Errorf("unexpected master passdb variables: %v", vars)
+	}
+}
@@ -0,0 +1,141 @@
+package dovecotsasl
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/emersion/go-sasl"
+)
+
+// Security flags of built-in mechanisms, same as used by Dovecot.
+var (
+	plainMechInfo   = Mechanism{Plaintext: true}
+	loginMechInfo   = Mechanism{Plaintext: true}
+	cramMD5MechInfo = Mechanism{Dictionary: true, Active: true}
+	scramMechInfo   = Mechanism{MutualAuth: true}
+)
+
+// passdbSuccess reports the successful authentication to the server.
+func passdbSuccess(cb FuncSASLCallback, user string, res *PassdbResult) {
+	if res.User != "" {
+		user = res.User
+	}
+	cb(user, res.Extra)
+}
+
+// PlainHandler returns the PLAIN mechanism implementation that verifies
+// credentials using db.
+func PlainHandler(db Passdb) FuncSASLHandler {
+	return func(req *AuthReq, cb FuncSASLCallback) sasl.Server {
+		return &plainServer{db: db, req: req, cb: cb}
+	}
+}
+
+type plainServer struct {
+	db  Passdb
+	req *AuthReq
+	cb  FuncSASLCallback
+
+	started bool
+}
+
+func (s *plainServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		if s.started {
+			return nil, false, errors.New("dovecotsasl: missing PLAIN response")
+		}
+		s.started = true
+		return []byte{}, false, nil
+	}
+
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 {
+		return nil, false, errors.New("dovecotsasl: malformed PLAIN response")
+	}
+	authzID, user, pass := string(parts[0]), string(parts[1]), string(parts[2])
+	if user == "" {
+		return nil, false, errors.New("dovecotsasl: empty PLAIN username")
+	}
+	authzID, user, pass, err := s.req.prepCredentials(authzID, user, pass)
+	if err != nil {
+		return nil, false, err
+	}
+	l, err := s.req.resolveLogin(s.db, authzID, user)
+	if err != nil {
+		return nil, false, err
+	}
+
+	res, err := l.verifyPlain(pass)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := l.success(s.cb, res); err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
+
+// LoginHandler returns the LOGIN mechanism implementation that verifies
+// credentials using db.
+func LoginHandler(db Passdb) FuncSASLHandler {
+	return func(req *AuthReq, cb FuncSASLCallback) sasl.Server {
+		return &loginServer{db: db, req: req, cb: cb}
+	}
+}
+
+type loginServer struct {
+	db  Passdb
+	req *AuthReq
+	cb  FuncSASLCallback
+
+	step int
+	user string
+}
+
+func (s *loginServer) Next(response []byte) ([]byte, bool, error) {
+	s.step++
+	switch s.step {
+	case 1:
+		if len(response) != 0 {
+			// Initial response contains username.
+			s.user = string(response)
+			s.step++
+			return []byte("Password:"), false, nil
+		}
+		return []byte("Username:"), false, nil
+	case 2:
+		s.user = string(response)
+		return []byte("Password:"), false, nil
+	case 3:
+		if s.user == "" {
+			return nil, false, errors.New("dovecotsasl: empty LOGIN username")
+		}
+		_, user, pass, err := s.req.prepCredentials("", s.user, string(response))
+		if err != nil {
+			return nil, false, err
+		}
+		l, err := s.req.resolveLogin(s.db, "", user)
+		if err != nil {
+			return nil, false, err
+		}
+		res, err := l.verifyPlain(pass)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := l.success(s.cb, res); err != nil {
+			return nil, false, err
+		}
+		return nil, true, nil
+	}
+	return nil, false, errors.New("dovecotsasl: unexpected LOGIN response")
+}
+
+// AddPassdbMechanisms registers all built-in mechanisms that work on top of
+// db: PLAIN, LOGIN, CRAM-MD5, SCRAM-SHA-1 and SCRAM-SHA-256.
+func (s *Server) AddPassdbMechanisms(db Passdb) {
+	s.AddMechanism("PLAIN", plainMechInfo, PlainHandler(db))
+	s.AddMechanism("LOGIN", loginMechInfo, LoginHandler(db))
+	s.AddMechanism("CRAM-MD5", cramMD5MechInfo, CRAMMD5Handler(db))
+	s.AddMechanism("SCRAM-SHA-1", scramMechInfo, SCRAMHandler("SCRAM-SHA-1", db))
+	s.AddMechanism("SCRAM-SHA-256", scramMechInfo, SCRAMHandler("SCRAM-SHA-256", db))
+}
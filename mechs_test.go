@@ -0,0 +1,121 @@
+package dovecotsasl
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/go-dovecot-sasl/pwscheme"
+)
+
+type testPassdb map[string]string
+
+func (db testPassdb) VerifyPlain(_ context.Context, _ *AuthReq, user, pass string) (*PassdbResult, error) {
+	stored, ok := db[user]
+	if !ok {
+		return nil, ErrUserUnknown
+	}
+	if stored == "disabled" {
+		return nil, ErrUserDisabled
+	}
+	if err := VerifyPassword(stored, "PLAIN", pass); err != nil {
+		return nil, err
+	}
+	return &PassdbResult{Extra: map[string]string{"quota": "1G"}}, nil
+}
+
+func (db testPassdb) LookupCredentials(_ context.Context, _ *AuthReq, user, scheme string) (*PassdbResult, error) {
+	stored, ok := db[user]
+	if !ok {
+		return nil, ErrUserUnknown
+	}
+	creds, err := PasswordCredentials(stored, "PLAIN", scheme)
+	if err != nil {
+		return nil, err
+	}
+	return &PassdbResult{Credentials: creds, Extra: map[string]string{"quota": "1G"}}, nil
+}
+
+func TestCRAMMD5Context(t *testing.T) {
+	challenge := []byte("<1896.697170952@postoffice.example.net>")
+	got, err := cramMD5Digest(pwscheme.CRAMMD5Context("tanstaaftanstaaf"), challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(md5.New, []byte("tanstaaftanstaaf"))
+	mac.Write(challenge)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		t.Errorf("digest computed from context does not match HMAC-MD5")
+	}
+}
+
+func TestPassdbMechanisms(t *testing.T) {
+	s := NewServer()
+	s.AddPassdbMechanisms(testPassdb{"foxcpp": "1234", "blocked": "disabled"})
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	for _, mech := range []string{"PLAIN", "LOGIN", "CRAM-MD5", "SCRAM-SHA-1", "SCRAM-SHA-256"} {
+		mech := mech
+		t.Run(mech, func(t *testing.T) {
+			saslCl, err := cl.mechClient(mech, Credentials{Username: "foxcpp", Password: "1234"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := cl.Do("imap", saslCl, ParamSecured(SecuredTLS))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.UserID != "foxcpp" {
+				t.Errorf("got UserID = %q, want %q", res.UserID, "foxcpp")
+			}
+
+			saslCl, err = cl.mechClient(mech, Credentials{Username: "foxcpp", Password: "5678"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = cl.Do("imap", saslCl, ParamSecured(SecuredTLS))
+			var authFail AuthFail
+			if !errors.As(err, &authFail) {
+				t.Fatal("Expected an auth fail, got", err)
+			}
+		})
+	}
+
+	mech, res, err := cl.Authenticate("imap", Credentials{Username: "foxcpp", Password: "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mech != "SCRAM-SHA-256" {
+		t.Errorf("got mech = %q, want %q", mech, "SCRAM-SHA-256")
+	}
+	if res.Extra["quota"] != "1G" {
+		t.Errorf("extra fields are not passed, got %v", res.Extra)
+	}
+
+	_, err = cl.Do("imap", sasl.NewPlainClient("", "blocked", "x"))
+	var authFail AuthFail
+	if !errors.As(err, &authFail) {
+		t.Fatal("Expected an auth fail, got", err)
+	}
+	if authFail.Code != UserDisabled {
+		t.Errorf("got code = %q, want %q", authFail.Code, UserDisabled)
+	}
+
+	// Make sure the connection is still usable after failures.
+	if _, _, err := cl.Authenticate("imap", Credentials{Username: "foxcpp", Password: "1234"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
@@ -0,0 +1,160 @@
+package dovecotsasl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// ChannelBinding contains TLS channel binding data for use with -PLUS
+// mechanisms.
+type ChannelBinding struct {
+	// Channel binding type as defined in RFC 5929, e.g. "tls-unique" or
+	// "tls-server-end-point".
+	Type string
+	Data []byte
+}
+
+// Credentials are used by Client.Authenticate to select and run
+// a SASL mechanism.
+type Credentials struct {
+	// Authorization identity, optional.
+	AuthzID string
+
+	Username string
+	Password string
+
+	// OAuth 2.0 bearer token. If set, Password is ignored and token-based
+	// mechanisms are used.
+	Token string
+
+	// Channel binding data, if set SCRAM-*-PLUS mechanisms are preferred.
+	ChannelBinding *ChannelBinding
+
+	// Permit use of plaintext mechanisms (PLAIN, LOGIN) even if the
+	// connection is not marked as secured by params.
+	AllowPlaintext bool
+
+	// Preparation of AuthzID, Username and Password before use, none by
+	// default.
+	Prep PrepMode
+}
+
+// Mechanisms in the order of preference.
+var (
+	passwordMechs = []string{
+		"SCRAM-SHA-256-PLUS",
+		"SCRAM-SHA-1-PLUS",
+		"SCRAM-SHA-256",
+		"SCRAM-SHA-1",
+		"CRAM-MD5",
+		"PLAIN",
+		"LOGIN",
+	}
+	tokenMechs = []string{
+		"OAUTHBEARER",
+		"XOAUTH2",
+	}
+)
+
+func isSecured(params []Parameter) bool {
+	for _, p := range params {
+		if p == "secured" || strings.HasPrefix(string(p), "secured=") || p == ParamTransport(TransportTLS) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectMech picks the strongest mechanism supported by the server that can
+// be used with creds.
+func (c *Client) selectMech(creds Credentials, secured bool) (string, error) {
+	candidates := passwordMechs
+	if creds.Token != "" {
+		candidates = tokenMechs
+	}
+
+	refusedPlain := false
+	for _, name := range candidates {
+		info, ok := c.info.Mechs[name]
+		if !ok {
+			continue
+		}
+		if strings.HasSuffix(name, "-PLUS") && creds.ChannelBinding == nil {
+			continue
+		}
+		plaintext := info.Plaintext || name == "PLAIN" || name == "LOGIN"
+		if plaintext && !secured && !creds.AllowPlaintext {
+			refusedPlain = true
+			continue
+		}
+		return name, nil
+	}
+
+	if refusedPlain {
+		return "", errors.New("dovecotsasl: refusing to use plaintext mechanism over insecure connection")
+	}
+	return "", errors.New("dovecotsasl: no usable mechanism offered by server")
+}
+
+func (c *Client) mechClient(mech string, creds Credentials) (sasl.Client, error) {
+	var err error
+	if creds.AuthzID, err = prepUsername(creds.Prep, creds.AuthzID); err != nil {
+		return nil, fmt.Errorf("dovecotsasl: invalid authorization identity: %v", err)
+	}
+	if creds.Username, err = prepUsername(creds.Prep, creds.Username); err != nil {
+		return nil, fmt.Errorf("dovecotsasl: invalid username: %v", err)
+	}
+	if creds.Password, err = prepPassword(creds.Prep, creds.Password); err != nil {
+		return nil, fmt.Errorf("dovecotsasl: invalid password: %v", err)
+	}
+
+	switch mech {
+	case "SCRAM-SHA-256-PLUS", "SCRAM-SHA-1-PLUS", "SCRAM-SHA-256", "SCRAM-SHA-1":
+		_, plusOffered := c.info.Mechs[mech+"-PLUS"]
+		cbSupported := creds.ChannelBinding != nil && !plusOffered
+		return newSCRAMClient(mech, creds.AuthzID, creds.Username, creds.Password, creds.ChannelBinding, cbSupported)
+	case "CRAM-MD5":
+		if creds.AuthzID != "" {
+			return nil, errors.New("dovecotsasl: CRAM-MD5 does not support authorization identity")
+		}
+		return newCRAMMD5Client(creds.Username, creds.Password), nil
+	case "PLAIN":
+		return sasl.NewPlainClient(creds.AuthzID, creds.Username, creds.Password), nil
+	case "LOGIN":
+		return sasl.NewLoginClient(creds.Username, creds.Password), nil
+	case "OAUTHBEARER":
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: creds.Username,
+			Token:    creds.Token,
+		}), nil
+	case "XOAUTH2":
+		return sasl.NewXoauth2Client(creds.Username, creds.Token), nil
+	}
+	return nil, fmt.Errorf("dovecotsasl: unsupported mechanism: %v", mech)
+}
+
+// Authenticate performs SASL authentication using the strongest mechanism
+// advertised by the server that can be used with provided credentials.
+//
+// Plaintext mechanisms are not used unless params contain ParamSecured or
+// creds.AllowPlaintext is set.
+//
+// Name of the used mechanism is returned along with the authentication
+// result.
+func (c *Client) Authenticate(service string, creds Credentials, params ...Parameter) (string, *AuthOK, error) {
+	mech, err := c.selectMech(creds, isSecured(params))
+	if err != nil {
+		return "", nil, err
+	}
+
+	cl, err := c.mechClient(mech, creds)
+	if err != nil {
+		return mech, nil, err
+	}
+
+	ao, err := c.Do(service, cl, params...)
+	return mech, ao, err
+}
@@ -0,0 +1,174 @@
+package dovecotsasl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// TokenValidator checks OAuth 2.0 bearer tokens.
+type TokenValidator interface {
+	// ValidateToken checks the token and returns the user it was issued
+	// for in PassdbResult.User. user is the username provided by the
+	// client, it may be empty.
+	//
+	// Token mechanisms do not consult Server.Authorize: the username
+	// provided by the client (OAUTHBEARER authzid or XOAUTH2 user) must
+	// match the token subject, validators should reject tokens issued for
+	// another user.
+	//
+	// Errors follow Passdb conventions: ErrPasswordMismatch for invalid or
+	// expired tokens, internal failure if the validation could not be done.
+	ValidateToken(ctx context.Context, req *AuthReq, user, token string) (*PassdbResult, error)
+}
+
+var tokenMechInfo = Mechanism{Plaintext: true}
+
+// oauthError is the JSON error sent to the client before the failure.
+type oauthError struct {
+	Status  string `json:"status"`
+	Schemes string `json:"schemes"`
+	Scope   string `json:"scope,omitempty"`
+}
+
+type tokenServer struct {
+	v       TokenValidator
+	req     *AuthReq
+	cb      FuncSASLCallback
+	xoauth2 bool
+
+	started bool
+	failure error
+}
+
+// OAuthBearerHandler returns the OAUTHBEARER (RFC 7628) mechanism
+// implementation that checks tokens using v.
+func OAuthBearerHandler(v TokenValidator) FuncSASLHandler {
+	return func(req *AuthReq, cb FuncSASLCallback) sasl.Server {
+		return &tokenServer{v: v, req: req, cb: cb}
+	}
+}
+
+// XOAuth2Handler returns the XOAUTH2 mechanism implementation that checks
+// tokens using v.
+func XOAuth2Handler(v TokenValidator) FuncSASLHandler {
+	return func(req *AuthReq, cb FuncSASLCallback) sasl.Server {
+		return &tokenServer{v: v, req: req, cb: cb, xoauth2: true}
+	}
+}
+
+// parseOAuthBearer parses the OAUTHBEARER client response:
+//
+//	gs2-header kvsep *(key=value kvsep) kvsep
+func parseOAuthBearer(response string) (user, token string, err error) {
+	parts := strings.SplitN(response, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") {
+		return "", "", errors.New("dovecotsasl: malformed OAUTHBEARER response")
+	}
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return "", "", errors.New("dovecotsasl: malformed OAUTHBEARER authzid")
+		}
+		user, err = scramUnescape(parts[1][2:])
+		if err != nil {
+			return "", "", err
+		}
+	}
+	token, err = bearerToken(strings.TrimPrefix(parts[2], "\x01"))
+	return user, token, err
+}
+
+// parseXOAuth2 parses the XOAUTH2 client response:
+//
+//	user=USER ^A auth=Bearer TOKEN ^A ^A
+func parseXOAuth2(response string) (user, token string, err error) {
+	if !strings.HasPrefix(response, "user=") {
+		return "", "", errors.New("dovecotsasl: malformed XOAUTH2 response")
+	}
+	idx := strings.IndexByte(response, '\x01')
+	if idx == -1 {
+		return "", "", errors.New("dovecotsasl: malformed XOAUTH2 response")
+	}
+	user = response[len("user="):idx]
+	token, err = bearerToken(response[idx+1:])
+	return user, token, err
+}
+
+// bearerToken extracts the token from \x01-separated key-value pairs.
+func bearerToken(kvpairs string) (string, error) {
+	if !strings.HasSuffix(kvpairs, "\x01\x01") {
+		return "", errors.New("dovecotsasl: malformed token response")
+	}
+	for _, kv := range strings.Split(strings.TrimSuffix(kvpairs, "\x01\x01"), "\x01") {
+		if !strings.HasPrefix(kv, "auth=") {
+			continue
+		}
+		value := kv[len("auth="):]
+		if len(value) < 7 || !strings.EqualFold(value[:7], "Bearer ") {
+			return "", errors.New("dovecotsasl: unsupported token type")
+		}
+		return value[7:], nil
+	}
+	return "", errors.New("dovecotsasl: missing token")
+}
+
+func (s *tokenServer) Next(response []byte) ([]byte, bool, error) {
+	if s.failure != nil {
+		// Client acknowledged the error challenge.
+		return nil, false, s.failure
+	}
+	if response == nil {
+		if s.started {
+			return nil, false, errors.New("dovecotsasl: missing token response")
+		}
+		s.started = true
+		return []byte{}, false, nil
+	}
+	s.started = true
+
+	var (
+		user, token string
+		err         error
+	)
+	if s.xoauth2 {
+		user, token, err = parseXOAuth2(string(response))
+	} else {
+		user, token, err = parseOAuthBearer(string(response))
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	res, err := s.v.ValidateToken(s.req.Context(), s.req, user, token)
+	if err != nil {
+		if PassdbStatusOf(err) == PassdbInternalFailure {
+			return nil, false, err
+		}
+		// Both mechanisms require the server to send the error
+		// challenge first.
+		s.failure = err
+		oerr := oauthError{Status: "invalid_token", Schemes: "bearer"}
+		if s.xoauth2 {
+			oerr = oauthError{Status: "401", Schemes: "bearer"}
+		}
+		challenge, _ := json.Marshal(oerr)
+		return challenge, false, nil
+	}
+	if user != "" && res.User != "" && res.User != user {
+		// Authorization identities are not supported.
+		return nil, false, errAuthzNotPermitted
+	}
+	passdbSuccess(s.cb, user, res)
+	return nil, true, nil
+}
+
+// AddTokenMechanisms registers OAUTHBEARER and XOAUTH2 mechanisms that
+// check tokens using v. The username provided by the client must match the
+// token subject, Server.Authorize is not used.
+func (s *Server) AddTokenMechanisms(v TokenValidator) {
+	s.AddMechanism("OAUTHBEARER", tokenMechInfo, OAuthBearerHandler(v))
+	s.AddMechanism("XOAUTH2", tokenMechInfo, XOAuth2Handler(v))
+}
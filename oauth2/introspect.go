@@ -0,0 +1,270 @@
+// Package oauth2 implements OAuth 2.0 bearer token validation for
+// OAUTHBEARER and XOAUTH2 mechanisms (and plaintext mechanisms, with token
+// used as a password).
+package oauth2
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+)
+
+// Introspector validates tokens using the token introspection endpoint
+// (RFC 7662). It implements dovecotsasl.TokenValidator and
+// dovecotsasl.Passdb.
+//
+// Active tokens are cached until they expire ("exp" claim), tokens without
+// expiration time are not cached.
+type Introspector struct {
+	// Introspection endpoint URL.
+	URL string
+
+	// Client credentials used to authenticate to the endpoint (HTTP Basic
+	// authentication). Not used if empty.
+	ClientID     string
+	ClientSecret string
+
+	// HTTP client to use, http.DefaultClient if nil.
+	Client *http.Client
+
+	// Claim containing the username, "username" by default. Use "sub" or
+	// "email" if the server does not return "username".
+	UsernameClaim string
+
+	// Scopes that should be granted to the token.
+	RequiredScopes []string
+
+	// Mapping of claims to extra fields.
+	ClaimFields map[string]string
+
+	// Maximum number of cached tokens.
+	CacheSize int
+
+	// Maximum time to cache the token, zero means until expiration.
+	MaxCacheTTL time.Duration
+
+	cacheLock sync.Mutex
+	cache     map[[sha256.Size]byte]*cacheEntry
+
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	claims  map[string]interface{}
+	expires time.Time
+}
+
+func NewIntrospector(endpoint, clientID, clientSecret string) *Introspector {
+	return &Introspector{
+		URL:           endpoint,
+		ClientID:      clientID,
+		ClientSecret:  clientSecret,
+		UsernameClaim: "username",
+		CacheSize:     1000,
+	}
+}
+
+func (i *Introspector) timeNow() time.Time {
+	if i.now != nil {
+		return i.now()
+	}
+	return time.Now()
+}
+
+// Introspect queries the endpoint and returns the claims. Inactive tokens
+// are reported as dovecotsasl.ErrPasswordMismatch.
+func (i *Introspector) Introspect(ctx context.Context, token string) (map[string]interface{}, error) {
+	key := sha256.Sum256([]byte(token))
+	if claims := i.cached(key); claims != nil {
+		return claims, nil
+	}
+
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+	httpReq, err := http.NewRequest(http.MethodPost, i.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, dovecotsasl.PassdbInternalError(err)
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+	if i.ClientID != "" {
+		httpReq.SetBasicAuth(url.QueryEscape(i.ClientID), url.QueryEscape(i.ClientSecret))
+	}
+
+	client := i.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, dovecotsasl.PassdbInternalError(fmt.Errorf("oauth2: introspection: %w", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, dovecotsasl.PassdbInternalError(fmt.Errorf("oauth2: introspection: unexpected status: %s", resp.Status))
+	}
+
+	var claims map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&claims); err != nil {
+		return nil, dovecotsasl.PassdbInternalError(fmt.Errorf("oauth2: introspection: malformed response: %w", err))
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, &dovecotsasl.PassdbError{
+			Status: dovecotsasl.PassdbPasswordMismatch,
+			Reason: "token is not active",
+		}
+	}
+	if exp, ok := numericDate(claims["exp"]); ok {
+		if !i.timeNow().Before(exp) {
+			return nil, &dovecotsasl.PassdbError{
+				Status: dovecotsasl.PassdbPasswordMismatch,
+				Reason: "token is expired",
+			}
+		}
+		i.store(key, claims, exp)
+	}
+	return claims, nil
+}
+
+// numericDate converts the JSON number of seconds since the epoch.
+func numericDate(v interface{}) (time.Time, bool) {
+	f, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+func (i *Introspector) cached(key [sha256.Size]byte) map[string]interface{} {
+	i.cacheLock.Lock()
+	defer i.cacheLock.Unlock()
+	e, ok := i.cache[key]
+	if !ok {
+		return nil
+	}
+	if !i.timeNow().Before(e.expires) {
+		delete(i.cache, key)
+		return nil
+	}
+	return e.claims
+}
+
+func (i *Introspector) store(key [sha256.Size]byte, claims map[string]interface{}, exp time.Time) {
+	if i.CacheSize <= 0 {
+		return
+	}
+	now := i.timeNow()
+	if i.MaxCacheTTL != 0 && exp.After(now.Add(i.MaxCacheTTL)) {
+		exp = now.Add(i.MaxCacheTTL)
+	}
+
+	i.cacheLock.Lock()
+	defer i.cacheLock.Unlock()
+	if i.cache == nil {
+		i.cache = make(map[[sha256.Size]byte]*cacheEntry)
+	}
+	if len(i.cache) >= i.CacheSize {
+		for k, e := range i.cache {
+			if !now.Before(e.expires) {
+				delete(i.cache, k)
+			}
+		}
+	}
+	for k := range i.cache {
+		if len(i.cache) < i.CacheSize {
+			break
+		}
+		delete(i.cache, k)
+	}
+	i.cache[key] = &cacheEntry{claims: claims, expires: exp}
+}
+
+// hasScopes checks that the space-separated scope claim contains all
+// required scopes.
+func hasScopes(scope interface{}, required []string) bool {
+	s, _ := scope.(string)
+	granted := make(map[string]bool)
+	for _, sc := range strings.Fields(s) {
+		granted[sc] = true
+	}
+	for _, sc := range required {
+		if !granted[sc] {
+			return false
+		}
+	}
+	return true
+}
+
+// claimsResult checks the username and converts claims into the passdb
+// result. It is shared by all validators in the package.
+func claimsResult(claims map[string]interface{}, usernameClaim string, claimFields map[string]string, user string) (*dovecotsasl.PassdbResult, error) {
+	username, _ := claims[usernameClaim].(string)
+	if username == "" {
+		return nil, &dovecotsasl.PassdbError{
+			Status: dovecotsasl.PassdbPasswordMismatch,
+			Reason: "token does not contain " + usernameClaim + " claim",
+		}
+	}
+	if user != "" && user != username {
+		return nil, &dovecotsasl.PassdbError{
+			Status: dovecotsasl.PassdbPasswordMismatch,
+			Reason: "token was issued for another user",
+		}
+	}
+
+	res := &dovecotsasl.PassdbResult{
+		User:  username,
+		Extra: make(map[string]string),
+	}
+	for claim, field := range claimFields {
+		switch v := claims[claim].(type) {
+		case string:
+			res.Extra[field] = v
+		case nil:
+		default:
+			val, _ := json.Marshal(v)
+			res.Extra[field] = string(val)
+		}
+	}
+	return res, nil
+}
+
+func (i *Introspector) ValidateToken(ctx context.Context, _ *dovecotsasl.AuthReq, user, token string) (*dovecotsasl.PassdbResult, error) {
+	claims, err := i.Introspect(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if !hasScopes(claims["scope"], i.RequiredScopes) {
+		return nil, &dovecotsasl.PassdbError{
+			Status: dovecotsasl.PassdbPasswordMismatch,
+			Reason: "insufficient token scope",
+		}
+	}
+	return claimsResult(claims, i.UsernameClaim, i.ClaimFields, user)
+}
+
+// VerifyPlain checks the token passed as a password.
+func (i *Introspector) VerifyPlain(ctx context.Context, req *dovecotsasl.AuthReq, user, pass string) (*dovecotsasl.PassdbResult, error) {
+	if pass == "" {
+		return nil, dovecotsasl.ErrPasswordMismatch
+	}
+	return i.ValidateToken(ctx, req, user, pass)
+}
+
+// LookupCredentials always returns dovecotsasl.ErrSchemeNotAvailable.
+func (i *Introspector) LookupCredentials(context.Context, *dovecotsasl.AuthReq, string, string) (*dovecotsasl.PassdbResult, error) {
+	return nil, dovecotsasl.ErrSchemeNotAvailable
+}
@@ -0,0 +1,91 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+)
+
+func TestIntrospector(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	exp := now.Add(time.Hour).Unix()
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if id, secret, ok := r.BasicAuth(); !ok || id != "imap" || secret != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		resp := map[string]interface{}{"active": false}
+		switch r.PostFormValue("token") {
+		case "valid":
+			resp = map[string]interface{}{
+				"active":   true,
+				"username": "foxcpp@example.org",
+				"scope":    "openid mail",
+				"exp":      exp,
+				"quota":    "1G",
+			}
+		case "noscope":
+			resp = map[string]interface{}{
+				"active":   true,
+				"username": "foxcpp@example.org",
+				"scope":    "openid",
+			}
+		case "expired":
+			resp = map[string]interface{}{
+				"active":   true,
+				"username": "foxcpp@example.org",
+				"exp":      now.Add(-time.Second).Unix(),
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	i := NewIntrospector(srv.URL, "imap", "s3cr3t")
+	i.RequiredScopes = []string{"mail"}
+	i.ClaimFields = map[string]string{"quota": "quota"}
+	i.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	res, err := i.ValidateToken(ctx, nil, "", "valid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.User != "foxcpp@example.org" || res.Extra["quota"] != "1G" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	if _, err := i.ValidateToken(ctx, nil, "foxcpp@example.org", "valid"); err != nil {
+		t.Errorf("matching username rejected: %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("token is not cached, %d requests made", requests)
+	}
+	if _, err := i.ValidateToken(ctx, nil, "admin@example.org", "valid"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("token accepted for another user: %v", err)
+	}
+
+	for _, token := range []string{"invalid", "noscope", "expired"} {
+		if _, err := i.ValidateToken(ctx, nil, "", token); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+			t.Errorf("%s: expected password mismatch, got %v", token, err)
+		}
+	}
+
+	// Cache expires with the token.
+	now = now.Add(2 * time.Hour)
+	if _, err := i.ValidateToken(ctx, nil, "", "valid"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("expired token accepted: %v", err)
+	}
+
+	i.ClientSecret = "wrong"
+	if _, err := i.ValidateToken(ctx, nil, "", "other"); dovecotsasl.PassdbStatusOf(err) != dovecotsasl.PassdbInternalFailure {
+		t.Errorf("expected internal failure, got %v", err)
+	}
+}
@@ -0,0 +1,426 @@
+package oauth2
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+)
+
+// JWTValidator validates JWT access tokens locally using keys from JWKS
+// files. It implements dovecotsasl.TokenValidator and dovecotsasl.Passdb.
+//
+// Supported algorithms are RS256, ES256, EdDSA (Ed25519) and HS256. The
+// token should have "exp" claim, "nbf", "iss" and "aud" claims are checked
+// if present (or configured).
+type JWTValidator struct {
+	// Path to the JWKS file or to the directory with *.json files, each
+	// containing either JWKS or a single JWK. Files are reloaded when
+	// changed.
+	KeysPath string
+
+	// Expected "iss" claim value. Not checked if empty.
+	Issuer string
+
+	// Value that should be present in "aud" claim. Not checked if empty.
+	Audience string
+
+	// Claim containing the username, "sub" by default.
+	UsernameClaim string
+
+	// Scopes that should be granted to the token ("scope" claim).
+	RequiredScopes []string
+
+	// Mapping of claims to extra fields.
+	ClaimFields map[string]string
+
+	// Allowed clock skew for "exp" and "nbf" checks.
+	Leeway time.Duration
+
+	// Log receives messages about keys that were skipped because they are
+	// malformed or not supported.
+	Log *log.Logger
+
+	keysLock sync.Mutex
+	keysSig  string
+	keys     []*jwk
+
+	now func() time.Time
+}
+
+func NewJWTValidator(keysPath, issuer, audience string) *JWTValidator {
+	return &JWTValidator{
+		KeysPath:      keysPath,
+		Issuer:        issuer,
+		Audience:      audience,
+		UsernameClaim: "sub",
+		Leeway:        time.Minute,
+		Log:           log.New(ioutil.Discard, "", 0),
+	}
+}
+
+// jwk is a parsed JSON Web Key (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC, OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// oct
+	K string `json:"k"`
+
+	key interface{}
+}
+
+func b64Decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (k *jwk) parse() error {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Decode(k.N)
+		if err != nil {
+			return err
+		}
+		e, err := b64Decode(k.E)
+		if err != nil {
+			return err
+		}
+		eInt := new(big.Int).SetBytes(e)
+		if !eInt.IsInt64() || eInt.Int64() > 1<<31-1 {
+			return errors.New("RSA exponent is too big")
+		}
+		k.key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(eInt.Int64())}
+	case "EC":
+		if k.Crv != "P-256" {
+			return fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := b64Decode(k.X)
+		if err != nil {
+			return err
+		}
+		y, err := b64Decode(k.Y)
+		if err != nil {
+			return err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return errors.New("EC point is not on curve")
+		}
+		k.key = pub
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := b64Decode(k.X)
+		if err != nil {
+			return err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return errors.New("malformed Ed25519 key")
+		}
+		k.key = ed25519.PublicKey(x)
+	case "oct":
+		secret, err := b64Decode(k.K)
+		if err != nil {
+			return err
+		}
+		k.key = secret
+	default:
+		return fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+	return nil
+}
+
+// algKty returns the key type for the signature algorithm.
+var algKty = map[string]string{
+	"RS256": "RSA",
+	"ES256": "EC",
+	"EdDSA": "OKP",
+	"HS256": "oct",
+}
+
+// parseKeysFile parses the JWKS or a single JWK. Keys that can not be used
+// are passed to skip and not returned, so e.g. keys with unsupported curves
+// in the identity provider JWKS do not prevent the use of other keys.
+func parseKeysFile(path string, skip func(error)) ([]*jwk, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(blob, &set); err != nil {
+		return nil, fmt.Errorf("oauth2: %s: %w", path, err)
+	}
+	if set.Keys == nil {
+		var key jwk
+		if err := json.Unmarshal(blob, &key); err != nil {
+			return nil, fmt.Errorf("oauth2: %s: %w", path, err)
+		}
+		set.Keys = []*jwk{&key}
+	}
+
+	keys := set.Keys[:0]
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if err := k.parse(); err != nil {
+			skip(fmt.Errorf("%s: key %q: %w", path, k.Kid, err))
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// keyFiles returns the list of key files and the signature used to detect
+// changes.
+func (v *JWTValidator) keyFiles() ([]string, string, error) {
+	info, err := os.Stat(v.KeysPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if !info.IsDir() {
+		return []string{v.KeysPath}, fmt.Sprint(info.ModTime().UnixNano(), info.Size()), nil
+	}
+
+	infos, err := ioutil.ReadDir(v.KeysPath)
+	if err != nil {
+		return nil, "", err
+	}
+	var (
+		files []string
+		sig   strings.Builder
+	)
+	for _, info := range infos {
+		if info.IsDir() || filepath.Ext(info.Name()) != ".json" {
+			continue
+		}
+		files = append(files, filepath.Join(v.KeysPath, info.Name()))
+		fmt.Fprint(&sig, info.Name(), info.ModTime().UnixNano(), info.Size(), ";")
+	}
+	sort.Strings(files)
+	return files, sig.String(), nil
+}
+
+// loadKeys returns the current key set, reloading it if files were changed.
+func (v *JWTValidator) loadKeys() ([]*jwk, error) {
+	files, sig, err := v.keyFiles()
+	if err != nil {
+		return nil, fmt.Errorf("oauth2: %w", err)
+	}
+
+	v.keysLock.Lock()
+	defer v.keysLock.Unlock()
+	if v.keys != nil && sig == v.keysSig {
+		return v.keys, nil
+	}
+
+	var (
+		keys    []*jwk
+		skipErr error
+	)
+	for _, f := range files {
+		fileKeys, err := parseKeysFile(f, func(err error) {
+			if v.Log != nil {
+				v.Log.Println("oauth2: skipping key:", err)
+			}
+			skipErr = err
+		})
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, fileKeys...)
+	}
+	if len(keys) == 0 && skipErr != nil {
+		return nil, fmt.Errorf("oauth2: no usable keys: %w", skipErr)
+	}
+	v.keys = keys
+	v.keysSig = sig
+	return keys, nil
+}
+
+func verifySignature(alg string, key interface{}, signed, sig []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch alg {
+	case "RS256":
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], sig) == nil
+	case "ES256":
+		if len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key.(*ecdsa.PublicKey), digest[:], r, s)
+	case "EdDSA":
+		return ed25519.Verify(key.(ed25519.PublicKey), signed, sig)
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	}
+	return false
+}
+
+func invalidToken(reason string) error {
+	return &dovecotsasl.PassdbError{
+		Status: dovecotsasl.PassdbPasswordMismatch,
+		Reason: reason,
+	}
+}
+
+// Verify checks the token signature and time-related claims and returns
+// the token claims.
+func (v *JWTValidator) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalidToken("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerBlob, err := b64Decode(parts[0])
+	if err != nil {
+		return nil, invalidToken("malformed token header")
+	}
+	if err := json.Unmarshal(headerBlob, &header); err != nil {
+		return nil, invalidToken("malformed token header")
+	}
+	kty, ok := algKty[header.Alg]
+	if !ok {
+		return nil, invalidToken("unsupported algorithm: " + header.Alg)
+	}
+	sig, err := b64Decode(parts[2])
+	if err != nil {
+		return nil, invalidToken("malformed token signature")
+	}
+
+	keys, err := v.loadKeys()
+	if err != nil {
+		return nil, dovecotsasl.PassdbInternalError(err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range keys {
+		// Key type should match the algorithm, otherwise an RSA public key
+		// could be used as an HMAC secret.
+		if k.Kty != kty || (k.Alg != "" && k.Alg != header.Alg) {
+			continue
+		}
+		if header.Kid != "" && k.Kid != header.Kid {
+			continue
+		}
+		if verifySignature(header.Alg, k.key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, invalidToken("invalid token signature")
+	}
+
+	payload, err := b64Decode(parts[1])
+	if err != nil {
+		return nil, invalidToken("malformed token payload")
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, invalidToken("malformed token payload")
+	}
+
+	now := time.Now()
+	if v.now != nil {
+		now = v.now()
+	}
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return nil, invalidToken("token does not have expiration time")
+	}
+	if !now.Before(exp.Add(v.Leeway)) {
+		return nil, invalidToken("token is expired")
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(v.Leeway).Before(nbf) {
+		return nil, invalidToken("token is not valid yet")
+	}
+	if v.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.Issuer {
+			return nil, invalidToken("token issuer mismatch")
+		}
+	}
+	if v.Audience != "" && !hasAudience(claims["aud"], v.Audience) {
+		return nil, invalidToken("token audience mismatch")
+	}
+	return claims, nil
+}
+
+// hasAudience checks the "aud" claim, which can be either a string or an
+// array of strings.
+func hasAudience(aud interface{}, expected string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == expected
+	case []interface{}:
+		for _, a := range aud {
+			if s, _ := a.(string); s == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *JWTValidator) ValidateToken(_ context.Context, _ *dovecotsasl.AuthReq, user, token string) (*dovecotsasl.PassdbResult, error) {
+	claims, err := v.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if !hasScopes(claims["scope"], v.RequiredScopes) {
+		return nil, invalidToken("insufficient token scope")
+	}
+	return claimsResult(claims, v.UsernameClaim, v.ClaimFields, user)
+}
+
+// VerifyPlain checks the token passed as a password.
+func (v *JWTValidator) VerifyPlain(ctx context.Context, req *dovecotsasl.AuthReq, user, pass string) (*dovecotsasl.PassdbResult, error) {
+	if pass == "" {
+		return nil, dovecotsasl.ErrPasswordMismatch
+	}
+	return v.ValidateToken(ctx, req, user, pass)
+}
+
+// LookupCredentials always returns dovecotsasl.ErrSchemeNotAvailable.
+func (v *JWTValidator) LookupCredentials(context.Context, *dovecotsasl.AuthReq, string, string) (*dovecotsasl.PassdbResult, error) {
+	return nil, dovecotsasl.ErrSchemeNotAvailable
+}
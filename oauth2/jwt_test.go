@@ -0,0 +1,228 @@
+package oauth2
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+)
+
+type testKey struct {
+	alg  string
+	kid  string
+	priv interface{}
+	jwk  map[string]string
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func testKeys(t *testing.T) []testKey {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	return []testKey{
+		{"RS256", "rsa", rsaKey, map[string]string{
+			"kty": "RSA", "kid": "rsa",
+			"n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+		}},
+		{"ES256", "ec", ecKey, map[string]string{
+			"kty": "EC", "kid": "ec", "crv": "P-256",
+			"x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes()),
+		}},
+		{"EdDSA", "ed", edKey, map[string]string{
+			"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edPub),
+		}},
+		{"HS256", "hmac", secret, map[string]string{
+			"kty": "oct", "kid": "hmac", "k": b64(secret),
+		}},
+	}
+}
+
+func signJWT(t *testing.T, k testKey, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": k.alg, "kid": k.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch priv := k.priv.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(priv, []byte(signed))
+	case []byte:
+		mac := hmac.New(sha256.New, priv)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	return signed + "." + b64(sig)
+}
+
+// tamper replaces the token payload keeping the signature.
+func tamper(token string, claims map[string]interface{}) string {
+	parts := strings.Split(token, ".")
+	payload, _ := json.Marshal(claims)
+	return parts[0] + "." + b64(payload) + "." + parts[2]
+}
+
+func writeKeys(t *testing.T, path string, keys []testKey, mtime time.Time) {
+	t.Helper()
+	set := map[string][]map[string]string{"keys": {}}
+	for _, k := range keys {
+		set["keys"] = append(set["keys"], k.jwk)
+	}
+	blob, _ := json.Marshal(set)
+	if err := ioutil.WriteFile(path, blob, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWTValidator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth2-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := testKeys(t)
+	now := time.Unix(1600000000, 0)
+	writeKeys(t, filepath.Join(dir, "keys.json"), keys[:3], now)
+
+	v := NewJWTValidator(dir, "https://idp.example.org", "imap")
+	v.now = func() time.Time { return now }
+
+	claims := func(mod func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": "https://idp.example.org",
+			"aud": []string{"imap", "smtp"},
+			"sub": "foxcpp@example.org",
+			"exp": now.Add(time.Hour).Unix(),
+			"nbf": now.Add(-time.Hour).Unix(),
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+
+	for _, k := range keys[:3] {
+		res, err := v.ValidateToken(context.Background(), nil, "foxcpp@example.org", signJWT(t, k, claims(nil)))
+		if err != nil {
+			t.Errorf("%s: %v", k.alg, err)
+			continue
+		}
+		if res.User != "foxcpp@example.org" {
+			t.Errorf("%s: got user %q", k.alg, res.User)
+		}
+	}
+
+	invalid := map[string]string{
+		"expired":        signJWT(t, keys[0], claims(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() })),
+		"no exp":         signJWT(t, keys[0], claims(func(c map[string]interface{}) { delete(c, "exp") })),
+		"not yet valid":  signJWT(t, keys[0], claims(func(c map[string]interface{}) { c["nbf"] = now.Add(time.Hour).Unix() })),
+		"wrong issuer":   signJWT(t, keys[0], claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.org" })),
+		"wrong audience": signJWT(t, keys[0], claims(func(c map[string]interface{}) { c["aud"] = "smtp" })),
+		"another user":   signJWT(t, keys[0], claims(func(c map[string]interface{}) { c["sub"] = "admin@example.org" })),
+		"unknown key":    signJWT(t, keys[3], claims(nil)),
+		"none alg":       b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"foxcpp@example.org"}`)) + ".",
+		"tampered":       tamper(signJWT(t, keys[1], claims(nil)), claims(func(c map[string]interface{}) { c["exp"] = now.Add(48 * time.Hour).Unix() })),
+	}
+	for name, token := range invalid {
+		if _, err := v.ValidateToken(context.Background(), nil, "foxcpp@example.org", token); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+			t.Errorf("%s: expected password mismatch, got %v", name, err)
+		}
+	}
+
+	// Keys are reloaded when a file is added.
+	writeKeys(t, filepath.Join(dir, "hmac.json"), keys[3:], now)
+	if _, err := v.ValidateToken(context.Background(), nil, "", signJWT(t, keys[3], claims(nil))); err != nil {
+		t.Errorf("new key is not loaded: %v", err)
+	}
+}
+
+func TestJWTValidatorUnsupportedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth2-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := testKeys(t)
+	now := time.Unix(1600000000, 0)
+	p384 := testKey{jwk: map[string]string{
+		"kty": "EC", "kid": "p384", "crv": "P-384", "x": "AA", "y": "AA",
+	}}
+	path := filepath.Join(dir, "keys.json")
+	writeKeys(t, path, []testKey{p384, keys[0]}, now)
+
+	var logBuf strings.Builder
+	v := NewJWTValidator(path, "", "")
+	v.Log = log.New(&logBuf, "", 0)
+	v.now = func() time.Time { return now }
+
+	token := signJWT(t, keys[0], map[string]interface{}{
+		"sub": "foxcpp@example.org",
+		"exp": now.Add(time.Hour).Unix(),
+	})
+	if _, err := v.ValidateToken(context.Background(), nil, "", token); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logBuf.String(), "p384") {
+		t.Errorf("skipped key is not logged: %q", logBuf.String())
+	}
+
+	// No usable keys left.
+	writeKeys(t, path, []testKey{p384}, now.Add(time.Second))
+	if _, err := v.ValidateToken(context.Background(), nil, "", token); dovecotsasl.PassdbStatusOf(err) != dovecotsasl.PassdbInternalFailure {
+		t.Errorf("expected internal failure, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package dovecotsasl
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+)
+
+type testTokenValidator map[string]string
+
+func (v testTokenValidator) ValidateToken(_ context.Context, _ *AuthReq, user, token string) (*PassdbResult, error) {
+	tokenUser, ok := v[token]
+	if !ok || (user != "" && user != tokenUser) {
+		return nil, ErrPasswordMismatch
+	}
+	return &PassdbResult{User: tokenUser}, nil
+}
+
+func TestTokenMechanisms(t *testing.T) {
+	s := NewServer()
+	s.AddTokenMechanisms(testTokenValidator{"t0ken": "foxcpp"})
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	for _, mech := range []string{"OAUTHBEARER", "XOAUTH2"} {
+		mech := mech
+		t.Run(mech, func(t *testing.T) {
+			saslCl, err := cl.mechClient(mech, Credentials{Username: "foxcpp", Token: "t0ken"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := cl.Do("imap", saslCl, ParamSecured(SecuredTLS))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.UserID != "foxcpp" {
+				t.Errorf("got user %q, want %q", res.UserID, "foxcpp")
+			}
+
+			saslCl, err = cl.mechClient(mech, Credentials{Username: "foxcpp", Token: "invalid"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = cl.Do("imap", saslCl, ParamSecured(SecuredTLS))
+			var (
+				bearerErr  *sasl.OAuthBearerError
+				xoauth2Err *sasl.Xoauth2Error
+			)
+			if !errors.As(err, &bearerErr) && !errors.As(err, &xoauth2Err) {
+				t.Errorf("expected mechanism error, got %v", err)
+			}
+		})
+	}
+
+	// Connection is still usable after error challenges.
+	mech, res, err := cl.Authenticate("imap", Credentials{Token: "t0ken"}, ParamSecured(SecuredTLS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mech != "OAUTHBEARER" || res.UserID != "foxcpp" {
+		t.Errorf("unexpected result: %s %+v", mech, res)
+	}
+}
+
+// subjectTokenValidator ignores the username provided by the client.
+type subjectTokenValidator map[string]string
+
+func (v subjectTokenValidator) ValidateToken(_ context.Context, _ *AuthReq, _, token string) (*PassdbResult, error) {
+	tokenUser, ok := v[token]
+	if !ok {
+		return nil, ErrPasswordMismatch
+	}
+	return &PassdbResult{User: tokenUser}, nil
+}
+
+func TestTokenMechanismsSubjectMismatch(t *testing.T) {
+	s := NewServer()
+	s.AddTokenMechanisms(subjectTokenValidator{"t0ken": "foxcpp"})
+	s.Authorize = func(*AuthReq, string, string) error { return nil }
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	saslCl, err := cl.mechClient("OAUTHBEARER", Credentials{Username: "admin", Token: "t0ken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cl.Do("imap", saslCl, ParamSecured(SecuredTLS))
+	var af AuthFail
+	if !errors.As(err, &af) || af.Code != AuthzFail {
+		t.Errorf("expected authz_fail, got %v", err)
+	}
+}
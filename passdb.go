@@ -0,0 +1,193 @@
+package dovecotsasl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// PassdbStatus is the result of a passdb lookup, mirrors Dovecot's
+// enum passdb_result.
+type PassdbStatus int
+
+const (
+	PassdbOK PassdbStatus = iota
+	PassdbPasswordMismatch
+	PassdbUserUnknown
+	PassdbUserDisabled
+	PassdbPassExpired
+	PassdbSchemeNotAvailable
+	PassdbInternalFailure
+)
+
+func (s PassdbStatus) String() string {
+	switch s {
+	case PassdbOK:
+		return "ok"
+	case PassdbPasswordMismatch:
+		return "password mismatch"
+	case PassdbUserUnknown:
+		return "user unknown"
+	case PassdbUserDisabled:
+		return "user disabled"
+	case PassdbPassExpired:
+		return "password expired"
+	case PassdbSchemeNotAvailable:
+		return "scheme not available"
+	case PassdbInternalFailure:
+		return "internal failure"
+	}
+	return fmt.Sprintf("PassdbStatus(%d)", int(s))
+}
+
+// PassdbError is a typed passdb failure.
+//
+// Use errors.Is with ErrPasswordMismatch, ErrUserUnknown, etc. to check the
+// status or PassdbStatusOf to get it directly.
+type PassdbError struct {
+	Status PassdbStatus
+	Reason string
+
+	// Extra fields to return with failure (e.g. "nodelay").
+	Extra map[string]string
+
+	// Underlying error, mostly for PassdbInternalFailure.
+	Err error
+
+	// UserFound is set with PassdbSchemeNotAvailable if the user exists,
+	// but its credentials can not be returned. Without it, the status does
+	// not tell whether the user exists (e.g. for backends that never see
+	// passwords).
+	UserFound bool
+}
+
+func (pe *PassdbError) Error() string {
+	msg := "dovecotsasl: passdb: " + pe.Status.String()
+	if pe.Reason != "" {
+		msg += ": " + pe.Reason
+	}
+	if pe.Err != nil {
+		msg += ": " + pe.Err.Error()
+	}
+	return msg
+}
+
+func (pe *PassdbError) Unwrap() error {
+	return pe.Err
+}
+
+// Is reports whether target is a PassdbError with the same status.
+func (pe *PassdbError) Is(target error) bool {
+	t, ok := target.(*PassdbError)
+	if !ok {
+		return false
+	}
+	return t.Status == pe.Status
+}
+
+var (
+	ErrPasswordMismatch   = &PassdbError{Status: PassdbPasswordMismatch}
+	ErrUserUnknown        = &PassdbError{Status: PassdbUserUnknown}
+	ErrUserDisabled       = &PassdbError{Status: PassdbUserDisabled}
+	ErrPassExpired        = &PassdbError{Status: PassdbPassExpired}
+	ErrSchemeNotAvailable = &PassdbError{Status: PassdbSchemeNotAvailable}
+
+	// ErrCredentialsUnavailable is ErrSchemeNotAvailable for users that
+	// were found by the backend.
+	ErrCredentialsUnavailable = &PassdbError{Status: PassdbSchemeNotAvailable, UserFound: true}
+)
+
+// PassdbInternalError wraps err as an internal passdb failure.
+func PassdbInternalError(err error) error {
+	return &PassdbError{Status: PassdbInternalFailure, Err: err}
+}
+
+// PassdbStatusOf returns the status corresponding to the error returned by
+// Passdb. Untyped errors are considered to be internal failures.
+func PassdbStatusOf(err error) PassdbStatus {
+	if err == nil {
+		return PassdbOK
+	}
+	var pe *PassdbError
+	if errors.As(err, &pe) {
+		return pe.Status
+	}
+	return PassdbInternalFailure
+}
+
+// PassdbUserFound reports whether the error returned by Passdb means that
+// the user exists: the lookup succeeded, failed for a known user or
+// returned ErrCredentialsUnavailable. Plain ErrSchemeNotAvailable does not
+// tell anything about the user.
+func PassdbUserFound(err error) bool {
+	switch PassdbStatusOf(err) {
+	case PassdbOK, PassdbPasswordMismatch, PassdbUserDisabled, PassdbPassExpired:
+		return true
+	case PassdbSchemeNotAvailable:
+		var pe *PassdbError
+		return errors.As(err, &pe) && pe.UserFound
+	}
+	return false
+}
+
+// PassdbResult is the successful result of a passdb lookup.
+type PassdbResult struct {
+	// User is the username as known to passdb. It may differ from the
+	// requested one (e.g. if backend canonicalizes it). If empty, the
+	// requested username is used.
+	User string
+
+	// Credentials in the requested scheme. Set only by
+	// Passdb.LookupCredentials.
+	Credentials []byte
+
+	// Extra fields, see https://doc.dovecot.org/configuration_manual/authentication/password_database_extra_fields/.
+	Extra map[string]string
+}
+
+// Passdb is the credentials backend, modelled after Dovecot's passdb layer.
+//
+// Both methods should return PassdbError (use ErrUserUnknown,
+// ErrPasswordMismatch and friends) to signal the lookup failure. Untyped
+// errors are treated as internal failures.
+type Passdb interface {
+	// VerifyPlain checks the plaintext password for the specified user.
+	VerifyPlain(ctx context.Context, req *AuthReq, user, pass string) (*PassdbResult, error)
+
+	// LookupCredentials returns user credentials in the requested scheme.
+	//
+	// The format of returned credentials is the same as Dovecot uses, that is:
+	// - PLAIN: plaintext password;
+	// - CRAM-MD5: 32 bytes of HMAC-MD5 context;
+	// - SCRAM-SHA-1, SCRAM-SHA-256: "iter,salt,storedkey,serverkey" string
+	//   with base64-encoded values.
+	//
+	// ErrSchemeNotAvailable should be returned if credentials can not be
+	// converted into the requested scheme. Use ErrCredentialsUnavailable
+	// (or PasswordCredentials) once the user is known to exist.
+	LookupCredentials(ctx context.Context, req *AuthReq, user, scheme string) (*PassdbResult, error)
+}
+
+// failFromPassdb converts the passdb error into the protocol-level failure.
+//
+// PasswordMismatch and UserUnknown are indistinguishable for the client.
+func failFromPassdb(rid string, err error) AuthFail {
+	af := AuthFail{
+		RequestID: rid,
+		Reason:    "authentication failed",
+	}
+	var pe *PassdbError
+	if errors.As(err, &pe) {
+		af.Extra = pe.Extra
+	}
+	switch PassdbStatusOf(err) {
+	case PassdbUserDisabled:
+		af.Code = UserDisabled
+	case PassdbPassExpired:
+		af.Code = PassExpired
+	case PassdbInternalFailure:
+		af.Code = TempFail
+		af.Reason = "temporary authentication failure"
+	}
+	return af
+}
@@ -0,0 +1,272 @@
+// Package passwdfile implements passdb and userdb backend using files in
+// Dovecot's passwd-file format:
+//
+//	user:{SCHEME}password:uid:gid:gecos:home:shell:extra_fields
+//
+// Extra fields are space-separated key=value pairs, fields with "userdb_"
+// prefix are used for userdb lookups.
+//
+// See https://doc.dovecot.org/configuration_manual/authentication/passwd_file/.
+package passwdfile
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	"github.com/foxcpp/go-dovecot-sasl/expand"
+)
+
+// Entry is a single passwd-file line.
+type Entry struct {
+	User     string
+	Password string
+	UID      string
+	GID      string
+	Gecos    string
+	Home     string
+	Shell    string
+	Extra    map[string]string
+}
+
+type file struct {
+	modTime time.Time
+	size    int64
+	entries map[string]*Entry
+}
+
+// DB is the passwd-file backend. It implements dovecotsasl.Passdb.
+//
+// The file is re-read when its modification time or size changes.
+type DB struct {
+	// Path to the file. It may contain variables, e.g. /etc/dovecot/%d/passwd
+	// to use per-domain files.
+	Path string
+
+	// Scheme to use for passwords without {SCHEME} prefix.
+	DefaultScheme string
+
+	// Template used to build the lookup key from the username, %u by
+	// default. Use %n to look up users without the domain part.
+	UsernameFormat string
+
+	filesLock sync.Mutex
+	files     map[string]*file
+}
+
+func New(path string) *DB {
+	return &DB{
+		Path:           path,
+		DefaultScheme:  "CRYPT",
+		UsernameFormat: "%u",
+		files:          map[string]*file{},
+	}
+}
+
+func parseExtra(fields string) map[string]string {
+	extra := make(map[string]string)
+	for _, f := range strings.Fields(fields) {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) == 1 {
+			extra[parts[0]] = ""
+			continue
+		}
+		extra[parts[0]] = parts[1]
+	}
+	return extra
+}
+
+// Parse reads entries from the passwd-file.
+func Parse(path string) (map[string]*Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make(map[string]*Entry)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 8)
+		if fields[0] == "" {
+			return nil, fmt.Errorf("passwdfile: %s:%d: empty username", path, lineNum)
+		}
+		for len(fields) < 8 {
+			fields = append(fields, "")
+		}
+		entries[fields[0]] = &Entry{
+			User:     fields[0],
+			Password: fields[1],
+			UID:      fields[2],
+			GID:      fields[3],
+			Gecos:    fields[4],
+			Home:     fields[5],
+			Shell:    fields[6],
+			Extra:    parseExtra(fields[7]),
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// entries returns the contents of the file, re-reading it if it was
+// changed since the last read.
+func (db *DB) entries(path string) (map[string]*Entry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db.filesLock.Lock()
+	defer db.filesLock.Unlock()
+	if db.files == nil {
+		db.files = map[string]*file{}
+	}
+
+	cached := db.files[path]
+	if cached != nil && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.entries, nil
+	}
+
+	entries, err := Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	db.files[path] = &file{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		entries: entries,
+	}
+	return entries, nil
+}
+
+// safePathValue reports whether the variable value can be used in the file
+// path: it must not change the directory (contain "/" or be "." or "..")
+// or contain NUL bytes.
+func safePathValue(v string) bool {
+	return v != "." && v != ".." && !strings.ContainsAny(v, "/\x00")
+}
+
+// Lookup returns the entry for the user. Usernames that would make the
+// file path point outside of the configured directories are rejected.
+func (db *DB) Lookup(req *dovecotsasl.AuthReq, user string) (*Entry, error) {
+	vars := req.Vars(user)
+	unsafe := false
+	path := expand.Expand(db.Path, vars, func(v string) string {
+		if !safePathValue(v) {
+			unsafe = true
+		}
+		return v
+	})
+	if unsafe {
+		return nil, &dovecotsasl.PassdbError{
+			Status: dovecotsasl.PassdbUserUnknown,
+			Reason: "unsafe characters in file path",
+		}
+	}
+	key := expand.Expand(db.UsernameFormat, vars, nil)
+
+	entries, err := db.entries(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, dovecotsasl.ErrUserUnknown
+		}
+		return nil, dovecotsasl.PassdbInternalError(err)
+	}
+	e, ok := entries[key]
+	if !ok {
+		return nil, dovecotsasl.ErrUserUnknown
+	}
+	return e, nil
+}
+
+// extra returns a copy of the extra fields, the entry itself is shared
+// between requests.
+func (e *Entry) extra() map[string]string {
+	if e.Extra == nil {
+		return nil
+	}
+	extra := make(map[string]string, len(e.Extra))
+	for k, v := range e.Extra {
+		extra[k] = v
+	}
+	return extra
+}
+
+func (db *DB) VerifyPlain(_ context.Context, req *dovecotsasl.AuthReq, user, pass string) (*dovecotsasl.PassdbResult, error) {
+	e, err := db.Lookup(req, user)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := e.Extra["nopassword"]; !ok {
+		if e.Password == "" {
+			return nil, dovecotsasl.ErrPasswordMismatch
+		}
+		if err := dovecotsasl.VerifyPassword(e.Password, db.DefaultScheme, pass); err != nil {
+			return nil, err
+		}
+	}
+	return &dovecotsasl.PassdbResult{
+		User:  e.User,
+		Extra: e.extra(),
+	}, nil
+}
+
+func (db *DB) LookupCredentials(_ context.Context, req *dovecotsasl.AuthReq, user, scheme string) (*dovecotsasl.PassdbResult, error) {
+	e, err := db.Lookup(req, user)
+	if err != nil {
+		return nil, err
+	}
+	if e.Password == "" {
+		return nil, dovecotsasl.ErrCredentialsUnavailable
+	}
+	creds, err := dovecotsasl.PasswordCredentials(e.Password, db.DefaultScheme, scheme)
+	if err != nil {
+		return nil, err
+	}
+	return &dovecotsasl.PassdbResult{
+		User:        e.User,
+		Credentials: creds,
+		Extra:       e.extra(),
+	}, nil
+}
+
+// LookupUser returns userdb fields for the user: uid, gid, home and extra
+// fields with "userdb_" prefix (without the prefix).
+func (db *DB) LookupUser(_ context.Context, req *dovecotsasl.AuthReq, user string) (map[string]string, error) {
+	e, err := db.Lookup(req, user)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string)
+	if e.UID != "" {
+		fields["uid"] = e.UID
+	}
+	if e.GID != "" {
+		fields["gid"] = e.GID
+	}
+	if e.Home != "" {
+		fields["home"] = e.Home
+	}
+	for k, v := range e.Extra {
+		if strings.HasPrefix(k, "userdb_") {
+			fields[strings.TrimPrefix(k, "userdb_")] = v
+		}
+	}
+	return fields, nil
+}
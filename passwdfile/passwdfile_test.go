@@ -0,0 +1,114 @@
+package passwdfile
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+)
+
+func writeFile(t *testing.T, path, contents string, mtime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswdFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passwdfile-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	writeFile(t, filepath.Join(dir, "example.org", "passwd"),
+		"# comment\n"+
+			"foxcpp@example.org:{PLAIN}1234:1000:1000::/home/foxcpp::userdb_mail=maildir:~/Mail quota=1G\n"+
+			"nopass@example.org::::::\n"+
+			"truncated@example.org:{SSHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"+
+			"hashed@example.org:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1\n",
+		now)
+
+	db := New(filepath.Join(dir, "%d", "passwd"))
+	ctx := context.Background()
+
+	res, err := db.VerifyPlain(ctx, nil, "foxcpp@example.org", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Extra["quota"] != "1G" {
+		t.Errorf("extra fields not parsed: %v", res.Extra)
+	}
+	// Malformed stored password is a mismatch, not a temporary failure.
+	if _, err := db.VerifyPlain(ctx, nil, "truncated@example.org", "password"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("expected password mismatch for truncated hash, got %v", err)
+	}
+	res.Extra["resp"] = "modified"
+	delete(res.Extra, "quota")
+	res, err = db.VerifyPlain(ctx, nil, "foxcpp@example.org", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.Extra["resp"]; ok || res.Extra["quota"] != "1G" {
+		t.Errorf("extra fields are shared between requests: %v", res.Extra)
+	}
+	if _, err := db.VerifyPlain(ctx, nil, "foxcpp@example.org", "5678"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("expected password mismatch, got %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, nil, "nopass@example.org", ""); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("expected password mismatch for empty password, got %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, nil, "hashed@example.org", "Hello world!"); err != nil {
+		t.Errorf("crypt hash without prefix is not verified: %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, nil, "foxcpp@example.com", "1234"); !errors.Is(err, dovecotsasl.ErrUserUnknown) {
+		t.Errorf("expected unknown user for missing domain file, got %v", err)
+	}
+
+	creds, err := db.LookupCredentials(ctx, nil, "foxcpp@example.org", "CRAM-MD5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds.Credentials) != 32 {
+		t.Errorf("unexpected CRAM-MD5 credentials length: %d", len(creds.Credentials))
+	}
+	if _, err := db.LookupCredentials(ctx, nil, "hashed@example.org", "CRAM-MD5"); !errors.Is(err, dovecotsasl.ErrSchemeNotAvailable) {
+		t.Errorf("expected scheme not available, got %v", err)
+	}
+
+	fields, err := db.LookupUser(ctx, nil, "foxcpp@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["uid"] != "1000" || fields["home"] != "/home/foxcpp" || fields["mail"] != "maildir:~/Mail" {
+		t.Errorf("unexpected userdb fields: %v", fields)
+	}
+
+	// Variables can not point outside of the configured directories.
+	writeFile(t, filepath.Join(dir, "evil"), "x@../evil:{PLAIN}1234\nx@..:{PLAIN}1234\n", now)
+	traversal := New(filepath.Join(dir, "example.org", "%d"))
+	for _, user := range []string{"x@../evil", "x@.."} {
+		if _, err := traversal.VerifyPlain(ctx, nil, user, "1234"); !errors.Is(err, dovecotsasl.ErrUserUnknown) {
+			t.Errorf("%s: expected unknown user, got %v", user, err)
+		}
+	}
+
+	// Reload on change.
+	writeFile(t, filepath.Join(dir, "example.org", "passwd"),
+		"foxcpp@example.org:{PLAIN}5678\n", now.Add(time.Second))
+	if _, err := db.VerifyPlain(ctx, nil, "foxcpp@example.org", "5678"); err != nil {
+		t.Errorf("file is not reloaded: %v", err)
+	}
+}
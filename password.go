@@ -0,0 +1,52 @@
+package dovecotsasl
+
+import (
+	"errors"
+
+	"github.com/foxcpp/go-dovecot-sasl/pwscheme"
+)
+
+// VerifyPassword checks the plaintext password against the stored one (in
+// "{SCHEME}data" format, defaultScheme is used if there is no prefix).
+//
+// It is intended to be used by Passdb implementations, errors are
+// ErrPasswordMismatch or internal failures. Like in Dovecot, a stored
+// password that is not valid for its scheme (e.g. truncated) is a mismatch,
+// the error is included for logging.
+func VerifyPassword(stored, defaultScheme, pass string) error {
+	ok, err := pwscheme.Verify(stored, defaultScheme, pass)
+	if err != nil {
+		if errors.Is(err, pwscheme.ErrMalformed) {
+			return &PassdbError{
+				Status: PassdbPasswordMismatch,
+				Reason: "invalid password in passdb",
+				Err:    err,
+			}
+		}
+		return PassdbInternalError(err)
+	}
+	if !ok {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+// PasswordCredentials converts the stored password into credentials for
+// the specified scheme as needed by Passdb.LookupCredentials.
+//
+// ErrSchemeNotAvailable is returned if the conversion is not possible, with
+// UserFound set since the password is known.
+func PasswordCredentials(stored, defaultScheme, scheme string) ([]byte, error) {
+	creds, err := pwscheme.Credentials(stored, defaultScheme, scheme)
+	if err != nil {
+		if errors.Is(err, pwscheme.ErrNotConvertible) {
+			return nil, &PassdbError{
+				Status:    PassdbSchemeNotAvailable,
+				Reason:    "requested " + scheme + " scheme, but the stored password uses a different one",
+				UserFound: true,
+			}
+		}
+		return nil, PassdbInternalError(err)
+	}
+	return creds, nil
+}
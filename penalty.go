@@ -0,0 +1,180 @@
+package dovecotsasl
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Penalty tracks authentication failures by the client IP address and
+// computes delays for FAIL replies, similar to Dovecot's auth penalty.
+//
+// The delay doubles with each failure, starting at InitialDelay and up to
+// MaxDelay. Counters are reset by a successful authentication and expire
+// after Expire since the last failure. IPv6 addresses are aggregated by
+// the IPv6Prefix length since clients usually get a whole subnet.
+//
+// Zero or negative settings are replaced with defaults used by NewPenalty,
+// so the zero value is ready to use.
+type Penalty struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Expire       time.Duration
+	IPv6Prefix   int
+
+	now func() time.Time
+
+	lock      sync.Mutex
+	failures  map[string]*penaltyEntry
+	lastPrune time.Time
+}
+
+type penaltyEntry struct {
+	count int
+	last  time.Time
+}
+
+const (
+	defaultPenaltyInitialDelay = 2 * time.Second
+	defaultPenaltyMaxDelay     = 15 * time.Second
+	defaultPenaltyExpire       = time.Hour
+	defaultPenaltyIPv6Prefix   = 48
+)
+
+func NewPenalty() *Penalty {
+	return &Penalty{
+		InitialDelay: defaultPenaltyInitialDelay,
+		MaxDelay:     defaultPenaltyMaxDelay,
+		Expire:       defaultPenaltyExpire,
+		IPv6Prefix:   defaultPenaltyIPv6Prefix,
+	}
+}
+
+func (p *Penalty) clock() time.Time {
+	if p.now == nil {
+		return time.Now()
+	}
+	return p.now()
+}
+
+func (p *Penalty) expire() time.Duration {
+	if p.Expire <= 0 {
+		return defaultPenaltyExpire
+	}
+	return p.Expire
+}
+
+// key returns the counter key for the address.
+func (p *Penalty) key(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	prefix := p.IPv6Prefix
+	if prefix <= 0 || prefix > 128 {
+		prefix = defaultPenaltyIPv6Prefix
+	}
+	return ip.Mask(net.CIDRMask(prefix, 128)).String()
+}
+
+// prune removes expired counters. It is called with lock held.
+func (p *Penalty) prune(now time.Time) {
+	if now.Sub(p.lastPrune) < p.expire() {
+		return
+	}
+	p.lastPrune = now
+	for k, e := range p.failures {
+		if now.Sub(e.last) >= p.expire() {
+			delete(p.failures, k)
+		}
+	}
+}
+
+// Failure records the failed authentication from the address and returns
+// the delay to apply to the FAIL reply.
+func (p *Penalty) Failure(ip net.IP) time.Duration {
+	now := p.clock()
+	k := p.key(ip)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.failures == nil {
+		p.failures = make(map[string]*penaltyEntry)
+	}
+	p.prune(now)
+	e := p.failures[k]
+	if e == nil || now.Sub(e.last) >= p.expire() {
+		e = &penaltyEntry{}
+		p.failures[k] = e
+	}
+	e.count++
+	e.last = now
+	return p.delay(e.count)
+}
+
+// Success resets the failure counter for the address.
+func (p *Penalty) Success(ip net.IP) {
+	k := p.key(ip)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.failures, k)
+}
+
+// Delay returns the delay for the address based on the recorded failures,
+// without recording a new one.
+func (p *Penalty) Delay(ip net.IP) time.Duration {
+	now := p.clock()
+	k := p.key(ip)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	e := p.failures[k]
+	if e == nil || now.Sub(e.last) >= p.expire() {
+		return 0
+	}
+	return p.delay(e.count)
+}
+
+func (p *Penalty) delay(count int) time.Duration {
+	if count <= 0 {
+		return 0
+	}
+	d, max := p.InitialDelay, p.MaxDelay
+	if d <= 0 {
+		d = defaultPenaltyInitialDelay
+	}
+	if max <= 0 {
+		max = defaultPenaltyMaxDelay
+	}
+	for i := 1; i < count && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// penalize records the failed request and waits for the penalty delay.
+// Requests with no-penalty set or without the client address are not
+// delayed.
+func (s *Server) penalize(ctx context.Context, req *AuthReq, af AuthFail) {
+	if s.Penalty == nil || req.NoPenalty || req.RemoteIP == nil || af.Code == TempFail {
+		return
+	}
+	d := s.Penalty.Failure(req.RemoteIP)
+	if d <= 0 {
+		return
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
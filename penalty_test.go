@@ -0,0 +1,120 @@
+package dovecotsasl
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+func TestPenaltyDelay(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	p := NewPenalty()
+	p.now = func() time.Time { return now }
+
+	ip := net.IPv4(192, 0, 2, 1)
+	for i, expected := range []time.Duration{2, 4, 8, 15, 15} {
+		if d := p.Failure(ip); d != expected*time.Second {
+			t.Errorf("failure %d: expected %v delay, got %v", i+1, expected*time.Second, d)
+		}
+	}
+	if d := p.Delay(net.IPv4(192, 0, 2, 2)); d != 0 {
+		t.Errorf("other address is penalized: %v", d)
+	}
+
+	// IPv6 addresses in the same /48 share the counter.
+	p.Failure(net.ParseIP("2001:db8:1:2::1"))
+	if d := p.Delay(net.ParseIP("2001:db8:1:ffff::2")); d != 2*time.Second {
+		t.Errorf("IPv6 prefix is not aggregated: %v", d)
+	}
+	if d := p.Delay(net.ParseIP("2001:db8:2::1")); d != 0 {
+		t.Errorf("other IPv6 prefix is penalized: %v", d)
+	}
+
+	p.Success(ip)
+	if d := p.Delay(ip); d != 0 {
+		t.Errorf("counter is not reset by success: %v", d)
+	}
+
+	p.Failure(ip)
+	now = now.Add(time.Hour)
+	if d := p.Delay(ip); d != 0 {
+		t.Errorf("counter is not expired: %v", d)
+	}
+	if d := p.Failure(ip); d != 2*time.Second {
+		t.Errorf("expired counter is not restarted: %v", d)
+	}
+	if len(p.failures) != 1 {
+		t.Errorf("expired counters are not pruned: %d left", len(p.failures))
+	}
+}
+
+func TestPenaltyZeroValue(t *testing.T) {
+	var p Penalty
+	ip := net.IPv4(192, 0, 2, 1)
+	if d := p.Delay(ip); d != 0 {
+		t.Errorf("unexpected delay: %v", d)
+	}
+	if d := p.Failure(ip); d != defaultPenaltyInitialDelay {
+		t.Errorf("expected %v delay, got %v", defaultPenaltyInitialDelay, d)
+	}
+	if d := p.Failure(ip); d != 2*defaultPenaltyInitialDelay {
+		t.Errorf("counter is not increased: %v", d)
+	}
+	p.Success(ip)
+	if d := p.Delay(ip); d != 0 {
+		t.Errorf("counter is not reset by success: %v", d)
+	}
+}
+
+func TestPenaltyServer(t *testing.T) {
+	s := NewServer()
+	s.AddPassdbMechanisms(testPassdb{"foxcpp": "1234", "nouserdb": "1234"})
+	s.Userdb = testUserdb{"foxcpp": {"home": "/home/foxcpp"}}
+	s.Penalty = NewPenalty()
+	s.Penalty.InitialDelay = 100 * time.Millisecond
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rip := ParamRemoteIP(net.IPv4(192, 0, 2, 1))
+	start := time.Now()
+	if _, err := cl.Do("imap", sasl.NewPlainClient("", "foxcpp", "wrong"), rip); err == nil {
+		t.Fatal("wrong password is accepted")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("FAIL is not delayed: %v", elapsed)
+	}
+
+	start = time.Now()
+	if _, err := cl.Do("imap", sasl.NewPlainClient("", "foxcpp", "wrong"), rip, ParamNoPenalty); err == nil {
+		t.Fatal("wrong password is accepted")
+	}
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Errorf("no-penalty request is delayed: %v", elapsed)
+	}
+	if d := s.Penalty.Delay(net.IPv4(192, 0, 2, 1)); d != 100*time.Millisecond {
+		t.Errorf("no-penalty request changed the counter: %v", d)
+	}
+
+	if _, err := cl.Do("imap", sasl.NewPlainClient("", "nouserdb", "1234"), rip); err == nil {
+		t.Fatal("user missing in userdb is accepted")
+	}
+	if d := s.Penalty.Delay(net.IPv4(192, 0, 2, 1)); d != 100*time.Millisecond {
+		t.Errorf("counter is reset after userdb failure: %v", d)
+	}
+
+	if _, err := cl.Do("imap", sasl.NewPlainClient("", "foxcpp", "1234"), rip); err != nil {
+		t.Fatal(err)
+	}
+	if d := s.Penalty.Delay(net.IPv4(192, 0, 2, 1)); d != 0 {
+		t.Errorf("counter is not reset after success: %v", d)
+	}
+}
@@ -0,0 +1,76 @@
+package dovecotsasl
+
+import (
+	"net"
+	"strings"
+)
+
+// errPlaintextDisabled is reported if a plaintext mechanism is used over
+// an insecure connection while Server.DisablePlaintextAuth is set.
+var errPlaintextDisabled = AuthFail{Reason: "Plaintext authentication disabled"}
+
+// Secure reports whether the client connection is considered secure: it
+// is marked as secured, uses TLS or trusted transport, or originates from
+// the local host.
+func (r *AuthReq) Secure() bool {
+	if r.Secured {
+		return true
+	}
+	switch TransportValue(r.Transport) {
+	case TransportTLS, TransportTrusted:
+		return true
+	}
+	if r.RemoteIP != nil {
+		if r.RemoteIP.IsLoopback() || r.RemoteIP.Equal(r.LocalIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// plaintextAllowed reports whether plaintext mechanisms can be used for
+// the request.
+func (s *Server) plaintextAllowed(req *AuthReq) bool {
+	if !s.DisablePlaintextAuth || req.Secure() {
+		return true
+	}
+	for _, service := range s.PlaintextServices {
+		if strings.EqualFold(service, req.Service) {
+			return true
+		}
+	}
+	if req.RemoteIP != nil {
+		for _, n := range s.TrustedNetworks {
+			if n.Contains(req.RemoteIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParseNetworks parses networks in CIDR notation or single IP addresses,
+// e.g. for use in Server.TrustedNetworks.
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: v}
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
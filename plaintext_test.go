@@ -0,0 +1,62 @@
+package dovecotsasl
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+)
+
+func TestDisablePlaintextAuth(t *testing.T) {
+	s := NewServer()
+	s.AddPassdbMechanisms(testPassdb{"foxcpp": "1234"})
+	s.DisablePlaintextAuth = true
+	s.PlaintextServices = []string{"smtp"}
+	trusted, err := ParseNetworks([]string{"198.51.100.0/24", "203.0.113.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.TrustedNetworks = trusted
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insecure := ParamRemoteIP(net.IPv4(192, 0, 2, 1))
+	_, err = cl.Do("imap", sasl.NewPlainClient("", "foxcpp", "1234"), insecure)
+	var af AuthFail
+	if !errors.As(err, &af) || af.Reason != errPlaintextDisabled.Reason {
+		t.Errorf("expected plaintext authentication to be disabled, got %v", err)
+	}
+	if _, err := cl.Do("imap", sasl.NewLoginClient("foxcpp", "1234"), insecure); err == nil {
+		t.Error("LOGIN is accepted over insecure connection")
+	}
+
+	allowed := map[string][]Parameter{
+		"secured":         {insecure, ParamSecured(SecuredTLS)},
+		"tls transport":   {insecure, ParamTransport(TransportTLS)},
+		"localhost":       {ParamRemoteIP(net.IPv4(127, 0, 0, 1))},
+		"rip equals lip":  {insecure, ParamLocalIP(net.IPv4(192, 0, 2, 1))},
+		"trusted network": {ParamRemoteIP(net.IPv4(198, 51, 100, 7))},
+		"trusted address": {ParamRemoteIP(net.IPv4(203, 0, 113, 5))},
+	}
+	for name, params := range allowed {
+		if _, err := cl.Do("imap", sasl.NewPlainClient("", "foxcpp", "1234"), params...); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := cl.Do("smtp", sasl.NewPlainClient("", "foxcpp", "1234"), insecure); err != nil {
+		t.Errorf("exempted service: %v", err)
+	}
+
+	// Non-plaintext mechanisms are not affected.
+	if _, err := cl.Do("imap", newCRAMMD5Client("foxcpp", "1234"), insecure); err != nil {
+		t.Errorf("CRAM-MD5: %v", err)
+	}
+}
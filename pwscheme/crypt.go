@@ -0,0 +1,375 @@
+package pwscheme
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// cryptB64 appends n characters encoding the 24-bit value made of b2, b1
+// and b0, least significant 6 bits first.
+func cryptB64(out []byte, b2, b1, b0 byte, n int) []byte {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out = append(out, cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+	return out
+}
+
+func cryptSalt(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = cryptAlphabet[int(b[i])%len(cryptAlphabet)]
+	}
+	return string(b), nil
+}
+
+func cryptVerify(generate func(plain, setting string) (string, error)) func(string, []byte) (bool, error) {
+	return func(plain string, raw []byte) (bool, error) {
+		computed, err := generate(plain, string(raw))
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare([]byte(computed), raw) == 1, nil
+	}
+}
+
+// md5Crypt implements the FreeBSD MD5-based crypt ("$1$").
+func md5Crypt(plain, setting string) (string, error) {
+	const magic = "$1$"
+	if !strings.HasPrefix(setting, magic) {
+		return "", ErrMalformed
+	}
+	salt := setting[len(magic):]
+	if idx := strings.IndexByte(salt, '$'); idx != -1 {
+		salt = salt[:idx]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(plain)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	for n := len(pw); n > 0; n -= md5.Size {
+		if n > md5.Size {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:n])
+		}
+	}
+	for n := len(pw); n != 0; n >>= 1 {
+		if n&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 != 0 {
+			c.Write(pw)
+		} else {
+			c.Write(final)
+		}
+		if i%3 != 0 {
+			c.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			c.Write(pw)
+		}
+		if i&1 != 0 {
+			c.Write(final)
+		} else {
+			c.Write(pw)
+		}
+		final = c.Sum(nil)
+	}
+
+	out := make([]byte, 0, len(magic)+len(salt)+1+22)
+	out = append(out, magic...)
+	out = append(out, salt...)
+	out = append(out, '$')
+	out = cryptB64(out, final[0], final[6], final[12], 4)
+	out = cryptB64(out, final[1], final[7], final[13], 4)
+	out = cryptB64(out, final[2], final[8], final[14], 4)
+	out = cryptB64(out, final[3], final[9], final[15], 4)
+	out = cryptB64(out, final[4], final[10], final[5], 4)
+	out = cryptB64(out, 0, 0, final[11], 2)
+	return string(out), nil
+}
+
+const (
+	shaCryptRoundsDefault = 5000
+	shaCryptRoundsMin     = 1000
+	shaCryptRoundsMax     = 999999999
+)
+
+// Byte order of SHA-256 and SHA-512 crypt output, in groups of 3.
+var (
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+// shaCrypt implements Ulrich Drepper's SHA-crypt ("$5$" and "$6$").
+func shaCrypt(h func() hash.Hash, magic string, plain, setting string) (string, error) {
+	if !strings.HasPrefix(setting, magic) {
+		return "", ErrMalformed
+	}
+	rest := setting[len(magic):]
+
+	rounds := shaCryptRoundsDefault
+	customRounds := false
+	if strings.HasPrefix(rest, "rounds=") {
+		idx := strings.IndexByte(rest, '$')
+		if idx == -1 {
+			return "", ErrMalformed
+		}
+		val, err := strconv.Atoi(rest[len("rounds="):idx])
+		if err != nil {
+			return "", ErrMalformed
+		}
+		rounds = val
+		if rounds < shaCryptRoundsMin {
+			rounds = shaCryptRoundsMin
+		}
+		if rounds > shaCryptRoundsMax {
+			rounds = shaCryptRoundsMax
+		}
+		customRounds = true
+		rest = rest[idx+1:]
+	}
+	salt := rest
+	if idx := strings.IndexByte(salt, '$'); idx != -1 {
+		salt = salt[:idx]
+	}
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+
+	key := []byte(plain)
+	saltB := []byte(salt)
+	size := h().Size()
+
+	b := h()
+	b.Write(key)
+	b.Write(saltB)
+	b.Write(key)
+	bSum := b.Sum(nil)
+
+	a := h()
+	a.Write(key)
+	a.Write(saltB)
+	for n := len(key); n > 0; n -= size {
+		if n > size {
+			a.Write(bSum)
+		} else {
+			a.Write(bSum[:n])
+		}
+	}
+	for n := len(key); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(bSum)
+		} else {
+			a.Write(key)
+		}
+	}
+	aSum := a.Sum(nil)
+
+	dp := h()
+	for range key {
+		dp.Write(key)
+	}
+	p := repeatTo(dp.Sum(nil), len(key))
+
+	ds := h()
+	for i := 0; i < 16+int(aSum[0]); i++ {
+		ds.Write(saltB)
+	}
+	s := repeatTo(ds.Sum(nil), len(saltB))
+
+	c := aSum
+	for i := 0; i < rounds; i++ {
+		ctx := h()
+		if i&1 != 0 {
+			ctx.Write(p)
+		} else {
+			ctx.Write(c)
+		}
+		if i%3 != 0 {
+			ctx.Write(s)
+		}
+		if i%7 != 0 {
+			ctx.Write(p)
+		}
+		if i&1 != 0 {
+			ctx.Write(c)
+		} else {
+			ctx.Write(p)
+		}
+		c = ctx.Sum(nil)
+	}
+
+	out := []byte(magic)
+	if customRounds {
+		out = append(out, "rounds="+strconv.Itoa(rounds)+"$"...)
+	}
+	out = append(out, salt...)
+	out = append(out, '$')
+	if size == sha256.Size {
+		for _, g := range sha256CryptOrder {
+			out = cryptB64(out, c[g[0]], c[g[1]], c[g[2]], 4)
+		}
+		out = cryptB64(out, 0, c[31], c[30], 3)
+	} else {
+		for _, g := range sha512CryptOrder {
+			out = cryptB64(out, c[g[0]], c[g[1]], c[g[2]], 4)
+		}
+		out = cryptB64(out, 0, 0, c[63], 2)
+	}
+	return string(out), nil
+}
+
+func repeatTo(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		if n-len(out) >= len(b) {
+			out = append(out, b...)
+		} else {
+			out = append(out, b[:n-len(out)]...)
+		}
+	}
+	return out
+}
+
+func shaCryptScheme(h func() hash.Hash, magic string) *Scheme {
+	generate := func(plain, setting string) (string, error) {
+		return shaCrypt(h, magic, plain, setting)
+	}
+	return &Scheme{
+		Encoding: EncodingNone,
+		Generate: func(plain string, rounds int) ([]byte, error) {
+			salt, err := cryptSalt(16)
+			if err != nil {
+				return nil, err
+			}
+			setting := magic + salt
+			if rounds != 0 {
+				setting = fmt.Sprintf("%srounds=%d$%s", magic, rounds, salt)
+			}
+			out, err := generate(plain, setting)
+			return []byte(out), err
+		},
+		Verify: cryptVerify(generate),
+	}
+}
+
+var md5CryptScheme = &Scheme{
+	Encoding: EncodingNone,
+	Generate: func(plain string, _ int) ([]byte, error) {
+		salt, err := cryptSalt(8)
+		if err != nil {
+			return nil, err
+		}
+		out, err := md5Crypt(plain, "$1$"+salt)
+		return []byte(out), err
+	},
+	Verify: cryptVerify(md5Crypt),
+}
+
+var blfCryptScheme = &Scheme{
+	Encoding: EncodingNone,
+	Generate: func(plain string, rounds int) ([]byte, error) {
+		if rounds == 0 {
+			rounds = 5
+		}
+		out, err := bcrypt.GenerateFromPassword([]byte(plain), rounds)
+		if err != nil {
+			return nil, err
+		}
+		// Dovecot uses $2y$ prefix, the algorithm is the same.
+		if len(out) > 4 && string(out[:4]) == "$2a$" {
+			out[2] = 'y'
+		}
+		return out, nil
+	},
+	Verify: func(plain string, raw []byte) (bool, error) {
+		err := bcrypt.CompareHashAndPassword(raw, []byte(plain))
+		switch err {
+		case nil:
+			return true, nil
+		case bcrypt.ErrMismatchedHashAndPassword:
+			return false, nil
+		}
+		return false, fmt.Errorf("%w: %v", ErrMalformed, err)
+	},
+}
+
+// cryptScheme dispatches to the crypt implementation based on the hash
+// prefix, like crypt(3). Traditional DES crypt is not supported. New
+// passwords are generated using SHA512-CRYPT.
+var cryptScheme = &Scheme{
+	Encoding: EncodingNone,
+	Generate: func(plain string, rounds int) ([]byte, error) {
+		return sha512CryptScheme.Generate(plain, rounds)
+	},
+	Verify: func(plain string, raw []byte) (bool, error) {
+		switch {
+		case strings.HasPrefix(string(raw), "$1$"):
+			return md5CryptScheme.Verify(plain, raw)
+		case strings.HasPrefix(string(raw), "$5$"):
+			return sha256CryptScheme.Verify(plain, raw)
+		case strings.HasPrefix(string(raw), "$6$"):
+			return sha512CryptScheme.Verify(plain, raw)
+		case strings.HasPrefix(string(raw), "$2"):
+			return blfCryptScheme.Verify(plain, raw)
+		}
+		return false, fmt.Errorf("%w: unsupported crypt hash", ErrMalformed)
+	},
+}
+
+var (
+	sha256CryptScheme = shaCryptScheme(sha256.New, "$5$")
+	sha512CryptScheme = shaCryptScheme(sha512.New, "$6$")
+)
+
+func init() {
+	Register(cryptScheme, "CRYPT")
+	Register(md5CryptScheme, "MD5-CRYPT", "MD5")
+	Register(sha256CryptScheme, "SHA256-CRYPT")
+	Register(sha512CryptScheme, "SHA512-CRYPT")
+	Register(blfCryptScheme, "BLF-CRYPT")
+}
@@ -0,0 +1,84 @@
+package pwscheme
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+)
+
+// saltLen is the length of salt used by salted hash schemes, same as
+// Dovecot's.
+const saltLen = 4
+
+var plainScheme = &Scheme{
+	Encoding: EncodingNone,
+	Generate: func(plain string, _ int) ([]byte, error) {
+		return []byte(plain), nil
+	},
+	Verify: func(plain string, raw []byte) (bool, error) {
+		return subtle.ConstantTimeCompare([]byte(plain), raw) == 1, nil
+	},
+}
+
+func hashScheme(h func() hash.Hash, enc Encoding) *Scheme {
+	return &Scheme{
+		Encoding: enc,
+		Generate: func(plain string, _ int) ([]byte, error) {
+			hasher := h()
+			hasher.Write([]byte(plain))
+			return hasher.Sum(nil), nil
+		},
+		Verify: func(plain string, raw []byte) (bool, error) {
+			hasher := h()
+			hasher.Write([]byte(plain))
+			return subtle.ConstantTimeCompare(hasher.Sum(nil), raw) == 1, nil
+		},
+	}
+}
+
+// saltedDigest computes hash(plain || salt) || salt.
+func saltedDigest(h func() hash.Hash, plain string, salt []byte) []byte {
+	hasher := h()
+	hasher.Write([]byte(plain))
+	hasher.Write(salt)
+	return append(hasher.Sum(nil), salt...)
+}
+
+func saltedHashScheme(h func() hash.Hash) *Scheme {
+	size := h().Size()
+	return &Scheme{
+		Encoding: EncodingBase64,
+		Generate: func(plain string, _ int) ([]byte, error) {
+			salt := make([]byte, saltLen)
+			if _, err := rand.Read(salt); err != nil {
+				return nil, err
+			}
+			return saltedDigest(h, plain, salt), nil
+		},
+		Verify: func(plain string, raw []byte) (bool, error) {
+			if len(raw) <= size {
+				return false, fmt.Errorf("%w: salted hash is too short", ErrMalformed)
+			}
+			expected := saltedDigest(h, plain, raw[size:])
+			return subtle.ConstantTimeCompare(expected, raw) == 1, nil
+		},
+	}
+}
+
+func init() {
+	Register(plainScheme, "PLAIN", "CLEAR", "CLEARTEXT")
+	Register(hashScheme(sha1.New, EncodingBase64), "SHA", "SHA1")
+	Register(hashScheme(sha256.New, EncodingBase64), "SHA256")
+	Register(hashScheme(sha512.New, EncodingBase64), "SHA512")
+	Register(hashScheme(md5.New, EncodingHex), "PLAIN-MD5")
+	Register(hashScheme(md5.New, EncodingBase64), "LDAP-MD5")
+	Register(saltedHashScheme(sha1.New), "SSHA")
+	Register(saltedHashScheme(sha256.New), "SSHA256")
+	Register(saltedHashScheme(sha512.New), "SSHA512")
+	Register(saltedHashScheme(md5.New), "SMD5")
+}
@@ -0,0 +1,125 @@
+package pwscheme
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Argon2 parameters used by Dovecot: libsodium's "interactive" limits,
+// which differ between Argon2i and Argon2id.
+const (
+	argon2iTime    = 4
+	argon2iMemory  = 32 * 1024
+	argon2idTime   = 2
+	argon2idMemory = 64 * 1024
+	argon2Threads  = 1
+	argon2SaltLen  = 16
+	argon2KeyLen   = 32
+)
+
+type argon2Func func(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte
+
+// argon2Scheme implements Argon2 schemes using the PHC string format:
+// $argon2id$v=19$m=65536,t=2,p=1$salt$hash. defTime and memory (in KiB) are
+// used for generated passwords.
+func argon2Scheme(variant string, f argon2Func, defTime, memory uint32) *Scheme {
+	prefix := "$" + variant + "$"
+	return &Scheme{
+		Encoding: EncodingNone,
+		Generate: func(plain string, rounds int) ([]byte, error) {
+			if rounds == 0 {
+				rounds = int(defTime)
+			}
+			salt := make([]byte, argon2SaltLen)
+			if _, err := rand.Read(salt); err != nil {
+				return nil, err
+			}
+			key := f([]byte(plain), salt, uint32(rounds), memory, argon2Threads, argon2KeyLen)
+			return []byte(fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", prefix, argon2.Version,
+				memory, rounds, argon2Threads,
+				base64.RawStdEncoding.EncodeToString(salt),
+				base64.RawStdEncoding.EncodeToString(key))), nil
+		},
+		Verify: func(plain string, raw []byte) (bool, error) {
+			parts := strings.Split(string(raw), "$")
+			if len(parts) != 6 || parts[0] != "" || "$"+parts[1]+"$" != prefix {
+				return false, ErrMalformed
+			}
+			if parts[2] != "v="+strconv.Itoa(argon2.Version) {
+				return false, fmt.Errorf("%w: unsupported Argon2 version: %v", ErrMalformed, parts[2])
+			}
+			var memory, time uint32
+			var threads uint8
+			if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+				return false, fmt.Errorf("%w: %v", ErrMalformed, err)
+			}
+			salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+			if err != nil {
+				return false, fmt.Errorf("%w: %v", ErrMalformed, err)
+			}
+			key, err := base64.RawStdEncoding.DecodeString(parts[5])
+			if err != nil {
+				return false, fmt.Errorf("%w: %v", ErrMalformed, err)
+			}
+			if time == 0 || threads == 0 || len(key) == 0 {
+				return false, ErrMalformed
+			}
+			computed := f([]byte(plain), salt, time, memory, threads, uint32(len(key)))
+			return subtle.ConstantTimeCompare(computed, key) == 1, nil
+		},
+	}
+}
+
+// PBKDF2 parameters used by Dovecot.
+const (
+	pbkdf2RoundsDefault = 5000
+	pbkdf2SaltLen       = 16
+	pbkdf2KeyLen        = sha1.Size
+)
+
+func pbkdf2Key(plain, salt string, rounds int) string {
+	return hex.EncodeToString(pbkdf2.Key([]byte(plain), []byte(salt), rounds, pbkdf2KeyLen, sha1.New))
+}
+
+// pbkdf2Scheme implements Dovecot's PBKDF2 scheme: $1$salt$rounds$hexkey
+// using HMAC-SHA1. Salt is used as is, without decoding.
+var pbkdf2Scheme = &Scheme{
+	Encoding: EncodingNone,
+	Generate: func(plain string, rounds int) ([]byte, error) {
+		if rounds == 0 {
+			rounds = pbkdf2RoundsDefault
+		}
+		salt, err := cryptSalt(pbkdf2SaltLen)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(fmt.Sprintf("$1$%s$%d$%s", salt, rounds, pbkdf2Key(plain, salt, rounds))), nil
+	},
+	Verify: func(plain string, raw []byte) (bool, error) {
+		parts := strings.Split(strings.TrimPrefix(string(raw), "$"), "$")
+		if len(parts) != 4 || parts[0] != "1" {
+			return false, ErrMalformed
+		}
+		rounds, err := strconv.Atoi(parts[2])
+		if err != nil || rounds <= 0 {
+			return false, ErrMalformed
+		}
+		computed := pbkdf2Key(plain, parts[1], rounds)
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(strings.ToLower(parts[3]))) == 1, nil
+	},
+}
+
+func init() {
+	Register(argon2Scheme("argon2id", argon2.IDKey, argon2idTime, argon2idMemory), "ARGON2ID")
+	Register(argon2Scheme("argon2i", argon2.Key, argon2iTime, argon2iMemory), "ARGON2I")
+	Register(pbkdf2Scheme, "PBKDF2")
+}
@@ -0,0 +1,213 @@
+// Package pwscheme implements Dovecot password schemes.
+//
+// Stored passwords use the "{SCHEME}data" format, the encoding of data
+// can be overridden using ".HEX" or ".B64" suffix of the scheme name,
+// e.g. "{SHA256.HEX}". See
+// https://doc.dovecot.org/configuration_manual/authentication/password_schemes/
+// for details.
+package pwscheme
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Encoding is the encoding of the raw password in the stored string.
+type Encoding int
+
+const (
+	// EncodingNone is used by schemes whose raw password is already
+	// a string (crypt-style schemes).
+	EncodingNone Encoding = iota
+	EncodingBase64
+	EncodingHex
+)
+
+func (e Encoding) encode(raw []byte) string {
+	switch e {
+	case EncodingBase64:
+		return base64.StdEncoding.EncodeToString(raw)
+	case EncodingHex:
+		return hex.EncodeToString(raw)
+	}
+	return string(raw)
+}
+
+func (e Encoding) decode(encoded string) ([]byte, error) {
+	switch e {
+	case EncodingBase64:
+		return base64.StdEncoding.DecodeString(encoded)
+	case EncodingHex:
+		return hex.DecodeString(encoded)
+	}
+	return []byte(encoded), nil
+}
+
+// Scheme is the password scheme implementation.
+type Scheme struct {
+	// Default encoding of the raw password.
+	Encoding Encoding
+
+	// Generate computes the raw password for the plaintext one. rounds is
+	// the scheme-specific cost, 0 means the default.
+	Generate func(plain string, rounds int) ([]byte, error)
+
+	// Verify reports whether plain matches the raw password.
+	Verify func(plain string, raw []byte) (bool, error)
+}
+
+var (
+	ErrUnknownScheme  = errors.New("pwscheme: unknown password scheme")
+	ErrNotConvertible = errors.New("pwscheme: password can not be converted into the requested scheme")
+	ErrMalformed      = errors.New("pwscheme: malformed password")
+)
+
+var (
+	registry     = map[string]*Scheme{}
+	registryLock sync.RWMutex
+)
+
+// Register adds the scheme to the registry. All names refer to the same
+// scheme, the first one is the canonical name.
+func Register(s *Scheme, names ...string) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	for _, name := range names {
+		registry[strings.ToUpper(name)] = s
+	}
+}
+
+// Lookup returns the scheme with the specified name (case-insensitive).
+func Lookup(name string) (*Scheme, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	s, ok := registry[strings.ToUpper(name)]
+	return s, ok
+}
+
+// Names returns the sorted list of names of all registered schemes.
+func Names() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// splitName splits the scheme name with optional encoding suffix.
+func splitName(name string) (string, *Encoding, error) {
+	name = strings.ToUpper(name)
+	idx := strings.LastIndexByte(name, '.')
+	if idx == -1 {
+		return name, nil, nil
+	}
+	var enc Encoding
+	switch name[idx+1:] {
+	case "HEX":
+		enc = EncodingHex
+	case "B64", "BASE64":
+		enc = EncodingBase64
+	default:
+		return "", nil, fmt.Errorf("pwscheme: unknown encoding: %v", name[idx+1:])
+	}
+	return name[:idx], &enc, nil
+}
+
+// Split splits the stored password into the scheme name (possibly with
+// encoding suffix) and the encoded data. defaultScheme is used if the
+// password has no "{SCHEME}" prefix.
+func Split(stored, defaultScheme string) (string, string) {
+	if strings.HasPrefix(stored, "{") {
+		if end := strings.IndexByte(stored, '}'); end != -1 {
+			return strings.ToUpper(stored[1:end]), stored[end+1:]
+		}
+	}
+	return strings.ToUpper(defaultScheme), stored
+}
+
+// Parse splits the stored password and decodes it, returning the scheme
+// and the raw password.
+func Parse(stored, defaultScheme string) (*Scheme, []byte, error) {
+	fullName, data := Split(stored, defaultScheme)
+	name, enc, err := splitName(fullName)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, ok := Lookup(name)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %v", ErrUnknownScheme, name)
+	}
+	if enc == nil {
+		enc = &s.Encoding
+	}
+	raw, err := enc.decode(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return s, raw, nil
+}
+
+// Verify reports whether plain matches the stored password.
+func Verify(stored, defaultScheme, plain string) (bool, error) {
+	s, raw, err := Parse(stored, defaultScheme)
+	if err != nil {
+		return false, err
+	}
+	return s.Verify(plain, raw)
+}
+
+// Generate returns the stored password in "{SCHEME}data" format.
+func Generate(scheme, plain string) (string, error) {
+	return GenerateRounds(scheme, plain, 0)
+}
+
+// GenerateRounds is similar to Generate but allows to change the
+// scheme-specific cost (rounds or iterations count).
+func GenerateRounds(scheme, plain string, rounds int) (string, error) {
+	name, enc, err := splitName(scheme)
+	if err != nil {
+		return "", err
+	}
+	s, ok := Lookup(name)
+	if !ok {
+		return "", fmt.Errorf("%w: %v", ErrUnknownScheme, name)
+	}
+	if enc == nil {
+		enc = &s.Encoding
+	}
+	raw, err := s.Generate(plain, rounds)
+	if err != nil {
+		return "", err
+	}
+	return "{" + strings.ToUpper(scheme) + "}" + enc.encode(raw), nil
+}
+
+// Credentials returns the raw password in the requested scheme.
+//
+// It is possible only if the stored password uses the same scheme or is in
+// plaintext, ErrNotConvertible is returned otherwise.
+func Credentials(stored, defaultScheme, scheme string) ([]byte, error) {
+	want, ok := Lookup(scheme)
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownScheme, scheme)
+	}
+	have, raw, err := Parse(stored, defaultScheme)
+	if err != nil {
+		return nil, err
+	}
+	if have == want {
+		return raw, nil
+	}
+	if have == plainScheme {
+		return want.Generate(string(raw), 0)
+	}
+	return nil, ErrNotConvertible
+}
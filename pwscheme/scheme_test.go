@@ -0,0 +1,142 @@
+package pwscheme
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestKnownHashes(t *testing.T) {
+	cases := []struct {
+		stored string
+		plain  string
+	}{
+		{"{PLAIN}password", "password"},
+		{"{PLAIN-MD5}5f4dcc3b5aa765d61d8327deb882cf99", "password"},
+		{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password"},
+		{"{SHA.HEX}5baa61e4c9b93f3f0682250b6cf8331b7ee68fd8", "password"},
+		{"{MD5-CRYPT}$1$saltstri$qQY4WxjABChYG1ccLpfkz/", "password"},
+		{"{SHA256-CRYPT}$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"},
+		{"{SHA512-CRYPT}$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+		{"{SHA256-CRYPT}$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!"},
+		// OpenBSD bcrypt test vectors, Dovecot generates $2y$.
+		{"{BLF-CRYPT}$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+		{"{BLF-CRYPT}$2y$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+		// Argon2 reference implementation and argon2-cffi examples.
+		{"{ARGON2I}$argon2i$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG", "password"},
+		{"{ARGON2ID}$argon2id$v=19$m=65536,t=3,p=4$MIIRqgvgQbgj220jfp0MPA$YfwJSVjtjSU0zzV/P3S9nnQ/USre2wvJMjfCIjrTQbg", "correct horse battery staple"},
+		// HMAC-SHA1 PBKDF2 with the salt used as is.
+		{"{PBKDF2}$1$saltsaltsaltsalt$5000$ec9e17f215c97baf5813e7e2e78c201578e2a6aa", "password"},
+		{"{PBKDF2}$1$xR8nS0dCq1kG2pLz$10000$A0CD66B251C8D0CD2F9D4FCA7BB5E3A8BCD7831E", "Hello world!"},
+		// hash(password || salt) || salt with salt 0x12345678.
+		{"{SSHA}eyDMtQQRFLR/tqtSmiwJH5UWx7kSNFZ4", "password"},
+		{"{SSHA256}wOka13e2qLbqF4d8G/hRUW9m4U88gI/0rIv6LwFNjeYSNFZ4", "password"},
+		{"{SSHA512}XRYd2aVnoE3LIjOU3HLvfV7lPl0Zs77tCcqhTecXs4CpU763eMdhGtJnprE7rL7wFKExkOA2U4Q40b1Eh9RjBxI0Vng=", "password"},
+		{"{SMD5}j2a8VOxfmYj2Yst1KE6qThI0Vng=", "password"},
+		// Not normalized, Dovecot uses the password bytes as is.
+		{"{SCRAM-SHA-256}4096,c2FsdHNhbHRzYWx0c2FsdA==,pL7xoSv9X5Fr8hB9GmiwJv3Wp5vddfLrXMf7hGkUuDQ=,GRcNvceJA0QufaQllZe6/WFXKNH/eh8R1W/TNPD/dZI=", "pa\u0308sswo\u0308rd"},
+	}
+	for _, c := range cases {
+		ok, err := Verify(c.stored, "", c.plain)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.stored, err)
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: password %q does not match", c.stored, c.plain)
+		}
+		ok, err = Verify(c.stored, "", c.plain+"x")
+		if err != nil || ok {
+			t.Errorf("%s: wrong password matches (err=%v)", c.stored, err)
+		}
+	}
+
+	// Passwords are not prepared (SASLprep) before hashing.
+	ok, err := Verify("{SCRAM-SHA-256}4096,c2FsdHNhbHRzYWx0c2FsdA==,pL7xoSv9X5Fr8hB9GmiwJv3Wp5vddfLrXMf7hGkUuDQ=,GRcNvceJA0QufaQllZe6/WFXKNH/eh8R1W/TNPD/dZI=", "", "p\u00e4ssw\u00f6rd")
+	if err != nil || ok {
+		t.Errorf("normalized password matches (err=%v)", err)
+	}
+}
+
+func TestArgon2Defaults(t *testing.T) {
+	for scheme, params := range map[string]string{
+		"ARGON2I":  "$argon2i$v=19$m=32768,t=4,p=1$",
+		"ARGON2ID": "$argon2id$v=19$m=65536,t=2,p=1$",
+	} {
+		stored, err := Generate(scheme, "hunter2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(stored, "{"+scheme+"}"+params) {
+			t.Errorf("%s: unexpected parameters: %s", scheme, stored)
+		}
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	for _, stored := range []string{
+		"{SSHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"{SSHA256}c2hvcnQ=",
+		"{PBKDF2}$1$salt$x$00",
+		"{ARGON2ID}$argon2id$v=19$m=65536",
+	} {
+		if _, err := Verify(stored, "", "password"); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: expected ErrMalformed, got %v", stored, err)
+		}
+	}
+}
+
+func TestGenerateVerify(t *testing.T) {
+	for _, scheme := range []string{
+		"PLAIN", "SHA", "SHA256", "SHA512", "PLAIN-MD5", "SSHA", "SSHA256", "SSHA512",
+		"MD5-CRYPT", "SHA256-CRYPT", "SHA512-CRYPT", "BLF-CRYPT", "ARGON2I", "ARGON2ID",
+		"PBKDF2", "CRAM-MD5", "SCRAM-SHA-1", "SCRAM-SHA-256", "SSHA512.HEX",
+	} {
+		stored, err := Generate(scheme, "hunter2")
+		if err != nil {
+			t.Errorf("%s: %v", scheme, err)
+			continue
+		}
+		ok, err := Verify(stored, "", "hunter2")
+		if err != nil || !ok {
+			t.Errorf("%s: generated password %q does not verify (err=%v)", scheme, stored, err)
+		}
+		ok, err = Verify(stored, "", "hunter3")
+		if err != nil || ok {
+			t.Errorf("%s: wrong password matches %q (err=%v)", scheme, stored, err)
+		}
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	creds, err := Credentials("{PLAIN}1234", "", "CRAM-MD5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 32 {
+		t.Errorf("unexpected CRAM-MD5 credentials length: %d", len(creds))
+	}
+
+	stored, err := Generate("CRAM-MD5", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromStored, err := Credentials(stored, "", "HMAC-MD5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fromStored) != string(creds) {
+		t.Errorf("credentials from stored hash do not match the computed ones")
+	}
+
+	_, err = Credentials("{SSHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "", "CRAM-MD5")
+	if !errors.Is(err, ErrNotConvertible) {
+		t.Errorf("expected ErrNotConvertible, got %v", err)
+	}
+
+	// Default scheme.
+	ok, err := Verify("1234", "PLAIN", "1234")
+	if err != nil || !ok {
+		t.Errorf("password without prefix is not verified using the default scheme (err=%v)", err)
+	}
+}
@@ -0,0 +1,73 @@
+package redisdb
+
+import (
+	"context"
+)
+
+// pool is a bounded pool of connections to a single server.
+type pool struct {
+	addr string
+	dial func(ctx context.Context, addr string) (*conn, error)
+	idle chan *conn
+	sem  chan struct{}
+}
+
+func newPool(addr string, size int, dial func(ctx context.Context, addr string) (*conn, error)) *pool {
+	if size <= 0 {
+		size = 1
+	}
+	return &pool{
+		addr: addr,
+		dial: dial,
+		idle: make(chan *conn, size),
+		sem:  make(chan struct{}, size),
+	}
+}
+
+// get returns an idle connection or dials a new one, blocking if the limit
+// is reached.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case c := <-p.idle:
+		return c, nil
+	default:
+	}
+
+	c, err := p.dial(ctx, p.addr)
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+	return c, nil
+}
+
+// put returns the connection to the pool. Broken connections are closed.
+func (p *pool) put(c *conn) {
+	defer func() { <-p.sem }()
+	if c.broken {
+		c.Close()
+		return
+	}
+	select {
+	case p.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+func (p *pool) close() {
+	for {
+		select {
+		case c := <-p.idle:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
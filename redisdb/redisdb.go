@@ -0,0 +1,312 @@
+// Package redisdb implements passdb and userdb backend on top of Redis.
+//
+// Keys are built from templates using Dovecot variables (%u, %n, %d,
+// %{rip}, ...). A key can hold either a hash, in which case its fields
+// are used directly, or a string. String values are parsed as a JSON
+// object (the format used by Dovecot's dict passdb); any other string is
+// taken as the password.
+//
+// Fields are mapped as follows:
+//   - password: stored password, "{SCHEME}" prefix is recognized;
+//   - user: canonical username;
+//   - everything else: extra fields (userdb fields for user key).
+//
+// Lookups are sent to read replicas if any are configured, the primary
+// server is used if all replicas are unreachable.
+package redisdb
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	"github.com/foxcpp/go-dovecot-sasl/expand"
+)
+
+// DB is the Redis backend. It implements dovecotsasl.Passdb.
+type DB struct {
+	// Primary server address (host:port).
+	Addr string
+
+	// Read replica addresses (host:port).
+	Replicas []string
+
+	// Credentials for the AUTH command. Username is used only with Redis 6
+	// ACLs, AUTH is not sent if Password is empty.
+	Username string
+	Password string
+
+	// Database number selected using the SELECT command.
+	Database int
+
+	// Connect using TLS if not nil.
+	TLSConfig *tls.Config
+
+	// Key template for passdb lookups, e.g. "passdb/%u".
+	PassKey string
+
+	// Key template for userdb lookups, e.g. "userdb/%u".
+	UserKey string
+
+	// Scheme to use for passwords without {SCHEME} prefix.
+	DefaultScheme string
+
+	// Maximum number of connections per server.
+	PoolSize int
+
+	// Timeout for connection establishment and requests.
+	Timeout time.Duration
+
+	initOnce sync.Once
+	primary  *pool
+	replicas []*pool
+	next     uint32
+}
+
+func New(addr string) *DB {
+	return &DB{
+		Addr:          addr,
+		PassKey:       "passdb/%u",
+		UserKey:       "userdb/%u",
+		DefaultScheme: "PLAIN",
+		PoolSize:      8,
+		Timeout:       10 * time.Second,
+	}
+}
+
+// init creates connection pools. Configuration fields should not be changed
+// after the first lookup.
+func (db *DB) init() {
+	db.primary = newPool(db.Addr, db.PoolSize, db.dial)
+	db.replicas = make([]*pool, len(db.Replicas))
+	for i, addr := range db.Replicas {
+		db.replicas[i] = newPool(addr, db.PoolSize, db.dial)
+	}
+}
+
+func (db *DB) dial(ctx context.Context, addr string) (*conn, error) {
+	dialer := &net.Dialer{Timeout: db.Timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if db.TLSConfig != nil {
+		tlsConn := tls.Client(netConn, db.TLSConfig)
+		if db.Timeout != 0 {
+			tlsConn.SetDeadline(time.Now().Add(db.Timeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		netConn = tlsConn
+	}
+
+	c := newConn(netConn, db.Timeout)
+	if db.Password != "" {
+		args := []string{"AUTH", db.Password}
+		if db.Username != "" {
+			args = []string{"AUTH", db.Username, db.Password}
+		}
+		if _, err := c.do(args...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if db.Database != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(db.Database)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// pools returns pools to try in order: replicas in round-robin order, then
+// the primary.
+func (db *DB) pools() []*pool {
+	pools := make([]*pool, 0, len(db.replicas)+1)
+	if len(db.replicas) != 0 {
+		start := int(atomic.AddUint32(&db.next, 1)) % len(db.replicas)
+		for i := range db.replicas {
+			pools = append(pools, db.replicas[(start+i)%len(db.replicas)])
+		}
+	}
+	return append(pools, db.primary)
+}
+
+// lookup reads fields stored at the key. Missing key is reported as
+// ErrUserUnknown.
+func (db *DB) lookup(ctx context.Context, key string) (map[string]string, error) {
+	db.initOnce.Do(db.init)
+
+	var lastErr error
+	for _, p := range db.pools() {
+		c, err := p.get(ctx)
+		if err != nil {
+			lastErr = fmt.Errorf("redisdb: %s: %w", p.addr, err)
+			continue
+		}
+		fields, err := fetch(c, key)
+		p.put(c)
+		if err != nil {
+			if c.broken {
+				lastErr = fmt.Errorf("redisdb: %s: %w", p.addr, err)
+				continue
+			}
+			return nil, dovecotsasl.PassdbInternalError(err)
+		}
+		if fields == nil {
+			return nil, dovecotsasl.ErrUserUnknown
+		}
+		return fields, nil
+	}
+	return nil, dovecotsasl.PassdbInternalError(lastErr)
+}
+
+// fetch reads the key as a hash, falling back to GET if it holds a
+// different type. nil map is returned if the key does not exist.
+func fetch(c *conn, key string) (map[string]string, error) {
+	reply, err := c.do("HGETALL", key)
+	if err != nil {
+		var rerr redisError
+		if !errors.As(err, &rerr) || !strings.HasPrefix(string(rerr), "WRONGTYPE") {
+			return nil, err
+		}
+
+		reply, err = c.do("GET", key)
+		if err != nil {
+			return nil, err
+		}
+		if reply == nil {
+			return nil, nil
+		}
+		value, ok := reply.(string)
+		if !ok {
+			return nil, errors.New("redisdb: unexpected GET reply")
+		}
+		return parseValue(value), nil
+	}
+
+	arr, ok := reply.([]interface{})
+	if !ok || len(arr)%2 != 0 {
+		return nil, errors.New("redisdb: unexpected HGETALL reply")
+	}
+	if len(arr) == 0 {
+		return nil, nil
+	}
+	fields := make(map[string]string, len(arr)/2)
+	for i := 0; i < len(arr); i += 2 {
+		k, kok := arr[i].(string)
+		v, vok := arr[i+1].(string)
+		if !kok || !vok {
+			return nil, errors.New("redisdb: unexpected HGETALL reply")
+		}
+		fields[k] = v
+	}
+	return fields, nil
+}
+
+// parseValue converts the string value into fields.
+func parseValue(value string) map[string]string {
+	var obj map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil || dec.More() {
+		return map[string]string{"password": value}
+	}
+
+	fields := make(map[string]string, len(obj))
+	for k, v := range obj {
+		switch v := v.(type) {
+		case nil:
+		case string:
+			fields[k] = v
+		case json.Number:
+			fields[k] = v.String()
+		case bool:
+			fields[k] = strconv.FormatBool(v)
+		default:
+			b, _ := json.Marshal(v)
+			fields[k] = string(b)
+		}
+	}
+	return fields
+}
+
+func passdbResult(fields map[string]string) *dovecotsasl.PassdbResult {
+	res := &dovecotsasl.PassdbResult{
+		User:  fields["user"],
+		Extra: make(map[string]string),
+	}
+	for k, v := range fields {
+		if k == "user" || k == "password" {
+			continue
+		}
+		res.Extra[k] = v
+	}
+	return res
+}
+
+func (db *DB) VerifyPlain(ctx context.Context, req *dovecotsasl.AuthReq, user, pass string) (*dovecotsasl.PassdbResult, error) {
+	fields, err := db.lookup(ctx, expand.Expand(db.PassKey, req.Vars(user), nil))
+	if err != nil {
+		return nil, err
+	}
+	res := passdbResult(fields)
+	if _, ok := res.Extra["nopassword"]; ok {
+		return res, nil
+	}
+	password, ok := fields["password"]
+	if !ok {
+		return nil, dovecotsasl.ErrPasswordMismatch
+	}
+	if err := dovecotsasl.VerifyPassword(password, db.DefaultScheme, pass); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (db *DB) LookupCredentials(ctx context.Context, req *dovecotsasl.AuthReq, user, scheme string) (*dovecotsasl.PassdbResult, error) {
+	fields, err := db.lookup(ctx, expand.Expand(db.PassKey, req.Vars(user), nil))
+	if err != nil {
+		return nil, err
+	}
+	password, ok := fields["password"]
+	if !ok {
+		return nil, dovecotsasl.ErrCredentialsUnavailable
+	}
+	res := passdbResult(fields)
+	res.Credentials, err = dovecotsasl.PasswordCredentials(password, db.DefaultScheme, scheme)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// LookupUser returns userdb fields stored at UserKey.
+func (db *DB) LookupUser(ctx context.Context, req *dovecotsasl.AuthReq, user string) (map[string]string, error) {
+	if db.UserKey == "" {
+		return nil, dovecotsasl.PassdbInternalError(errors.New("redisdb: user key is not configured"))
+	}
+	return db.lookup(ctx, expand.Expand(db.UserKey, req.Vars(user), nil))
+}
+
+// Close closes all pooled connections.
+func (db *DB) Close() error {
+	db.initOnce.Do(db.init)
+	db.primary.close()
+	for _, p := range db.replicas {
+		p.close()
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package redisdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	"github.com/foxcpp/go-dovecot-sasl/redisdb/redistest"
+)
+
+func TestRedis(t *testing.T) {
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Password = "secret"
+
+	srv.HSet("passdb/foxcpp@example.org", map[string]string{
+		"password": "{PLAIN}1234",
+		"quota":    "1G",
+	})
+	srv.Set("passdb/json@example.org", `{"password":"{PLAIN}1234","user":"JSON@example.org","quota":1024,"unused":null}`)
+	srv.Set("passdb/bare@example.org", "1234")
+	srv.HSet("userdb/foxcpp@example.org", map[string]string{
+		"home": "/var/vmail/example.org/foxcpp",
+		"uid":  "1000",
+	})
+
+	db := New(srv.Addr())
+	db.Password = "secret"
+	db.Database = 1
+	defer db.Close()
+	ctx := context.Background()
+
+	res, err := db.VerifyPlain(ctx, nil, "foxcpp@example.org", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Extra["quota"] != "1G" {
+		t.Errorf("unexpected extra fields: %v", res.Extra)
+	}
+	if _, ok := res.Extra["password"]; ok {
+		t.Errorf("password is returned as an extra field")
+	}
+	if _, err := db.VerifyPlain(ctx, nil, "foxcpp@example.org", "5678"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("expected password mismatch, got %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, nil, "nobody@example.org", "1234"); !errors.Is(err, dovecotsasl.ErrUserUnknown) {
+		t.Errorf("expected unknown user, got %v", err)
+	}
+
+	res, err = db.VerifyPlain(ctx, nil, "json@example.org", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.User != "JSON@example.org" || res.Extra["quota"] != "1024" {
+		t.Errorf("unexpected result for JSON value: %+v", res)
+	}
+	if _, ok := res.Extra["unused"]; ok {
+		t.Errorf("null field is returned as an extra field")
+	}
+
+	creds, err := db.LookupCredentials(ctx, nil, "bare@example.org", "PLAIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(creds.Credentials) != "1234" {
+		t.Errorf("got credentials %q, want %q", creds.Credentials, "1234")
+	}
+
+	fields, err := db.LookupUser(ctx, nil, "foxcpp@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["home"] != "/var/vmail/example.org/foxcpp" || fields["uid"] != "1000" {
+		t.Errorf("unexpected userdb fields: %v", fields)
+	}
+
+	if conns := srv.Conns(); conns != 1 {
+		t.Errorf("sequential lookups used %d connections, want 1", conns)
+	}
+
+	bad := New(srv.Addr())
+	bad.Password = "wrong"
+	if _, err := bad.VerifyPlain(ctx, nil, "foxcpp@example.org", "1234"); dovecotsasl.PassdbStatusOf(err) != dovecotsasl.PassdbInternalFailure {
+		t.Errorf("expected internal failure for wrong AUTH password, got %v", err)
+	}
+}
+
+func TestRedisReplicas(t *testing.T) {
+	primary, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	replica, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	down, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	primary.Set("passdb/foxcpp", "{PLAIN}primary")
+	replica.Set("passdb/foxcpp", "{PLAIN}replica")
+
+	db := New(primary.Addr())
+	db.Replicas = []string{replica.Addr(), down.Addr()}
+	defer db.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		if _, err := db.VerifyPlain(ctx, nil, "foxcpp", "replica"); err != nil {
+			t.Fatalf("lookup %d: %v", i, err)
+		}
+	}
+	if primary.Conns() != 0 {
+		t.Errorf("primary is used while a replica is available")
+	}
+
+	replica.Close()
+	if _, err := db.VerifyPlain(ctx, nil, "foxcpp", "primary"); err != nil {
+		t.Fatalf("no failover to primary: %v", err)
+	}
+}
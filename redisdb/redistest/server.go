@@ -0,0 +1,272 @@
+// Package redistest provides an in-process in-memory Redis stand-in for
+// testing.
+//
+// Only string and hash values and a handful of commands are implemented:
+// PING, AUTH, SELECT, GET, SET, HGETALL, HSET, DEL and QUIT. All database
+// numbers share the same keyspace.
+package redistest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is the fake Redis server.
+type Server struct {
+	// Require AUTH with this password (and Username, if set).
+	Username string
+	Password string
+
+	lock    sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	conns   int
+
+	l       net.Listener
+	wg      sync.WaitGroup
+	netConn sync.Map
+}
+
+// NewServer starts the server listening on a random local TCP port.
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		l:       l,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the host:port address of the server.
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Set stores the string value.
+func (s *Server) Set(key, value string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.hashes, key)
+	s.strings[key] = value
+}
+
+// HSet stores hash fields.
+func (s *Server) HSet(key string, fields map[string]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.strings, key)
+	h := s.hashes[key]
+	if h == nil {
+		h = make(map[string]string)
+		s.hashes[key] = h
+	}
+	for k, v := range fields {
+		h[k] = v
+	}
+}
+
+// Conns returns the number of connections accepted so far.
+func (s *Server) Conns() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.conns
+}
+
+func (s *Server) Close() error {
+	err := s.l.Close()
+	s.netConn.Range(func(k, _ interface{}) bool {
+		k.(net.Conn).Close()
+		return true
+	})
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conns++
+		s.lock.Unlock()
+		s.netConn.Store(conn, struct{}{})
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	line, err := readLine()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("expected array")
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n <= 0 {
+		return nil, errors.New("invalid array length")
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errors.New("expected bulk string")
+		}
+		l, err := strconv.Atoi(line[1:])
+		if err != nil || l < 0 {
+			return nil, errors.New("invalid bulk string length")
+		}
+		buf := make([]byte, l+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:l])
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer func() {
+		s.netConn.Delete(conn)
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	authed := s.Password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		reply, quit := s.execute(args, &authed)
+		if _, err := io.WriteString(conn, reply); err != nil || quit {
+			return
+		}
+	}
+}
+
+func (s *Server) execute(args []string, authed *bool) (reply string, quit bool) {
+	cmd := strings.ToUpper(args[0])
+	switch cmd {
+	case "QUIT":
+		return "+OK\r\n", true
+	case "AUTH":
+		var user, pass string
+		switch len(args) {
+		case 2:
+			pass = args[1]
+		case 3:
+			user, pass = args[1], args[2]
+		default:
+			return "-ERR wrong number of arguments for 'auth' command\r\n", false
+		}
+		if user != s.Username || pass != s.Password {
+			return "-WRONGPASS invalid username-password pair\r\n", false
+		}
+		*authed = true
+		return "+OK\r\n", false
+	}
+	if !*authed {
+		return "-NOAUTH Authentication required.\r\n", false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch {
+	case cmd == "PING":
+		return "+PONG\r\n", false
+	case cmd == "SELECT" && len(args) == 2:
+		if _, err := strconv.Atoi(args[1]); err != nil {
+			return "-ERR invalid DB index\r\n", false
+		}
+		return "+OK\r\n", false
+	case cmd == "GET" && len(args) == 2:
+		if _, ok := s.hashes[args[1]]; ok {
+			return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", false
+		}
+		v, ok := s.strings[args[1]]
+		if !ok {
+			return "$-1\r\n", false
+		}
+		return bulk(v), false
+	case cmd == "SET" && len(args) == 3:
+		delete(s.hashes, args[1])
+		s.strings[args[1]] = args[2]
+		return "+OK\r\n", false
+	case cmd == "HGETALL" && len(args) == 2:
+		if _, ok := s.strings[args[1]]; ok {
+			return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", false
+		}
+		h := s.hashes[args[1]]
+		var b strings.Builder
+		fmt.Fprintf(&b, "*%d\r\n", 2*len(h))
+		for k, v := range h {
+			b.WriteString(bulk(k))
+			b.WriteString(bulk(v))
+		}
+		return b.String(), false
+	case cmd == "HSET" && len(args) >= 4 && len(args)%2 == 0:
+		if _, ok := s.strings[args[1]]; ok {
+			return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", false
+		}
+		h := s.hashes[args[1]]
+		if h == nil {
+			h = make(map[string]string)
+			s.hashes[args[1]] = h
+		}
+		added := 0
+		for i := 2; i < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				added++
+			}
+			h[args[i]] = args[i+1]
+		}
+		return ":" + strconv.Itoa(added) + "\r\n", false
+	case cmd == "DEL" && len(args) >= 2:
+		deleted := 0
+		for _, key := range args[1:] {
+			_, isStr := s.strings[key]
+			_, isHash := s.hashes[key]
+			if isStr || isHash {
+				deleted++
+			}
+			delete(s.strings, key)
+			delete(s.hashes, key)
+		}
+		return ":" + strconv.Itoa(deleted) + "\r\n", false
+	default:
+		return "-ERR unknown command or wrong number of arguments\r\n", false
+	}
+}
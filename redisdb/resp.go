@@ -0,0 +1,134 @@
+package redisdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// redisError is the error reply returned by the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redisdb: server error: " + string(e)
+}
+
+// conn is a minimal RESP2 client connection.
+type conn struct {
+	net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration
+	broken  bool
+}
+
+func newConn(netConn net.Conn, timeout time.Duration) *conn {
+	return &conn{
+		Conn:    netConn,
+		r:       bufio.NewReader(netConn),
+		w:       bufio.NewWriter(netConn),
+		timeout: timeout,
+	}
+}
+
+// do sends the command and reads the reply. Reply values are string (simple
+// and bulk strings), nil (null bulk string or array), int64 and
+// []interface{}. Server errors are returned as redisError, other errors mark
+// the connection as broken.
+func (c *conn) do(args ...string) (interface{}, error) {
+	if c.timeout != 0 {
+		c.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.w.Flush(); err != nil {
+		c.broken = true
+		return nil, err
+	}
+
+	reply, err := c.readReply()
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			c.broken = true
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *conn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("redisdb: malformed reply line")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (c *conn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("redisdb: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redisdb: malformed integer reply: %w", err)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redisdb: malformed bulk string length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redisdb: malformed array length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			// Errors inside arrays are returned as values.
+			arr[i], err = c.readReply()
+			if err != nil {
+				if rerr, ok := err.(redisError); ok {
+					arr[i] = rerr
+					continue
+				}
+				return nil, err
+			}
+		}
+		return arr, nil
+	default:
+		return nil, fmt.Errorf("redisdb: unexpected reply type: %q", line[0])
+	}
+}
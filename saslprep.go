@@ -0,0 +1,80 @@
+package dovecotsasl
+
+import (
+	"golang.org/x/text/secure/precis"
+)
+
+// PrepMode controls the preparation of usernames and passwords (SASLprep,
+// RFC 4013) by built-in mechanisms and client helpers.
+//
+// PRECIS profiles (RFC 8265) that supersede SASLprep are used:
+// UsernameCasePreserved for usernames and authorization identities and
+// OpaqueString for passwords. Both keep ASCII strings unchanged (except for
+// usernames with spaces or control characters that are never valid), but
+// map and normalize non-ASCII ones so equivalent strings entered
+// differently by clients compare equal.
+//
+// Passwords are prepared only where they are entered (PLAIN and LOGIN on
+// the server, Credentials on the client); stored hashes, including SCRAM
+// ones, are used byte-exact like in Dovecot.
+type PrepMode int
+
+const (
+	// PrepNone disables the preparation, the default.
+	PrepNone PrepMode = iota
+
+	// PrepLenient prepares strings but uses them as is if they are not
+	// valid for the PRECIS profile.
+	PrepLenient
+
+	// PrepStrict rejects strings that are not valid for the PRECIS
+	// profile.
+	PrepStrict
+)
+
+// errPrepFailed is reported to the client if credentials are rejected by
+// PrepStrict.
+var errPrepFailed = AuthFail{Reason: "invalid characters in credentials"}
+
+func prepString(p *precis.Profile, mode PrepMode, s string) (string, error) {
+	if mode == PrepNone || s == "" {
+		return s, nil
+	}
+	prepared, err := p.String(s)
+	if err != nil {
+		if mode == PrepStrict {
+			return "", err
+		}
+		return s, nil
+	}
+	return prepared, nil
+}
+
+func prepUsername(mode PrepMode, s string) (string, error) {
+	return prepString(precis.UsernameCasePreserved, mode, s)
+}
+
+func prepPassword(mode PrepMode, s string) (string, error) {
+	return prepString(precis.OpaqueString, mode, s)
+}
+
+// prepCredentials prepares the authorization identity, username and
+// password for the request, errPrepFailed is returned if any of them are
+// rejected.
+func (r *AuthReq) prepCredentials(authzID, user, pass string) (string, string, string, error) {
+	mode := PrepNone
+	if r != nil {
+		mode = r.prep
+	}
+	var err error
+	if authzID, err = prepUsername(mode, authzID); err != nil {
+		return "", "", "", errPrepFailed
+	}
+	if user, err = prepUsername(mode, user); err != nil {
+		return "", "", "", errPrepFailed
+	}
+	if pass, err = prepPassword(mode, pass); err != nil {
+		return "", "", "", errPrepFailed
+	}
+	return authzID, user, pass, nil
+}
@@ -0,0 +1,77 @@
+package dovecotsasl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+)
+
+func TestSASLprep(t *testing.T) {
+	// Stored in NFC, clients below use NFD.
+	const (
+		user     = "jürgen"
+		pass     = "pässwörd"
+		userNFD  = "ju\u0308rgen"
+		passNFD  = "pa\u0308sswo\u0308rd"
+		ctrlPass = "1234\u0007"
+	)
+
+	s := NewServer()
+	s.AddPassdbMechanisms(testPassdb{user: pass, "foxcpp": ctrlPass})
+	s.Prep = PrepLenient
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := cl.Do("imap", sasl.NewPlainClient("", userNFD, passNFD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.UserID != user {
+		t.Errorf("username is not normalized: %q", res.UserID)
+	}
+
+	for _, mech := range []string{"SCRAM-SHA-256", "CRAM-MD5"} {
+		c, err := cl.mechClient(mech, Credentials{Username: userNFD, Password: passNFD, Prep: PrepLenient})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cl.Do("imap", c); err != nil {
+			t.Errorf("%s: %v", mech, err)
+		}
+	}
+
+	// Invalid strings are used as is in lenient mode.
+	if _, err := cl.Do("imap", sasl.NewPlainClient("", "foxcpp", ctrlPass)); err != nil {
+		t.Errorf("lenient mode: %v", err)
+	}
+
+	s.Prep = PrepStrict
+	_, err = cl.Do("imap", sasl.NewPlainClient("", "foxcpp", ctrlPass))
+	var af AuthFail
+	if !errors.As(err, &af) || af.Reason != errPrepFailed.Reason {
+		t.Errorf("strict mode: expected %v, got %v", errPrepFailed, err)
+	}
+	if _, _, err := cl.Authenticate("imap", Credentials{Username: "foxcpp", Password: ctrlPass, Prep: PrepStrict}); err == nil {
+		t.Errorf("strict mode: client accepted invalid password")
+	}
+
+	s.Prep = PrepNone
+	if _, err := cl.Do("imap", sasl.NewPlainClient("", userNFD, passNFD)); !errors.As(err, &af) {
+		t.Errorf("no preparation: expected authentication failure, got %v", err)
+	}
+	c, err := cl.mechClient("SCRAM-SHA-256", Credentials{Username: user, Password: passNFD})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Do("imap", c); !errors.As(err, &af) {
+		t.Errorf("no preparation: client prepared the password by default, got %v", err)
+	}
+}
@@ -0,0 +1,457 @@
+package dovecotsasl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// scramHash returns the hash function used by the SCRAM mechanism with the
+// specified name (with or without -PLUS suffix).
+func scramHash(mech string) func() hash.Hash {
+	switch strings.TrimSuffix(mech, "-PLUS") {
+	case "SCRAM-SHA-1":
+		return sha1.New
+	case "SCRAM-SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+func scramHMAC(h func() hash.Hash, key []byte, data string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func scramH(h func() hash.Hash, data []byte) []byte {
+	hasher := h()
+	hasher.Write(data)
+	return hasher.Sum(nil)
+}
+
+// scramSaltedKeys derives StoredKey and ServerKey from the plaintext password
+// as defined in RFC 5802.
+func scramSaltedKeys(h func() hash.Hash, password string, salt []byte, iter int) (clientKey, storedKey, serverKey []byte) {
+	salted := pbkdf2.Key([]byte(password), salt, iter, h().Size(), h)
+	clientKey = scramHMAC(h, salted, "Client Key")
+	storedKey = scramH(h, clientKey)
+	serverKey = scramHMAC(h, salted, "Server Key")
+	return
+}
+
+func scramEscape(s string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s)
+}
+
+func scramUnescape(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case ',':
+			return "", errors.New("dovecotsasl: unescaped comma in SCRAM name")
+		case '=':
+			if i+2 >= len(s) {
+				return "", errors.New("dovecotsasl: malformed SCRAM name escape")
+			}
+			switch s[i+1 : i+3] {
+			case "3D":
+				b.WriteByte('=')
+			case "2C":
+				b.WriteByte(',')
+			default:
+				return "", errors.New("dovecotsasl: malformed SCRAM name escape")
+			}
+			i += 2
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// scramAttrs splits SCRAM message into attribute-value pairs, preserving
+// order.
+func scramAttrs(msg string) ([][2]string, error) {
+	var attrs [][2]string
+	for _, part := range strings.Split(msg, ",") {
+		if len(part) < 2 || part[1] != '=' {
+			return nil, fmt.Errorf("dovecotsasl: malformed SCRAM attribute: %q", part)
+		}
+		attrs = append(attrs, [2]string{part[:1], part[2:]})
+	}
+	return attrs, nil
+}
+
+func scramNonce() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+type scramClient struct {
+	mech     string
+	h        func() hash.Hash
+	authzID  string
+	username string
+	password string
+
+	// cbType is the channel binding type used with -PLUS mechanisms,
+	// cbSupported is set if we could do channel binding but the server
+	// does not advertise -PLUS variant.
+	cbType      string
+	cbData      []byte
+	cbSupported bool
+
+	step            int
+	clientNonce     string
+	gs2Header       string
+	clientFirstBare string
+	serverSignature []byte
+	// Set once the server signature is verified.
+	verified bool
+}
+
+func newSCRAMClient(mech, authzID, username, password string, cb *ChannelBinding, cbSupported bool) (sasl.Client, error) {
+	h := scramHash(mech)
+	if h == nil {
+		return nil, fmt.Errorf("dovecotsasl: unknown SCRAM mechanism: %v", mech)
+	}
+	c := &scramClient{
+		mech:        mech,
+		h:           h,
+		authzID:     authzID,
+		username:    username,
+		password:    password,
+		cbSupported: cbSupported,
+	}
+	if strings.HasSuffix(mech, "-PLUS") {
+		if cb == nil {
+			return nil, fmt.Errorf("dovecotsasl: %v requires channel binding data", mech)
+		}
+		c.cbType = cb.Type
+		c.cbData = cb.Data
+	}
+	return c, nil
+}
+
+func (c *scramClient) Start() (string, []byte, error) {
+	nonce, err := scramNonce()
+	if err != nil {
+		return "", nil, err
+	}
+	c.clientNonce = nonce
+
+	switch {
+	case c.cbType != "":
+		c.gs2Header = "p=" + c.cbType + ","
+	case c.cbSupported:
+		c.gs2Header = "y,"
+	default:
+		c.gs2Header = "n,"
+	}
+	if c.authzID != "" {
+		c.gs2Header += "a=" + scramEscape(c.authzID)
+	}
+	c.gs2Header += ","
+
+	c.clientFirstBare = "n=" + scramEscape(c.username) + ",r=" + c.clientNonce
+	return c.mech, []byte(c.gs2Header + c.clientFirstBare), nil
+}
+
+func (c *scramClient) Next(challenge []byte) ([]byte, error) {
+	c.step++
+	switch c.step {
+	case 1:
+		return c.clientFinal(string(challenge))
+	case 2:
+		return nil, c.verifyServerFinal(string(challenge))
+	default:
+		return nil, errors.New("dovecotsasl: unexpected SCRAM challenge")
+	}
+}
+
+func (c *scramClient) clientFinal(serverFirst string) ([]byte, error) {
+	attrs, err := scramAttrs(serverFirst)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		nonce string
+		salt  []byte
+		iter  int
+	)
+	for _, attr := range attrs {
+		switch attr[0] {
+		case "m":
+			return nil, errors.New("dovecotsasl: unsupported SCRAM extension")
+		case "r":
+			nonce = attr[1]
+		case "s":
+			salt, err = base64.StdEncoding.DecodeString(attr[1])
+			if err != nil {
+				return nil, fmt.Errorf("dovecotsasl: malformed SCRAM salt: %v", err)
+			}
+		case "i":
+			iter, err = strconv.Atoi(attr[1])
+			if err != nil || iter <= 0 {
+				return nil, fmt.Errorf("dovecotsasl: malformed SCRAM iteration count: %v", attr[1])
+			}
+		}
+	}
+	if !strings.HasPrefix(nonce, c.clientNonce) || len(nonce) == len(c.clientNonce) {
+		return nil, errors.New("dovecotsasl: SCRAM server nonce mismatch")
+	}
+	if len(salt) == 0 || iter == 0 {
+		return nil, errors.New("dovecotsasl: missing SCRAM salt or iteration count")
+	}
+
+	cbInput := append([]byte(c.gs2Header), c.cbData...)
+	clientFinalNoProof := "c=" + base64.StdEncoding.EncodeToString(cbInput) + ",r=" + nonce
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + clientFinalNoProof
+
+	clientKey, storedKey, serverKey := scramSaltedKeys(c.h, c.password, salt, iter)
+	clientSignature := scramHMAC(c.h, storedKey, authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	c.serverSignature = scramHMAC(c.h, serverKey, authMessage)
+
+	return []byte(clientFinalNoProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (c *scramClient) verifyServerFinal(serverFinal string) error {
+	attrs, err := scramAttrs(serverFinal)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch attr[0] {
+		case "e":
+			return fmt.Errorf("dovecotsasl: SCRAM server error: %v", attr[1])
+		case "v":
+			sig, err := base64.StdEncoding.DecodeString(attr[1])
+			if err != nil {
+				return fmt.Errorf("dovecotsasl: malformed SCRAM server signature: %v", err)
+			}
+			if subtle.ConstantTimeCompare(sig, c.serverSignature) != 1 {
+				return errors.New("dovecotsasl: SCRAM server signature mismatch")
+			}
+			c.verified = true
+			return nil
+		}
+	}
+	return errors.New("dovecotsasl: missing SCRAM server signature")
+}
+
+func (c *scramClient) serverVerified() bool {
+	return c.verified
+}
+
+// parseSCRAMCredentials parses SCRAM credentials in Dovecot format:
+// "iter,salt,storedkey,serverkey" with base64-encoded values.
+func parseSCRAMCredentials(creds []byte) (iter int, salt, storedKey, serverKey []byte, err error) {
+	parts := strings.Split(string(creds), ",")
+	if len(parts) != 4 {
+		return 0, nil, nil, nil, errors.New("dovecotsasl: malformed SCRAM credentials")
+	}
+	iter, err = strconv.Atoi(parts[0])
+	if err != nil || iter <= 0 {
+		return 0, nil, nil, nil, errors.New("dovecotsasl: malformed SCRAM iteration count")
+	}
+	if salt, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+		return 0, nil, nil, nil, fmt.Errorf("dovecotsasl: malformed SCRAM salt: %v", err)
+	}
+	if storedKey, err = base64.StdEncoding.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, nil, fmt.Errorf("dovecotsasl: malformed SCRAM stored key: %v", err)
+	}
+	if serverKey, err = base64.StdEncoding.DecodeString(parts[3]); err != nil {
+		return 0, nil, nil, nil, fmt.Errorf("dovecotsasl: malformed SCRAM server key: %v", err)
+	}
+	return iter, salt, storedKey, serverKey, nil
+}
+
+// SCRAMHandler returns the implementation of SCRAM-SHA-1 or SCRAM-SHA-256
+// mechanism (selected by mech) that uses credentials from db.
+//
+// Channel binding (-PLUS variants) is not supported.
+func SCRAMHandler(mech string, db Passdb) FuncSASLHandler {
+	h := scramHash(mech)
+	if h == nil || strings.HasSuffix(mech, "-PLUS") {
+		panic("dovecotsasl: unsupported SCRAM mechanism: " + mech)
+	}
+	return func(req *AuthReq, cb FuncSASLCallback) sasl.Server {
+		return &scramServer{mech: mech, h: h, db: db, req: req, cb: cb}
+	}
+}
+
+type scramServer struct {
+	mech string
+	h    func() hash.Hash
+	db   Passdb
+	req  *AuthReq
+	cb   FuncSASLCallback
+
+	step            int
+	login           *login
+	res             *PassdbResult
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	storedKey       []byte
+	serverKey       []byte
+}
+
+func (s *scramServer) Next(response []byte) ([]byte, bool, error) {
+	s.step++
+	switch s.step {
+	case 1:
+		if len(response) == 0 {
+			// No initial response, ask client to send it.
+			s.step = 0
+			return []byte{}, false, nil
+		}
+		challenge, err := s.serverFirstMsg(string(response))
+		return challenge, false, err
+	case 2:
+		final, err := s.serverFinalMsg(string(response))
+		if err != nil {
+			return nil, false, err
+		}
+		if err := s.login.success(s.cb, s.res); err != nil {
+			return nil, false, err
+		}
+		return final, true, nil
+	}
+	return nil, false, errors.New("dovecotsasl: unexpected SCRAM response")
+}
+
+func (s *scramServer) serverFirstMsg(clientFirst string) ([]byte, error) {
+	// gs2-cbind-flag "," [authzid] "," client-first-message-bare
+	parts := strings.SplitN(clientFirst, ",", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("dovecotsasl: malformed SCRAM client-first-message")
+	}
+	switch {
+	case parts[0] == "n", parts[0] == "y":
+		// We never advertise -PLUS variants so "y" is fine.
+	case strings.HasPrefix(parts[0], "p="):
+		return nil, errors.New("dovecotsasl: SCRAM channel binding is not supported")
+	default:
+		return nil, errors.New("dovecotsasl: malformed SCRAM gs2 header")
+	}
+
+	var authzID string
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, errors.New("dovecotsasl: malformed SCRAM authzid")
+		}
+		var err error
+		authzID, err = scramUnescape(parts[1][2:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+
+	attrs, err := scramAttrs(s.clientFirstBare)
+	if err != nil {
+		return nil, err
+	}
+	if len(attrs) < 2 || attrs[0][0] != "n" || attrs[1][0] != "r" {
+		return nil, errors.New("dovecotsasl: malformed SCRAM client-first-message")
+	}
+	user, err := scramUnescape(attrs[0][1])
+	if err != nil {
+		return nil, err
+	}
+	if user == "" {
+		return nil, errors.New("dovecotsasl: empty SCRAM username")
+	}
+	if authzID, user, _, err = s.req.prepCredentials(authzID, user, ""); err != nil {
+		return nil, err
+	}
+	if s.login, err = s.req.resolveLogin(s.db, authzID, user); err != nil {
+		return nil, err
+	}
+	clientNonce := attrs[1][1]
+
+	s.res, err = s.login.lookupCredentials(strings.TrimSuffix(s.mech, "-PLUS"))
+	if err != nil {
+		return nil, err
+	}
+	iter, salt, storedKey, serverKey, err := parseSCRAMCredentials(s.res.Credentials)
+	if err != nil {
+		return nil, PassdbInternalError(err)
+	}
+	s.storedKey = storedKey
+	s.serverKey = serverKey
+
+	serverNonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+	s.nonce = clientNonce + serverNonce
+	s.serverFirst = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(salt) + ",i=" + strconv.Itoa(iter)
+	return []byte(s.serverFirst), nil
+}
+
+func (s *scramServer) serverFinalMsg(clientFinal string) ([]byte, error) {
+	idx := strings.LastIndex(clientFinal, ",p=")
+	if idx < 0 {
+		return nil, errors.New("dovecotsasl: missing SCRAM client proof")
+	}
+	clientFinalNoProof := clientFinal[:idx]
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[idx+3:])
+	if err != nil {
+		return nil, fmt.Errorf("dovecotsasl: malformed SCRAM client proof: %v", err)
+	}
+
+	attrs, err := scramAttrs(clientFinalNoProof)
+	if err != nil {
+		return nil, err
+	}
+	if len(attrs) < 2 || attrs[0][0] != "c" || attrs[1][0] != "r" {
+		return nil, errors.New("dovecotsasl: malformed SCRAM client-final-message")
+	}
+	cbind, err := base64.StdEncoding.DecodeString(attrs[0][1])
+	if err != nil || string(cbind) != s.gs2Header {
+		return nil, errors.New("dovecotsasl: SCRAM channel binding mismatch")
+	}
+	if attrs[1][1] != s.nonce {
+		return nil, errors.New("dovecotsasl: SCRAM nonce mismatch")
+	}
+
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + clientFinalNoProof
+	clientSignature := scramHMAC(s.h, s.storedKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, ErrPasswordMismatch
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	if subtle.ConstantTimeCompare(scramH(s.h, clientKey), s.storedKey) != 1 {
+		return nil, ErrPasswordMismatch
+	}
+
+	serverSignature := scramHMAC(s.h, s.serverKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
@@ -1,11 +1,14 @@
 package dovecotsasl
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
 	"net"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-sasl"
 )
@@ -81,3 +84,129 @@ func TestSaslPlain(t *testing.T) {
 		t.Fatal("Error is not an auth fail:", err)
 	}
 }
+
+func TestAuthenticatePlaintextPolicy(t *testing.T) {
+	s := NewServer()
+	s.AddMechanism("PLAIN", Mechanism{Plaintext: true}, func(req *AuthReq, cb FuncSASLCallback) sasl.Server {
+		return sasl.NewPlainServer(func(_, user, pass string) error {
+			if user == "foxcpp" && pass == "1234" {
+				cb("foxcpp", nil)
+				return nil
+			}
+			return errors.New("nope")
+		})
+	})
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	creds := Credentials{Username: "foxcpp", Password: "1234"}
+	if _, _, err := cl.Authenticate("smtp", creds); err == nil {
+		t.Fatal("Expected plaintext mechanism to be refused on insecure connection")
+	}
+
+	mech, res, err := cl.Authenticate("smtp", creds, ParamSecured(SecuredTLS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mech != "PLAIN" {
+		t.Errorf("got mech = %q, want %q", mech, "PLAIN")
+	}
+	if res.UserID != "foxcpp" {
+		t.Errorf("got UserID = %q, want %q", res.UserID, "foxcpp")
+	}
+
+	if _, _, err := cl.Authenticate("smtp", creds, ParamTransport(TransportTLS)); err != nil {
+		t.Errorf("TLS transport: %v", err)
+	}
+
+	creds.AllowPlaintext = true
+	if _, _, err := cl.Authenticate("smtp", creds); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// scramSkipServer completes the SCRAM exchange without sending the server
+// signature.
+type scramSkipServer struct {
+	step int
+}
+
+func (s *scramSkipServer) Next(response []byte) ([]byte, bool, error) {
+	s.step++
+	if s.step == 1 {
+		attrs, err := scramAttrs(strings.TrimPrefix(string(response), "n,,"))
+		if err != nil {
+			return nil, false, err
+		}
+		return []byte("r=" + attrs[1][1] + "server,s=c2FsdA==,i=4096"), false, nil
+	}
+	return nil, true, nil
+}
+
+func TestSCRAMServerSignatureRequired(t *testing.T) {
+	s := NewServer()
+	s.AddMechanism("SCRAM-SHA-256", Mechanism{}, func(req *AuthReq, cb FuncSASLCallback) sasl.Server {
+		cb("foxcpp", nil)
+		return &scramSkipServer{}
+	})
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if _, _, err := cl.Authenticate("imap", Credentials{Username: "foxcpp", Password: "1234"}); err == nil {
+		t.Error("success without server signature is accepted")
+	}
+}
+
+// blockingPassdb waits for the request to be canceled.
+type blockingPassdb struct {
+	testPassdb
+	canceled chan struct{}
+}
+
+func (db blockingPassdb) VerifyPlain(ctx context.Context, _ *AuthReq, _, _ string) (*PassdbResult, error) {
+	<-ctx.Done()
+	close(db.canceled)
+	return nil, PassdbInternalError(ctx.Err())
+}
+
+func TestContextCanceledOnClose(t *testing.T) {
+	db := blockingPassdb{canceled: make(chan struct{})}
+	s := NewServer()
+	s.AddPassdbMechanisms(db)
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	conn := testDial(t, l)
+	cl, err := NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cl.Do("imap", sasl.NewPlainClient("", "foxcpp", "1234"), ParamSecured(SecuredTLS))
+
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case <-db.canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request context is not canceled after the connection is closed")
+	}
+}
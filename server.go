@@ -2,6 +2,7 @@ package dovecotsasl
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -25,6 +26,43 @@ type Server struct {
 	mechImpl map[string]FuncSASLHandler
 	Log      *log.Logger
 
+	// Userdb is consulted after the successful authentication, its result
+	// is sent in the OK reply as userdb_* fields. Use PrefetchUserdb to
+	// reuse fields returned by the passdb.
+	Userdb Userdb
+
+	// Preparation of usernames and passwords by built-in mechanisms, none
+	// by default.
+	Prep PrepMode
+
+	// Master user logins for built-in mechanisms, disabled if nil.
+	MasterUsers *MasterUsers
+
+	// Authorize checks whether the authenticated user (authcID) is
+	// allowed to act as the requested authorization identity (authzID)
+	// in built-in mechanisms. If nil, authorization identities other than
+	// the authenticated user are rejected (except for master users). See
+	// AuthzRules for a rule-based implementation. A returned error is
+	// reported to the client as the authz_fail failure.
+	Authorize func(req *AuthReq, authcID, authzID string) error
+
+	// DisablePlaintextAuth rejects mechanisms marked as Plaintext unless
+	// the connection is secure (see AuthReq.Secure), similar to Dovecot's
+	// disable_plaintext_auth.
+	DisablePlaintextAuth bool
+
+	// Services (AuthReq.Service) and client networks (AuthReq.RemoteIP)
+	// for which plaintext mechanisms are permitted regardless of
+	// DisablePlaintextAuth.
+	PlaintextServices []string
+	TrustedNetworks   []*net.IPNet
+
+	// Penalty delays FAIL replies after repeated authentication failures
+	// from the same client address, disabled if nil. Since requests on a
+	// connection are processed sequentially, the delay holds the whole
+	// connection.
+	Penalty *Penalty
+
 	connCount uint32
 }
 
@@ -69,8 +107,12 @@ func (s *Server) handleConn(netConn net.Conn) {
 		return
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn.watch(cancel)
+
 	for {
-		err := s.handleAuth(&conn)
+		err := s.handleAuth(ctx, &conn)
 		if err != nil {
 			if !errors.Is(err, io.EOF) {
 				s.Log.Println("Protocol error:", err)
@@ -80,7 +122,25 @@ func (s *Server) handleConn(netConn net.Conn) {
 	}
 }
 
-func (s *Server) handleAuth(c *conn) error {
+// authFailure converts the error returned by the mechanism into the FAIL
+// reply.
+func authFailure(rid string, err error) AuthFail {
+	var af AuthFail
+	if errors.As(err, &af) {
+		af.RequestID = rid
+		return af
+	}
+	var pe *PassdbError
+	if errors.As(err, &pe) {
+		return failFromPassdb(rid, err)
+	}
+	return AuthFail{
+		RequestID: rid,
+		Reason:    "authentication failed",
+	}
+}
+
+func (s *Server) handleAuth(ctx context.Context, c *conn) error {
 	params, err := c.ReadlnExpect("AUTH", 3)
 	if err != nil {
 		return err
@@ -93,21 +153,31 @@ func (s *Server) handleAuth(c *conn) error {
 
 	handler := s.mechImpl[req.Mechanism]
 	if handler == nil {
-		err = c.Writeln("FAIL", AuthFail{
+		return c.Writeln("FAIL", AuthFail{
 			RequestID: req.RequestID,
 			Reason:    "unsupported mechanism",
 		}.format()...)
-		if err != nil {
-			return err
-		}
 	}
+	if s.mechInfo[req.Mechanism].Plaintext && !s.plaintextAllowed(req) {
+		s.Log.Printf("authentication failed: plaintext authentication disabled (mech=%s, service=%s, rip=%v)", req.Mechanism, req.Service, req.RemoteIP)
+		return c.Writeln("FAIL", authFailure(req.RequestID, errPlaintextDisabled).format()...)
+	}
+	req.ctx = ctx
+	req.prep = s.Prep
+	req.masterUsers = s.MasterUsers
+	req.authorize = s.Authorize
+	req.userdb = s.Userdb
 
 	okResp := &AuthOK{
 		RequestID: req.RequestID,
 	}
 	callback := func(userID string, extra map[string]string) {
 		okResp.UserID = userID
-		okResp.Extra = extra
+		// The map may belong to the backend, it is modified below.
+		okResp.Extra = make(map[string]string, len(extra))
+		for k, v := range extra {
+			okResp.Extra[k] = v
+		}
 	}
 
 	serv := handler(req, callback)
@@ -117,15 +187,19 @@ func (s *Server) handleAuth(c *conn) error {
 	for {
 		challenge, done, err := serv.Next(resp)
 		if err != nil {
-			err = c.Writeln("FAIL", AuthFail{
-				RequestID: req.RequestID,
-				Reason:    "authentication failed",
-			}.format()...)
-			if err != nil {
-				return err
-			}
+			s.Log.Printf("authentication failed: %v (mech=%s, service=%s, rip=%v)", err, req.Mechanism, req.Service, req.RemoteIP)
+			af := authFailure(req.RequestID, err)
+			s.penalize(ctx, req, af)
+			return c.Writeln("FAIL", af.format()...)
 		}
 		if done {
+			if len(challenge) != 0 {
+				// Additional data with success.
+				if okResp.Extra == nil {
+					okResp.Extra = make(map[string]string)
+				}
+				okResp.Extra["resp"] = base64.StdEncoding.EncodeToString(challenge)
+			}
 			break
 		}
 		if err = c.Writeln("CONT", req.RequestID, base64.StdEncoding.EncodeToString(challenge)); err != nil {
@@ -145,6 +219,23 @@ func (s *Server) handleAuth(c *conn) error {
 		}
 	}
 
+	if master := okResp.Extra[masterUserField]; master != "" {
+		s.Log.Printf("master user login: %s as %s (mech=%s, service=%s, rip=%v)", master, okResp.UserID, req.Mechanism, req.Service, req.RemoteIP)
+	} else if authcID := okResp.Extra[authUserField]; authcID != "" {
+		s.Log.Printf("authorized login: %s as %s (mech=%s, service=%s, rip=%v)", authcID, okResp.UserID, req.Mechanism, req.Service, req.RemoteIP)
+	}
+
+	if s.Userdb != nil {
+		if err := lookupUserdb(ctx, s.Userdb, req, okResp); err != nil {
+			s.Log.Printf("userdb lookup failed: %v (user=%s, service=%s, rip=%v)", err, okResp.UserID, req.Service, req.RemoteIP)
+			return c.Writeln("FAIL", failFromPassdb(req.RequestID, err).format()...)
+		}
+	}
+
+	if s.Penalty != nil && req.RemoteIP != nil {
+		s.Penalty.Success(req.RemoteIP)
+	}
+
 	return c.Writeln("OK", okResp.format()...)
 }
 
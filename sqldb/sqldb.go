@@ -0,0 +1,412 @@
+// Package sqldb implements passdb and userdb backend on top of
+// database/sql, similar to Dovecot's SQL driver.
+//
+// Queries use Dovecot variables (%u, %n, %d, %{rip}, ...). Queries are
+// turned into prepared statements with variables passed as arguments.
+// String literals mixing variables with other text (e.g. '%n@%d') are
+// built using DB.Concat. If the query can not be converted (e.g. DB.Concat
+// is nil or variables are used inside double quotes, which are string
+// literals in MySQL but identifiers elsewhere), variables are substituted
+// into the query text after escaping with DB.Escape.
+//
+// Result columns are mapped to fields as follows:
+//   - password: stored password, "{SCHEME}" prefix is recognized;
+//   - password_noscheme: stored password, "{" is not considered a prefix;
+//   - user: canonical username;
+//   - everything else: extra fields (userdb fields for user query).
+//
+// NULL values are ignored.
+//
+// See https://doc.dovecot.org/configuration_manual/authentication/sql/.
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	"github.com/foxcpp/go-dovecot-sasl/expand"
+)
+
+// DB is the SQL backend. It implements dovecotsasl.Passdb.
+type DB struct {
+	DB *sql.DB
+
+	// Query returning the password and extra fields, e.g.
+	// SELECT username AS user, password FROM users WHERE username = '%u'
+	PasswordQuery string
+
+	// Query returning userdb fields, e.g.
+	// SELECT home, uid, gid FROM users WHERE username = '%u'
+	UserQuery string
+
+	// Scheme to use for passwords without {SCHEME} prefix.
+	DefaultScheme string
+
+	// Placeholder returns the bind parameter marker for n-th (starting from
+	// 1) argument. Defaults to "?", use DollarPlaceholder for PostgreSQL.
+	Placeholder func(n int) string
+
+	// Concat returns the expression concatenating the parts, used for
+	// string literals mixing variables with other text. Defaults to
+	// ConcatFunc, use ConcatOperator for SQLite.
+	Concat func(parts []string) string
+
+	// Escape is used for values substituted into the query text. Defaults
+	// to EscapeString, use EscapeStandardString for PostgreSQL and SQLite.
+	Escape func(string) string
+
+	stmtsLock sync.Mutex
+	stmts     map[string]*sql.Stmt
+	compiled  map[string]*compiledQuery
+}
+
+func New(db *sql.DB) *DB {
+	return &DB{
+		DB:            db,
+		DefaultScheme: "MD5",
+		Placeholder:   QuestionPlaceholder,
+		Concat:        ConcatFunc,
+		Escape:        EscapeString,
+		stmts:         map[string]*sql.Stmt{},
+		compiled:      map[string]*compiledQuery{},
+	}
+}
+
+// QuestionPlaceholder returns "?" (MySQL, SQLite).
+func QuestionPlaceholder(int) string {
+	return "?"
+}
+
+// DollarPlaceholder returns "$n" (PostgreSQL).
+func DollarPlaceholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// ConcatFunc returns "CONCAT(a, b, ...)" (MySQL, PostgreSQL).
+func ConcatFunc(parts []string) string {
+	return "CONCAT(" + strings.Join(parts, ", ") + ")"
+}
+
+// ConcatOperator returns "(a || b || ...)" (SQLite, PostgreSQL).
+func ConcatOperator(parts []string) string {
+	return "(" + strings.Join(parts, " || ") + ")"
+}
+
+// EscapeString escapes the value for use inside a quoted MySQL string
+// literal, see expand.EscapeMySQL.
+func EscapeString(s string) string {
+	return expand.EscapeMySQL(s)
+}
+
+// EscapeStandardString escapes the value for use inside a single-quoted
+// string literal with standard-conforming strings (PostgreSQL, SQLite).
+func EscapeStandardString(s string) string {
+	return expand.EscapeSQL(s)
+}
+
+// compiledQuery is the query template converted into the prepared
+// statement. vars contains variable tokens (e.g. "%u" or "%{rip}") for each
+// argument.
+type compiledQuery struct {
+	query string
+	vars  []string
+}
+
+// compile converts the template into the parametrized query. String
+// literals containing variables together with other text (e.g. '%n@%d')
+// are built using concat. ok is false if the template can not be
+// converted, e.g. concat is nil, a variable is malformed or used inside
+// double quotes.
+func compile(tmpl string, placeholder func(int) string, concat func([]string) string) (cq compiledQuery, ok bool) {
+	var b strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		c := tmpl[i]
+		switch {
+		case c == '%' && i+1 < len(tmpl) && tmpl[i+1] == '%':
+			b.WriteByte('%')
+			i++
+		case c == '\'':
+			end, ok := compileLiteral(&cq, &b, tmpl, i, placeholder, concat)
+			if !ok {
+				return compiledQuery{}, false
+			}
+			i = end
+		case c == '"':
+			end := quotedEnd(tmpl, i)
+			if end < 0 || strings.ContainsRune(tmpl[i:end], '%') {
+				return compiledQuery{}, false
+			}
+			b.WriteString(tmpl[i : end+1])
+			i = end
+		case c == '%':
+			token := expand.TokenAt(tmpl, i)
+			if token == "" {
+				return compiledQuery{}, false
+			}
+			cq.vars = append(cq.vars, token)
+			b.WriteString(placeholder(len(cq.vars)))
+			i += len(token) - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	cq.query = b.String()
+	return cq, true
+}
+
+// quotedEnd returns the index of the closing double quote for the quote at
+// tmpl[start] or -1 if there is none. Doubled quotes are skipped.
+func quotedEnd(tmpl string, start int) int {
+	for i := start + 1; i < len(tmpl); i++ {
+		if tmpl[i] != '"' {
+			continue
+		}
+		if i+1 < len(tmpl) && tmpl[i+1] == '"' {
+			i++
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// compileLiteral converts the string literal starting at tmpl[start] and
+// returns the index of its closing quote.
+func compileLiteral(cq *compiledQuery, b *strings.Builder, tmpl string, start int, placeholder func(int) string, concat func([]string) string) (int, bool) {
+	var (
+		parts   []string
+		text    strings.Builder
+		hasVars bool
+	)
+	flush := func() {
+		if text.Len() != 0 {
+			parts = append(parts, "'"+text.String()+"'")
+			text.Reset()
+		}
+	}
+
+	i := start + 1
+	for ; i < len(tmpl); i++ {
+		c := tmpl[i]
+		switch {
+		case c == '\'' && i+1 < len(tmpl) && tmpl[i+1] == '\'':
+			text.WriteString("''")
+			i++
+		case c == '\'':
+			flush()
+			switch {
+			case !hasVars:
+				if len(parts) == 0 {
+					parts = []string{"''"}
+				}
+				b.WriteString(parts[0])
+			case len(parts) == 1:
+				b.WriteString(parts[0])
+			case concat == nil:
+				return 0, false
+			default:
+				b.WriteString(concat(parts))
+			}
+			return i, true
+		case c == '%' && i+1 < len(tmpl) && tmpl[i+1] == '%':
+			text.WriteByte('%')
+			i++
+		case c == '%':
+			token := expand.TokenAt(tmpl, i)
+			if token == "" {
+				return 0, false
+			}
+			flush()
+			cq.vars = append(cq.vars, token)
+			parts = append(parts, placeholder(len(cq.vars)))
+			hasVars = true
+			i += len(token) - 1
+		default:
+			text.WriteByte(c)
+		}
+	}
+	// Unterminated literal.
+	return 0, false
+}
+
+// compileCached returns the compiled template, nil if it can not be
+// compiled. Results are cached.
+func (db *DB) compileCached(tmpl string) *compiledQuery {
+	db.stmtsLock.Lock()
+	defer db.stmtsLock.Unlock()
+	if db.compiled == nil {
+		db.compiled = map[string]*compiledQuery{}
+	}
+	if cq, ok := db.compiled[tmpl]; ok {
+		return cq
+	}
+	var res *compiledQuery
+	if cq, ok := compile(tmpl, db.Placeholder, db.Concat); ok {
+		res = &cq
+	}
+	db.compiled[tmpl] = res
+	return res
+}
+
+func (db *DB) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	db.stmtsLock.Lock()
+	defer db.stmtsLock.Unlock()
+	if db.stmts == nil {
+		db.stmts = map[string]*sql.Stmt{}
+	}
+	if stmt, ok := db.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.DB.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	db.stmts[query] = stmt
+	return stmt, nil
+}
+
+// query runs the query template and returns the first result row as
+// a map. Missing row is reported as ErrUserUnknown.
+func (db *DB) query(ctx context.Context, tmpl string, req *dovecotsasl.AuthReq, user string) (map[string]string, error) {
+	vars := req.Vars(user)
+
+	var rows *sql.Rows
+	if cq := db.compileCached(tmpl); cq != nil {
+		stmt, err := db.stmt(ctx, cq.query)
+		if err != nil {
+			return nil, dovecotsasl.PassdbInternalError(err)
+		}
+		args := make([]interface{}, len(cq.vars))
+		for i, token := range cq.vars {
+			args[i] = expand.Expand(token, vars, nil)
+		}
+		rows, err = stmt.QueryContext(ctx, args...)
+		if err != nil {
+			return nil, dovecotsasl.PassdbInternalError(err)
+		}
+	} else {
+		var err error
+		rows, err = db.DB.QueryContext(ctx, expand.Expand(tmpl, vars, db.Escape))
+		if err != nil {
+			return nil, dovecotsasl.PassdbInternalError(err)
+		}
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, dovecotsasl.PassdbInternalError(err)
+		}
+		return nil, dovecotsasl.ErrUserUnknown
+	}
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, dovecotsasl.PassdbInternalError(err)
+	}
+	values := make([]sql.NullString, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, dovecotsasl.PassdbInternalError(err)
+	}
+	if rows.Next() {
+		return nil, dovecotsasl.PassdbInternalError(errors.New("sqldb: query returned multiple rows"))
+	}
+
+	fields := make(map[string]string, len(cols))
+	for i, col := range cols {
+		if values[i].Valid {
+			fields[strings.ToLower(col)] = values[i].String
+		}
+	}
+	return fields, nil
+}
+
+// passwordLookup runs the password query, separating the password field.
+func (db *DB) passwordLookup(ctx context.Context, req *dovecotsasl.AuthReq, user string) (string, *dovecotsasl.PassdbResult, error) {
+	fields, err := db.query(ctx, db.PasswordQuery, req, user)
+	if err != nil {
+		return "", nil, err
+	}
+
+	password, hasPassword := fields["password"]
+	if noscheme, ok := fields["password_noscheme"]; ok {
+		password = "{" + db.DefaultScheme + "}" + noscheme
+		hasPassword = true
+	}
+	res := &dovecotsasl.PassdbResult{
+		User:  fields["user"],
+		Extra: make(map[string]string),
+	}
+	for k, v := range fields {
+		switch k {
+		case "password", "password_noscheme", "user":
+		default:
+			res.Extra[k] = v
+		}
+	}
+	if !hasPassword {
+		if _, ok := res.Extra["nopassword"]; !ok {
+			return "", nil, dovecotsasl.ErrPasswordMismatch
+		}
+	}
+	return password, res, nil
+}
+
+func (db *DB) VerifyPlain(ctx context.Context, req *dovecotsasl.AuthReq, user, pass string) (*dovecotsasl.PassdbResult, error) {
+	password, res, err := db.passwordLookup(ctx, req, user)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := res.Extra["nopassword"]; ok {
+		return res, nil
+	}
+	if err := dovecotsasl.VerifyPassword(password, db.DefaultScheme, pass); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (db *DB) LookupCredentials(ctx context.Context, req *dovecotsasl.AuthReq, user, scheme string) (*dovecotsasl.PassdbResult, error) {
+	password, res, err := db.passwordLookup(ctx, req, user)
+	if err != nil {
+		return nil, err
+	}
+	if password == "" {
+		return nil, dovecotsasl.ErrCredentialsUnavailable
+	}
+	res.Credentials, err = dovecotsasl.PasswordCredentials(password, db.DefaultScheme, scheme)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// LookupUser runs the user query and returns the resulting columns as
+// userdb fields.
+func (db *DB) LookupUser(ctx context.Context, req *dovecotsasl.AuthReq, user string) (map[string]string, error) {
+	if db.UserQuery == "" {
+		return nil, dovecotsasl.PassdbInternalError(errors.New("sqldb: user query is not configured"))
+	}
+	return db.query(ctx, db.UserQuery, req, user)
+}
+
+// Close releases prepared statements. It does not close the underlying
+// sql.DB.
+func (db *DB) Close() error {
+	db.stmtsLock.Lock()
+	defer db.stmtsLock.Unlock()
+	for query, stmt := range db.stmts {
+		stmt.Close()
+		delete(db.stmts, query)
+	}
+	return nil
+}
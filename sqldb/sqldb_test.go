@@ -0,0 +1,156 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In-memory database is per-connection.
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`
+		CREATE TABLE users (
+			username TEXT NOT NULL,
+			domain TEXT NOT NULL,
+			password TEXT,
+			home TEXT,
+			uid INTEGER,
+			quota TEXT
+		);
+		INSERT INTO users VALUES ('foxcpp', 'example.org', '{PLAIN}1234', '/home/foxcpp', 1000, '1G');
+		INSERT INTO users VALUES ('o''neil', 'example.org', '{PLAIN}5678', '/home/oneil', 1001, NULL);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestCompile(t *testing.T) {
+	cq, ok := compile("SELECT password FROM users WHERE username = '%n' AND domain = %{domain} AND x = '100%%'", DollarPlaceholder, ConcatFunc)
+	if !ok {
+		t.Fatal("query is not compiled")
+	}
+	if want := "SELECT password FROM users WHERE username = $1 AND domain = $2 AND x = '100%'"; cq.query != want {
+		t.Errorf("got query %q, want %q", cq.query, want)
+	}
+	if len(cq.vars) != 2 || cq.vars[0] != "%n" || cq.vars[1] != "%{domain}" {
+		t.Errorf("unexpected vars: %v", cq.vars)
+	}
+
+	cq, ok = compile("SELECT password FROM users WHERE username = '%n@%d' AND x = 'it''s' AND y = ''", DollarPlaceholder, ConcatFunc)
+	if !ok {
+		t.Fatal("query is not compiled")
+	}
+	if want := "SELECT password FROM users WHERE username = CONCAT($1, '@', $2) AND x = 'it''s' AND y = ''"; cq.query != want {
+		t.Errorf("got query %q, want %q", cq.query, want)
+	}
+	if len(cq.vars) != 2 || cq.vars[0] != "%n" || cq.vars[1] != "%d" {
+		t.Errorf("unexpected vars: %v", cq.vars)
+	}
+
+	if _, ok := compile("SELECT password FROM users WHERE username = '%n@%d'", QuestionPlaceholder, nil); ok {
+		t.Error("variables inside literal are compiled without concat")
+	}
+
+	cq, ok = compile(`SELECT "it's" AS "x""y", password FROM users WHERE username = '%n'`, DollarPlaceholder, ConcatFunc)
+	if !ok {
+		t.Fatal("query is not compiled")
+	}
+	if want := `SELECT "it's" AS "x""y", password FROM users WHERE username = $1`; cq.query != want {
+		t.Errorf("got query %q, want %q", cq.query, want)
+	}
+	for _, tmpl := range []string{
+		`SELECT password FROM users WHERE username = "%u"`,
+		`SELECT password FROM users WHERE username = "%n@%d"`,
+		`SELECT password FROM users WHERE username = "%u`,
+	} {
+		if _, ok := compile(tmpl, QuestionPlaceholder, ConcatFunc); ok {
+			t.Errorf("%s: variables inside double quotes are compiled", tmpl)
+		}
+	}
+}
+
+func TestCompileCached(t *testing.T) {
+	db := New(nil)
+	tmpl := "SELECT password FROM users WHERE username = '%u'"
+	cq := db.compileCached(tmpl)
+	if cq == nil {
+		t.Fatal("query is not compiled")
+	}
+	if db.compileCached(tmpl) != cq {
+		t.Error("compiled query is not cached")
+	}
+	if db.compileCached(`SELECT password FROM users WHERE username = "%u"`) != nil {
+		t.Error("query with variables inside double quotes is compiled")
+	}
+}
+
+func TestSQL(t *testing.T) {
+	for _, test := range []struct {
+		query  string
+		concat func([]string) string
+		escape func(string) string
+	}{
+		{"SELECT username || '@' || domain AS user, password, quota FROM users WHERE username = '%n' AND domain = '%d'", ConcatOperator, EscapeString},
+		{`SELECT username || '@' || domain AS "user", password, quota FROM "users" WHERE username = '%n' AND domain = '%d'`, ConcatOperator, EscapeString},
+		{"SELECT username || '@' || domain AS user, password, quota FROM users WHERE username || '@' || domain = '%n@%d'", ConcatOperator, EscapeString},
+		// Substitution into the query text.
+		{"SELECT username || '@' || domain AS user, password, quota FROM users WHERE username || '@' || domain = '%n@%d'", nil, EscapeString},
+		{"SELECT username || '@' || domain AS user, password, quota FROM users WHERE username || '@' || domain = '%n@%d'", nil, EscapeStandardString},
+	} {
+		db := New(testDB(t))
+		db.PasswordQuery = test.query
+		db.Concat = test.concat
+		db.Escape = test.escape
+		db.UserQuery = "SELECT home, uid FROM users WHERE username = '%n' AND domain = '%d'"
+		ctx := context.Background()
+
+		res, err := db.VerifyPlain(ctx, nil, "foxcpp@example.org", "1234")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.User != "foxcpp@example.org" || res.Extra["quota"] != "1G" {
+			t.Errorf("unexpected result: %+v", res)
+		}
+		if _, err := db.VerifyPlain(ctx, nil, "foxcpp@example.org", "5678"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+			t.Errorf("expected password mismatch, got %v", err)
+		}
+		if _, err := db.VerifyPlain(ctx, nil, "o'neil@example.org", "5678"); err != nil {
+			t.Errorf("quote in username: %v", err)
+		}
+		if _, err := db.VerifyPlain(ctx, nil, "nobody@example.org", "1234"); !errors.Is(err, dovecotsasl.ErrUserUnknown) {
+			t.Errorf("expected unknown user, got %v", err)
+		}
+		if _, err := db.VerifyPlain(ctx, nil, `x\' OR 1=1 OR 'a@example.org`, "1234"); !errors.Is(err, dovecotsasl.ErrUserUnknown) {
+			t.Errorf("expected unknown user for injection attempt, got %v", err)
+		}
+
+		creds, err := db.LookupCredentials(ctx, nil, "foxcpp@example.org", "PLAIN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(creds.Credentials) != "1234" {
+			t.Errorf("got credentials %q, want %q", creds.Credentials, "1234")
+		}
+
+		fields, err := db.LookupUser(ctx, nil, "foxcpp@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fields["home"] != "/home/foxcpp" || fields["uid"] != "1000" {
+			t.Errorf("unexpected userdb fields: %v", fields)
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,62 @@
+// Package staticdb implements userdb backend returning the same fields for
+// all users, similar to Dovecot's static userdb.
+//
+// Field values are templates using Dovecot variables (%u, %n, %d, ...),
+// e.g. home=/var/vmail/%d/%n.
+package staticdb
+
+import (
+	"context"
+	"strings"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	"github.com/foxcpp/go-dovecot-sasl/expand"
+)
+
+// DB is the static userdb. It implements dovecotsasl.Userdb.
+type DB struct {
+	// Field templates.
+	Fields map[string]string
+
+	// If not nil, user existence is checked using a credentials lookup.
+	// The passdb must be able to tell whether the user exists (see
+	// dovecotsasl.ErrCredentialsUnavailable), ErrSchemeNotAvailable
+	// without it is considered a missing user. If nil, all users are
+	// accepted (allow_all_users=yes in Dovecot).
+	Passdb dovecotsasl.Passdb
+}
+
+// New creates the userdb from Dovecot-style args, e.g.
+// "uid=vmail gid=vmail home=/var/vmail/%d/%n". Fields without a value
+// are set to an empty string.
+func New(args string) *DB {
+	db := &DB{Fields: make(map[string]string)}
+	for _, field := range strings.Fields(args) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) == 1 {
+			db.Fields[parts[0]] = ""
+			continue
+		}
+		db.Fields[parts[0]] = parts[1]
+	}
+	return db
+}
+
+func (db *DB) LookupUser(ctx context.Context, req *dovecotsasl.AuthReq, user string) (map[string]string, error) {
+	if db.Passdb != nil {
+		_, err := db.Passdb.LookupCredentials(ctx, req, user, "PLAIN")
+		if dovecotsasl.PassdbStatusOf(err) == dovecotsasl.PassdbInternalFailure {
+			return nil, err
+		}
+		if !dovecotsasl.PassdbUserFound(err) {
+			return nil, dovecotsasl.ErrUserUnknown
+		}
+	}
+
+	vars := req.Vars(user)
+	fields := make(map[string]string, len(db.Fields))
+	for k, tmpl := range db.Fields {
+		fields[k] = expand.Expand(tmpl, vars, nil)
+	}
+	return fields, nil
+}
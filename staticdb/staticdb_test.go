@@ -0,0 +1,56 @@
+package staticdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+)
+
+// testPassdb returns ErrCredentialsUnavailable for known users, users with
+// "?" are reported as if the passdb could not tell whether they exist.
+type testPassdb map[string]string
+
+func (db testPassdb) VerifyPlain(context.Context, *dovecotsasl.AuthReq, string, string) (*dovecotsasl.PassdbResult, error) {
+	return nil, dovecotsasl.ErrSchemeNotAvailable
+}
+
+func (db testPassdb) LookupCredentials(_ context.Context, _ *dovecotsasl.AuthReq, user, _ string) (*dovecotsasl.PassdbResult, error) {
+	pass, ok := db[user]
+	if !ok {
+		return nil, dovecotsasl.ErrUserUnknown
+	}
+	if pass == "?" {
+		return nil, dovecotsasl.ErrSchemeNotAvailable
+	}
+	return nil, dovecotsasl.ErrCredentialsUnavailable
+}
+
+func TestStatic(t *testing.T) {
+	db := New("uid=vmail gid=vmail home=/var/vmail/%d/%n nologin")
+	ctx := context.Background()
+	req := &dovecotsasl.AuthReq{Service: "imap"}
+
+	fields, err := db.LookupUser(ctx, req, "foxcpp@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["home"] != "/var/vmail/example.org/foxcpp" || fields["uid"] != "vmail" || fields["gid"] != "vmail" {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+	if _, ok := fields["nologin"]; !ok {
+		t.Errorf("flag field is lost: %v", fields)
+	}
+
+	db.Passdb = testPassdb{"foxcpp@example.org": "", "bind@example.org": "?"}
+	if _, err := db.LookupUser(ctx, req, "foxcpp@example.org"); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.LookupUser(ctx, req, "nobody@example.org"); !errors.Is(err, dovecotsasl.ErrUserUnknown) {
+		t.Errorf("expected unknown user, got %v", err)
+	}
+	if _, err := db.LookupUser(ctx, req, "bind@example.org"); !errors.Is(err, dovecotsasl.ErrUserUnknown) {
+		t.Errorf("expected unknown user if passdb can not tell, got %v", err)
+	}
+}
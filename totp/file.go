@@ -0,0 +1,106 @@
+package totp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore keeps enrollments in a JSON file as an object mapping
+// usernames to enrollments.
+//
+// The file is read on each lookup and replaced atomically on changes.
+type FileStore struct {
+	Path string
+
+	lock sync.Mutex
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+func (s *FileStore) load() (map[string]*Enrollment, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]*Enrollment{}, nil
+		}
+		return nil, err
+	}
+	users := map[string]*Enrollment{}
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *FileStore) save(users map[string]*Enrollment) error {
+	data, err := json.MarshalIndent(users, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+func (s *FileStore) Enrollment(_ context.Context, user string) (*Enrollment, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	users, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return users[user], nil
+}
+
+func (s *FileStore) SetEnrollment(_ context.Context, user string, e *Enrollment) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	users, err := s.load()
+	if err != nil {
+		return err
+	}
+	users[user] = e
+	return s.save(users)
+}
+
+func (s *FileStore) DeleteEnrollment(_ context.Context, user string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	users, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := users[user]; !ok {
+		return nil
+	}
+	delete(users, user)
+	return s.save(users)
+}
@@ -0,0 +1,370 @@
+// Package totp implements TOTP (RFC 6238) second factor for plaintext
+// mechanisms.
+//
+// Since clients like SMTP submission agents can not ask for the second
+// factor interactively, the code is appended to the password:
+// "password123456" (or "password:123456" with Separator set to ":").
+//
+// Enrolled users marked as Required must always provide the code, unless
+// the request is exempted by service or source network. Other enrolled
+// users may provide it optionally. Users that are not enrolled are passed
+// to the wrapped passdb as is.
+//
+// Secrets are stored encrypted using AES-GCM with DB.Key. Each code can be
+// used only once per user (used time steps are remembered in memory).
+//
+// If results are cached using authcache, the cache must be wrapped by DB
+// and not the other way around, otherwise a cached password with the code
+// would be accepted again until the cache entry expires.
+package totp
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+)
+
+// Enrollment is the TOTP configuration of a user.
+type Enrollment struct {
+	// Secret encrypted using DB.Key.
+	Secret []byte `json:"secret"`
+
+	// The code is mandatory for the user.
+	Required bool `json:"required"`
+}
+
+// Store keeps enrollments.
+type Store interface {
+	// Enrollment returns the enrollment of the user or nil if the user is
+	// not enrolled.
+	Enrollment(ctx context.Context, user string) (*Enrollment, error)
+
+	SetEnrollment(ctx context.Context, user string, e *Enrollment) error
+
+	DeleteEnrollment(ctx context.Context, user string) error
+}
+
+// DB wraps a Passdb and checks TOTP codes. It implements
+// dovecotsasl.Passdb.
+type DB struct {
+	Passdb dovecotsasl.Passdb
+	Store  Store
+
+	// AES-128, AES-192 or AES-256 key used to encrypt secrets.
+	Key []byte
+
+	// Issuer shown in authenticator applications.
+	Issuer string
+
+	// Separator between the password and the code, empty by default.
+	Separator string
+
+	// Number of digits in codes and the time step, 6 and 30 seconds if
+	// not set.
+	Digits int
+	Period time.Duration
+
+	// Number of time steps before and after the current one to accept, to
+	// allow for clock skew.
+	Skew int
+
+	// Requests for these services (AuthReq.Service) or from these networks
+	// (AuthReq.RemoteIP) do not require the code.
+	ExemptServices []string
+	ExemptNetworks []*net.IPNet
+
+	now func() time.Time
+
+	usedLock sync.Mutex
+	// Last used time step for each user.
+	used map[string]int64
+	// Time step of the last removal of outdated used entries.
+	prunedStep int64
+}
+
+const (
+	defaultDigits = 6
+	defaultPeriod = 30 * time.Second
+)
+
+func New(db dovecotsasl.Passdb, store Store, key []byte) *DB {
+	return &DB{
+		Passdb: db,
+		Store:  store,
+		Key:    key,
+		Issuer: "dovecot-sasl",
+		Digits: defaultDigits,
+		Period: defaultPeriod,
+		Skew:   1,
+	}
+}
+
+func (db *DB) clock() time.Time {
+	if db.now == nil {
+		return time.Now()
+	}
+	return db.now()
+}
+
+func (db *DB) digits() int {
+	if db.Digits <= 0 {
+		return defaultDigits
+	}
+	return db.Digits
+}
+
+// period returns the time step in seconds.
+func (db *DB) period() int64 {
+	if db.Period < time.Second {
+		return int64(defaultPeriod / time.Second)
+	}
+	return int64(db.Period / time.Second)
+}
+
+func (db *DB) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(db.Key)
+	if err != nil {
+		return nil, fmt.Errorf("totp: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func (db *DB) encrypt(user string, secret []byte) ([]byte, error) {
+	aead, err := db.aead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// Username is authenticated to prevent moving secrets between users.
+	return aead.Seal(nonce, nonce, secret, []byte(user)), nil
+}
+
+func (db *DB) decrypt(user string, sealed []byte) ([]byte, error) {
+	aead, err := db.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("totp: malformed encrypted secret")
+	}
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(user))
+	if err != nil {
+		return nil, fmt.Errorf("totp: failed to decrypt secret: %w", err)
+	}
+	return secret, nil
+}
+
+// Enroll generates a new secret for the user and returns the otpauth://
+// URI for authenticator applications. The previous secret, if any, is
+// replaced.
+func (db *DB) Enroll(ctx context.Context, user string, required bool) (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	sealed, err := db.encrypt(user, secret)
+	if err != nil {
+		return "", err
+	}
+	if err := db.Store.SetEnrollment(ctx, user, &Enrollment{Secret: sealed, Required: required}); err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("secret", base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret))
+	params.Set("issuer", db.Issuer)
+	params.Set("digits", strconv.Itoa(db.digits()))
+	params.Set("period", strconv.FormatInt(db.period(), 10))
+	label := url.PathEscape(db.Issuer + ":" + user)
+	return "otpauth://totp/" + label + "?" + params.Encode(), nil
+}
+
+// Unenroll removes the secret of the user.
+func (db *DB) Unenroll(ctx context.Context, user string) error {
+	return db.Store.DeleteEnrollment(ctx, user)
+}
+
+// code computes the TOTP code for the time step.
+func (db *DB) code(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < db.digits(); i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", db.digits(), value%mod)
+}
+
+// checkCode verifies the code and marks it as used. It returns false if the
+// code is invalid or was already used.
+func (db *DB) checkCode(user string, secret []byte, code string) bool {
+	current := db.clock().Unix() / db.period()
+
+	db.usedLock.Lock()
+	defer db.usedLock.Unlock()
+
+	if db.used == nil {
+		db.used = make(map[string]int64)
+	}
+	db.prune(current)
+
+	for step := current - int64(db.Skew); step <= current+int64(db.Skew); step++ {
+		if step <= db.used[user] {
+			continue
+		}
+		if hmac.Equal([]byte(db.code(secret, step)), []byte(code)) {
+			db.used[user] = step
+			return true
+		}
+	}
+	return false
+}
+
+// prune removes used steps that are outside of the accepted window, at most
+// once per time step. It is called with usedLock held.
+func (db *DB) prune(current int64) {
+	if current == db.prunedStep {
+		return
+	}
+	db.prunedStep = current
+	for user, step := range db.used {
+		if step < current-int64(db.Skew) {
+			delete(db.used, user)
+		}
+	}
+}
+
+// splitCode splits the code from the password. ok is false if pass does
+// not end with a code.
+func (db *DB) splitCode(pass string) (base, code string, ok bool) {
+	digits := db.digits()
+	if len(pass) < digits+len(db.Separator) {
+		return "", "", false
+	}
+	code = pass[len(pass)-digits:]
+	for _, ch := range code {
+		if ch < '0' || ch > '9' {
+			return "", "", false
+		}
+	}
+	base = pass[:len(pass)-digits]
+	if !strings.HasSuffix(base, db.Separator) {
+		return "", "", false
+	}
+	return strings.TrimSuffix(base, db.Separator), code, true
+}
+
+// exempt reports whether the request does not require the code.
+func (db *DB) exempt(req *dovecotsasl.AuthReq) bool {
+	if req == nil {
+		return false
+	}
+	for _, s := range db.ExemptServices {
+		if strings.EqualFold(s, req.Service) {
+			return true
+		}
+	}
+	if req.RemoteIP != nil {
+		for _, n := range db.ExemptNetworks {
+			if n.Contains(req.RemoteIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// enrollment returns the user enrollment and whether the code is
+// required for the request.
+func (db *DB) enrollment(ctx context.Context, req *dovecotsasl.AuthReq, user string) (*Enrollment, bool, error) {
+	e, err := db.Store.Enrollment(ctx, user)
+	if err != nil {
+		return nil, false, dovecotsasl.PassdbInternalError(err)
+	}
+	if e == nil {
+		return nil, false, nil
+	}
+	return e, e.Required && !db.exempt(req), nil
+}
+
+func (db *DB) VerifyPlain(ctx context.Context, req *dovecotsasl.AuthReq, user, pass string) (*dovecotsasl.PassdbResult, error) {
+	e, required, err := db.enrollment(ctx, req, user)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return db.Passdb.VerifyPlain(ctx, req, user, pass)
+	}
+
+	base, code, ok := db.splitCode(pass)
+	if ok {
+		res, err := db.Passdb.VerifyPlain(ctx, req, user, base)
+		if err == nil {
+			secret, err := db.decrypt(user, e.Secret)
+			if err != nil {
+				return nil, dovecotsasl.PassdbInternalError(err)
+			}
+			if db.checkCode(user, secret, code) {
+				return res, nil
+			}
+			if required {
+				return nil, &dovecotsasl.PassdbError{
+					Status: dovecotsasl.PassdbPasswordMismatch,
+					Reason: "invalid or reused TOTP code",
+				}
+			}
+		} else if required || dovecotsasl.PassdbStatusOf(err) != dovecotsasl.PassdbPasswordMismatch {
+			return nil, err
+		}
+	}
+	if required {
+		return nil, &dovecotsasl.PassdbError{
+			Status: dovecotsasl.PassdbPasswordMismatch,
+			Reason: "TOTP code is required",
+		}
+	}
+
+	// The code is optional and the password may end with digits itself.
+	return db.Passdb.VerifyPlain(ctx, req, user, pass)
+}
+
+// LookupCredentials passes the lookup to the wrapped passdb unless the
+// code is required. Non-plaintext mechanisms can not be used then, since
+// the code can not be checked.
+func (db *DB) LookupCredentials(ctx context.Context, req *dovecotsasl.AuthReq, user, scheme string) (*dovecotsasl.PassdbResult, error) {
+	_, required, err := db.enrollment(ctx, req, user)
+	if err != nil {
+		return nil, err
+	}
+	if required {
+		return nil, &dovecotsasl.PassdbError{
+			Status: dovecotsasl.PassdbSchemeNotAvailable,
+			Reason: "TOTP code is required",
+		}
+	}
+	return db.Passdb.LookupCredentials(ctx, req, user, scheme)
+}
@@ -0,0 +1,219 @@
+package totp
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	"github.com/foxcpp/go-dovecot-sasl/pwscheme"
+)
+
+type testPassdb map[string]string
+
+func (db testPassdb) VerifyPlain(_ context.Context, _ *dovecotsasl.AuthReq, user, pass string) (*dovecotsasl.PassdbResult, error) {
+	stored, ok := db[user]
+	if !ok {
+		return nil, dovecotsasl.ErrUserUnknown
+	}
+	if err := dovecotsasl.VerifyPassword(stored, "PLAIN", pass); err != nil {
+		return nil, err
+	}
+	return &dovecotsasl.PassdbResult{}, nil
+}
+
+func (db testPassdb) LookupCredentials(_ context.Context, _ *dovecotsasl.AuthReq, user, scheme string) (*dovecotsasl.PassdbResult, error) {
+	stored, ok := db[user]
+	if !ok {
+		return nil, dovecotsasl.ErrUserUnknown
+	}
+	creds, err := pwscheme.Credentials(stored, "PLAIN", scheme)
+	if err != nil {
+		return nil, err
+	}
+	return &dovecotsasl.PassdbResult{Credentials: creds}, nil
+}
+
+func TestCode(t *testing.T) {
+	// RFC 6238 test vector.
+	db := New(nil, nil, nil)
+	db.Digits = 8
+	if code := db.code([]byte("12345678901234567890"), 59/30); code != "94287082" {
+		t.Errorf("unexpected code: %s", code)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totp-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	now := time.Unix(1600000000, 0)
+	db := New(testPassdb{"required": "pass", "optional": "pass123", "plain": "pass"},
+		NewFileStore(filepath.Join(dir, "totp.json")), []byte("0123456789abcdef"))
+	db.now = func() time.Time { return now }
+	db.ExemptServices = []string{"sieve"}
+	_, localNet, _ := net.ParseCIDR("10.0.0.0/8")
+	db.ExemptNetworks = []*net.IPNet{localNet}
+
+	secretOf := func(user string, required bool) []byte {
+		t.Helper()
+		uri, err := db.Enroll(ctx, user, required)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(u.Query().Get("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return secret
+	}
+	requiredSecret := secretOf("required", true)
+	optionalSecret := secretOf("optional", false)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "totp.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), base32.StdEncoding.EncodeToString(requiredSecret)) {
+		t.Error("secret is stored unencrypted")
+	}
+
+	imap := &dovecotsasl.AuthReq{Service: "imap", RemoteIP: net.IPv4(192, 0, 2, 1)}
+	step := now.Unix() / 30
+
+	if _, err := db.VerifyPlain(ctx, imap, "required", "pass"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("missing code is accepted: %v", err)
+	}
+	code := db.code(requiredSecret, step)
+	if _, err := db.VerifyPlain(ctx, imap, "required", "wrong"+code); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("wrong password is accepted: %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, imap, "required", "pass"+code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.VerifyPlain(ctx, imap, "required", "pass"+code); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("code replay is accepted: %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, imap, "required", "pass"+db.code(requiredSecret, step-1)); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("code older than the last used one is accepted: %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, imap, "required", "pass"+db.code(requiredSecret, step+1)); err != nil {
+		t.Errorf("code within skew window is rejected: %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, imap, "required", "pass"+db.code(requiredSecret, step+3)); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("code outside of skew window is accepted: %v", err)
+	}
+	if _, err := db.LookupCredentials(ctx, imap, "required", "SCRAM-SHA-256"); !errors.Is(err, dovecotsasl.ErrSchemeNotAvailable) {
+		t.Errorf("credentials are returned for user with required code: %v", err)
+	}
+
+	// Exemptions.
+	if _, err := db.VerifyPlain(ctx, &dovecotsasl.AuthReq{Service: "sieve"}, "required", "pass"); err != nil {
+		t.Errorf("exempted service: %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, &dovecotsasl.AuthReq{Service: "imap", RemoteIP: net.IPv4(10, 1, 2, 3)}, "required", "pass"); err != nil {
+		t.Errorf("exempted network: %v", err)
+	}
+
+	// Optional code, the password itself ends with digits.
+	if _, err := db.VerifyPlain(ctx, imap, "optional", "pass123"); err != nil {
+		t.Errorf("optional code: %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, imap, "optional", "pass123"+db.code(optionalSecret, step)); err != nil {
+		t.Errorf("optional code: %v", err)
+	}
+	if _, err := db.VerifyPlain(ctx, imap, "optional", "pass123000000"); !errors.Is(err, dovecotsasl.ErrPasswordMismatch) {
+		t.Errorf("wrong optional code is accepted: %v", err)
+	}
+
+	// Not enrolled.
+	if _, err := db.VerifyPlain(ctx, imap, "plain", "pass"); err != nil {
+		t.Error(err)
+	}
+
+	// Secrets can not be moved between users.
+	e, err := db.Store.Enrollment(ctx, "required")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Store.SetEnrollment(ctx, "plain", e); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.VerifyPlain(ctx, imap, "plain", "pass"+db.code(requiredSecret, step)); dovecotsasl.PassdbStatusOf(err) != dovecotsasl.PassdbInternalFailure {
+		t.Errorf("secret of another user is accepted: %v", err)
+	}
+
+	if err := db.Unenroll(ctx, "required"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.VerifyPlain(ctx, imap, "required", "pass"); err != nil {
+		t.Errorf("unenrolled user: %v", err)
+	}
+}
+
+func TestZeroValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totp-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	db := &DB{
+		Passdb: testPassdb{"user": "pass"},
+		Store:  NewFileStore(filepath.Join(dir, "totp.json")),
+		Key:    []byte("0123456789abcdef"),
+	}
+	if _, err := db.Enroll(ctx, "user", true); err != nil {
+		t.Fatal(err)
+	}
+	e, err := db.Store.Enrollment(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := db.decrypt("user", e.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := db.code(secret, time.Now().Unix()/30)
+	if len(code) != 6 {
+		t.Errorf("unexpected code length: %q", code)
+	}
+	if _, err := db.VerifyPlain(ctx, nil, "user", "pass"+code); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUsedPruning(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	db := New(nil, nil, nil)
+	db.now = func() time.Time { return now }
+
+	secret := []byte("12345678901234567890")
+	step := now.Unix() / 30
+	if !db.checkCode("user", secret, db.code(secret, step)) {
+		t.Fatal("valid code is rejected")
+	}
+	now = now.Add(time.Hour)
+	db.checkCode("other", secret, "000000")
+	if _, ok := db.used["user"]; ok {
+		t.Error("outdated used step is not removed")
+	}
+}
@@ -0,0 +1,350 @@
+package dovecotsasl
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+// Upstream forwards authentication requests to another Dovecot auth server
+// (or another Server) using a pool of client connections.
+//
+// It can be used as a Passdb (only VerifyPlain is supported) or to proxy
+// whole SASL exchanges for any mechanism offered by the upstream server, see
+// Server.AddUpstreamMechanisms.
+type Upstream struct {
+	// Dial opens a new connection to the upstream auth socket.
+	Dial func() (net.Conn, error)
+
+	// Maximum number of connections to the upstream server. Each connection
+	// is used by one exchange at a time. Idle connections are reused, if
+	// one turns out to be closed, the request is retried once on a new
+	// connection.
+	MaxConns int
+
+	// Timeout for each upstream reply.
+	Timeout time.Duration
+
+	initOnce sync.Once
+	idle     chan *Client
+	sem      chan struct{}
+}
+
+func NewUpstream(network, address string) *Upstream {
+	return &Upstream{
+		Dial: func() (net.Conn, error) {
+			return net.DialTimeout(network, address, 10*time.Second)
+		},
+		MaxConns: 8,
+		Timeout:  30 * time.Second,
+	}
+}
+
+func (u *Upstream) init() {
+	size := u.MaxConns
+	if size <= 0 {
+		size = 1
+	}
+	u.idle = make(chan *Client, size)
+	u.sem = make(chan struct{}, size)
+}
+
+// get returns an idle connection or opens a new one, blocking if the
+// connection limit is reached. reused is true for idle connections, unless
+// fresh is set and a new connection is always opened.
+func (u *Upstream) get(ctx context.Context, fresh bool) (cl *Client, reused bool, err error) {
+	u.initOnce.Do(u.init)
+
+	if !fresh {
+		select {
+		case cl := <-u.idle:
+			return cl, true, nil
+		default:
+		}
+	}
+
+	idle := u.idle
+	if fresh {
+		// Receiving from nil channel blocks forever.
+		idle = nil
+	}
+	select {
+	case cl := <-idle:
+		return cl, true, nil
+	case u.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+
+	netConn, err := u.Dial()
+	if err != nil {
+		<-u.sem
+		return nil, false, err
+	}
+	if u.Timeout != 0 {
+		netConn.SetDeadline(time.Now().Add(u.Timeout))
+	}
+	cl, err = NewClient(netConn)
+	if err != nil {
+		netConn.Close()
+		<-u.sem
+		return nil, false, err
+	}
+	return cl, false, nil
+}
+
+// put returns the connection to the pool. Broken connections (or
+// connections with an unfinished exchange) are closed.
+func (u *Upstream) put(cl *Client, broken bool) {
+	if broken {
+		cl.Close()
+		<-u.sem
+		return
+	}
+	cl.c.C.SetDeadline(time.Time{})
+	select {
+	case u.idle <- cl:
+	default:
+		cl.Close()
+		<-u.sem
+	}
+}
+
+// Mechanisms returns mechanisms advertised by the upstream server.
+func (u *Upstream) Mechanisms(ctx context.Context) (map[string]Mechanism, error) {
+	cl, _, err := u.get(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	mechs := cl.ConnInfo().Mechs
+	u.put(cl, false)
+	return mechs, nil
+}
+
+// Close closes idle connections.
+func (u *Upstream) Close() error {
+	u.initOnce.Do(u.init)
+	for {
+		select {
+		case cl := <-u.idle:
+			cl.Close()
+			<-u.sem
+		default:
+			return nil
+		}
+	}
+}
+
+// Handler returns the mechanism implementation that forwards the exchange
+// to the upstream server as is. Request parameters are preserved, OK and
+// FAIL fields are relayed to the client.
+func (u *Upstream) Handler() FuncSASLHandler {
+	return func(req *AuthReq, cb FuncSASLCallback) sasl.Server {
+		return &upstreamServer{u: u, req: req, cb: cb}
+	}
+}
+
+type upstreamServer struct {
+	u   *Upstream
+	req *AuthReq
+	cb  FuncSASLCallback
+
+	cl  *Client
+	rid string
+
+	// release returns the upstream connection to the pool, set by attach.
+	release func(broken bool)
+}
+
+// attach makes cl the connection used for the exchange.
+func (s *upstreamServer) attach(cl *Client) {
+	var (
+		once     sync.Once
+		finished = make(chan struct{})
+	)
+	release := func(broken bool) {
+		once.Do(func() {
+			close(finished)
+			s.u.put(cl, broken)
+		})
+	}
+	s.cl = cl
+	s.release = release
+
+	// The exchange may be abandoned by the client, the connection can't be
+	// reused in this case.
+	go func() {
+		select {
+		case <-s.req.Context().Done():
+			release(true)
+		case <-finished:
+		}
+	}()
+}
+
+// begin starts the exchange and returns the first reply. An idle
+// connection may have been closed by the upstream server in the meantime,
+// so the request is retried once on a new connection if a reused one
+// fails.
+func (s *upstreamServer) begin(resp []byte) (string, []string, error) {
+	fresh := false
+	for {
+		cl, reused, err := s.u.get(s.req.Context(), fresh)
+		if err != nil {
+			return "", nil, err
+		}
+		s.attach(cl)
+
+		s.setDeadline()
+		s.rid, err = cl.start(s.req.Mechanism, resp, s.req.params())
+		if err == nil {
+			var (
+				cmd    string
+				params []string
+			)
+			cmd, params, err = cl.reply(s.rid)
+			if err == nil {
+				return cmd, params, nil
+			}
+		}
+		s.release(true)
+		if !reused || fresh || s.req.Context().Err() != nil {
+			return "", nil, err
+		}
+		fresh = true
+	}
+}
+
+func (s *upstreamServer) Next(resp []byte) ([]byte, bool, error) {
+	var (
+		cmd    string
+		params []string
+		err    error
+	)
+	if s.cl == nil {
+		cmd, params, err = s.begin(resp)
+		if err != nil {
+			return nil, false, PassdbInternalError(fmt.Errorf("dovecotsasl: upstream: %w", err))
+		}
+	} else {
+		s.setDeadline()
+		if err := s.cl.cont(s.rid, resp); err != nil {
+			s.release(true)
+			return nil, false, PassdbInternalError(fmt.Errorf("dovecotsasl: upstream: %w", err))
+		}
+		cmd, params, err = s.cl.reply(s.rid)
+		if err != nil {
+			s.release(true)
+			return nil, false, PassdbInternalError(fmt.Errorf("dovecotsasl: upstream: %w", err))
+		}
+	}
+
+	switch cmd {
+	case "CONT":
+		challenge, err := base64.StdEncoding.DecodeString(params[1])
+		if err != nil {
+			s.release(true)
+			return nil, false, PassdbInternalError(fmt.Errorf("dovecotsasl: upstream: malformed challenge: %v", err))
+		}
+		return challenge, false, nil
+	case "FAIL":
+		s.release(false)
+		return nil, false, parseFail(params)
+	default: // OK
+		s.release(false)
+		ao := parseOk(params)
+		var final []byte
+		if resp, ok := ao.Extra["resp"]; ok {
+			delete(ao.Extra, "resp")
+			final, err = base64.StdEncoding.DecodeString(resp)
+			if err != nil {
+				return nil, false, PassdbInternalError(fmt.Errorf("dovecotsasl: upstream: malformed success data: %v", err))
+			}
+		}
+		for k, v := range ao.Userdb {
+			ao.Extra[userdbPrefix+k] = v
+		}
+		s.cb(ao.UserID, ao.Extra)
+		return final, true, nil
+	}
+}
+
+func (s *upstreamServer) setDeadline() {
+	if s.u.Timeout != 0 {
+		s.cl.c.C.SetDeadline(time.Now().Add(s.u.Timeout))
+	}
+}
+
+// passdbFromFail converts the upstream failure into the passdb error.
+func passdbFromFail(af AuthFail) error {
+	pe := &PassdbError{
+		Status: PassdbPasswordMismatch,
+		Reason: af.Reason,
+		Extra:  af.Extra,
+	}
+	switch af.Code {
+	case TempFail:
+		pe.Status = PassdbInternalFailure
+		pe.Err = af
+	case UserDisabled:
+		pe.Status = PassdbUserDisabled
+	case PassExpired:
+		pe.Status = PassdbPassExpired
+	}
+	return pe
+}
+
+// VerifyPlain checks the password using PLAIN mechanism of the upstream
+// server.
+func (u *Upstream) VerifyPlain(ctx context.Context, req *AuthReq, user, pass string) (*PassdbResult, error) {
+	upReq := AuthReq{ctx: ctx}
+	if req != nil {
+		upReq = *req
+		upReq.ctx = ctx
+	}
+	upReq.Mechanism = "PLAIN"
+
+	var res *PassdbResult
+	s := &upstreamServer{u: u, req: &upReq, cb: func(userID string, extra map[string]string) {
+		res = &PassdbResult{User: userID, Extra: extra}
+	}}
+	_, done, err := s.Next([]byte("\x00" + user + "\x00" + pass))
+	if err != nil {
+		var af AuthFail
+		if errors.As(err, &af) {
+			return nil, passdbFromFail(af)
+		}
+		return nil, err
+	}
+	if !done {
+		s.release(true)
+		return nil, PassdbInternalError(errors.New("dovecotsasl: upstream: unexpected challenge for PLAIN"))
+	}
+	return res, nil
+}
+
+// LookupCredentials is not supported by the auth protocol and always
+// returns ErrSchemeNotAvailable.
+func (u *Upstream) LookupCredentials(context.Context, *AuthReq, string, string) (*PassdbResult, error) {
+	return nil, ErrSchemeNotAvailable
+}
+
+// AddUpstreamMechanisms registers all mechanisms advertised by the upstream
+// server, forwarding exchanges using u.Handler.
+func (s *Server) AddUpstreamMechanisms(ctx context.Context, u *Upstream) error {
+	mechs, err := u.Mechanisms(ctx)
+	if err != nil {
+		return err
+	}
+	handler := u.Handler()
+	for name, info := range mechs {
+		s.AddMechanism(name, info, handler)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package dovecotsasl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+)
+
+// ripPassdb records the remote IP seen by the backend.
+type ripPassdb struct {
+	testPassdb
+	rip chan net.IP
+}
+
+func (db ripPassdb) VerifyPlain(ctx context.Context, req *AuthReq, user, pass string) (*PassdbResult, error) {
+	db.rip <- req.RemoteIP
+	return db.testPassdb.VerifyPlain(ctx, req, user, pass)
+}
+
+func TestUpstream(t *testing.T) {
+	backendDB := ripPassdb{
+		testPassdb: testPassdb{"foxcpp": "1234", "blocked": "disabled"},
+		rip:        make(chan net.IP, 10),
+	}
+	backend := NewServer()
+	backend.AddPassdbMechanisms(backendDB)
+	defer backend.Close()
+	backendL := testListener(t)
+	go backend.Serve(backendL)
+
+	u := NewUpstream(backendL.Addr().Network(), backendL.Addr().String())
+	u.MaxConns = 1
+	defer u.Close()
+
+	front := NewServer()
+	if err := front.AddUpstreamMechanisms(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	defer front.Close()
+	frontL := testListener(t)
+	go front.Serve(frontL)
+
+	cl, err := NewClient(testDial(t, frontL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if _, ok := cl.ConnInfo().Mechs["SCRAM-SHA-256"]; !ok {
+		t.Fatalf("upstream mechanisms are not advertised: %v", cl.ConnInfo().Mechs)
+	}
+
+	// Multi-step exchange with success data.
+	mech, res, err := cl.Authenticate("imap", Credentials{Username: "foxcpp", Password: "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mech != "SCRAM-SHA-256" || res.UserID != "foxcpp" || res.Extra["quota"] != "1G" {
+		t.Errorf("unexpected result: %s %+v", mech, res)
+	}
+
+	// Request parameters are preserved.
+	_, err = cl.Do("imap", sasl.NewPlainClient("", "foxcpp", "1234"),
+		ParamRemoteIP(net.IPv4(192, 0, 2, 1)), ParamSecured(SecuredTLS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rip := <-backendDB.rip; !rip.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("remote IP is not forwarded: %v", rip)
+	}
+
+	// Failure code is relayed.
+	_, err = cl.Do("imap", sasl.NewPlainClient("", "blocked", "1234"))
+	<-backendDB.rip
+	var af AuthFail
+	if !errors.As(err, &af) || af.Code != UserDisabled {
+		t.Errorf("expected user_disabled failure, got %v", err)
+	}
+
+	// Passdb interface.
+	pres, err := u.VerifyPlain(context.Background(), &AuthReq{Service: "imap"}, "foxcpp", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-backendDB.rip
+	if pres.User != "foxcpp" || pres.Extra["quota"] != "1G" {
+		t.Errorf("unexpected passdb result: %+v", pres)
+	}
+	if _, err := u.VerifyPlain(context.Background(), &AuthReq{Service: "imap"}, "foxcpp", "5678"); !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("expected password mismatch, got %v", err)
+	}
+	<-backendDB.rip
+}
+
+// recordListener sends accepted connections to conns.
+type recordListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l recordListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.conns <- conn
+	}
+	return conn, err
+}
+
+func TestUpstreamStaleConnection(t *testing.T) {
+	backend := NewServer()
+	backend.AddPassdbMechanisms(testPassdb{"foxcpp": "1234"})
+	defer backend.Close()
+	backendL := recordListener{testListener(t), make(chan net.Conn, 10)}
+	go backend.Serve(backendL)
+
+	u := NewUpstream(backendL.Addr().Network(), backendL.Addr().String())
+	u.MaxConns = 1
+	defer u.Close()
+
+	if _, err := u.VerifyPlain(context.Background(), nil, "foxcpp", "1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The upstream server closes the idle connection.
+	(<-backendL.conns).Close()
+
+	if _, err := u.VerifyPlain(context.Background(), nil, "foxcpp", "1234"); err != nil {
+		t.Fatalf("request is not retried on a new connection: %v", err)
+	}
+	if _, err := u.VerifyPlain(context.Background(), nil, "foxcpp", "5678"); !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("expected password mismatch, got %v", err)
+	}
+	if len(backendL.conns) != 1 {
+		t.Errorf("expected one new connection, got %d", len(backendL.conns))
+	}
+}
@@ -0,0 +1,77 @@
+package dovecotsasl
+
+import (
+	"context"
+	"strings"
+)
+
+// Userdb is the user information backend, modelled after Dovecot's userdb
+// layer. It provides fields needed by mail processes after the
+// authentication, such as uid, gid, home and mail.
+//
+// ErrUserUnknown should be returned if the user does not exist. Other
+// errors are treated as internal failures.
+type Userdb interface {
+	LookupUser(ctx context.Context, req *AuthReq, user string) (map[string]string, error)
+}
+
+const userdbPrefix = "userdb_"
+
+// prefetchFields returns userdb_* passdb extra fields with the prefix
+// removed.
+func prefetchFields(extra map[string]string) map[string]string {
+	var fields map[string]string
+	for k, v := range extra {
+		if !strings.HasPrefix(k, userdbPrefix) || len(k) == len(userdbPrefix) {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]string)
+		}
+		fields[k[len(userdbPrefix):]] = v
+	}
+	return fields
+}
+
+// PrefetchUserdb returns userdb fields provided by the passdb during the
+// authentication (userdb_* extra fields), similar to Dovecot's prefetch
+// userdb. This avoids a separate userdb lookup if the passdb can return
+// all needed fields at once.
+//
+// If no fields were prefetched (e.g. for master USER lookups), the lookup
+// is passed to Next. ErrUserUnknown is returned if Next is nil.
+type PrefetchUserdb struct {
+	Next Userdb
+}
+
+func (p PrefetchUserdb) LookupUser(ctx context.Context, req *AuthReq, user string) (map[string]string, error) {
+	if req != nil {
+		if fields := prefetchFields(req.passdbExtra); fields != nil {
+			return fields, nil
+		}
+	}
+	if p.Next == nil {
+		return nil, ErrUserUnknown
+	}
+	return p.Next.LookupUser(ctx, req, user)
+}
+
+// lookupUserdb runs the userdb lookup after the successful authentication
+// and attaches the result to ao. Prefetched userdb_* fields are left out
+// of extra fields, the original map is not modified.
+func lookupUserdb(ctx context.Context, db Userdb, req *AuthReq, ao *AuthOK) error {
+	req.passdbExtra = ao.Extra
+	fields, err := db.LookupUser(ctx, req, ao.UserID)
+	if err != nil {
+		return err
+	}
+	extra := make(map[string]string, len(ao.Extra))
+	for k, v := range ao.Extra {
+		if !strings.HasPrefix(k, userdbPrefix) {
+			extra[k] = v
+		}
+	}
+	ao.Extra = extra
+	ao.Userdb = fields
+	return nil
+}
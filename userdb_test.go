@@ -0,0 +1,176 @@
+package dovecotsasl
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+)
+
+type testUserdb map[string]map[string]string
+
+func (db testUserdb) LookupUser(_ context.Context, _ *AuthReq, user string) (map[string]string, error) {
+	fields, ok := db[user]
+	if !ok {
+		return nil, ErrUserUnknown
+	}
+	return fields, nil
+}
+
+// prefetchPassdb adds userdb_* fields to results for "prefetch" user.
+type prefetchPassdb struct {
+	testPassdb
+}
+
+func (db prefetchPassdb) VerifyPlain(ctx context.Context, req *AuthReq, user, pass string) (*PassdbResult, error) {
+	res, err := db.testPassdb.VerifyPlain(ctx, req, user, pass)
+	if err == nil && user == "prefetch" {
+		res.Extra["userdb_home"] = "/home/prefetched"
+		res.Extra["userdb_uid"] = "1001"
+	}
+	return res, err
+}
+
+func TestUserdb(t *testing.T) {
+	userdb := testUserdb{
+		"foxcpp":   {"home": "/home/foxcpp", "uid": "1000"},
+		"prefetch": {"home": "/home/wrong"},
+	}
+
+	s := NewServer()
+	s.AddPassdbMechanisms(prefetchPassdb{testPassdb{"foxcpp": "1234", "prefetch": "1234", "nouserdb": "1234"}})
+	s.Userdb = PrefetchUserdb{Next: userdb}
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := cl.Do("imap", sasl.NewPlainClient("", "foxcpp", "1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Userdb["home"] != "/home/foxcpp" || res.Userdb["uid"] != "1000" || res.Extra["quota"] != "1G" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	res, err = cl.Do("imap", sasl.NewPlainClient("", "prefetch", "1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Userdb["home"] != "/home/prefetched" || res.Userdb["uid"] != "1001" {
+		t.Errorf("prefetched fields are not used: %+v", res)
+	}
+	if _, ok := res.Extra["userdb_home"]; ok {
+		t.Errorf("prefetched fields are left in extra fields: %+v", res)
+	}
+
+	if _, err := cl.Do("imap", sasl.NewPlainClient("", "nouserdb", "1234")); err == nil {
+		t.Errorf("expected an error for user missing in userdb")
+	}
+}
+
+func TestMasterUser(t *testing.T) {
+	s := NewMasterServer()
+	s.Userdb = PrefetchUserdb{Next: testUserdb{
+		"foxcpp":    {"home": "/home/foxcpp", "nologin": ""},
+		"canonical": {"user": "Canonical", "home": "/home/canonical"},
+	}}
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewMasterClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	fields, err := cl.LookupUser("foxcpp", "service=imap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["home"] != "/home/foxcpp" {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+	if _, ok := fields["nologin"]; !ok {
+		t.Errorf("flag field is lost: %v", fields)
+	}
+
+	fields, err = cl.LookupUser("canonical")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["user"] != "Canonical" {
+		t.Errorf("canonical username is not returned: %v", fields)
+	}
+
+	if _, err := cl.LookupUser("nobody"); !errors.Is(err, ErrUserUnknown) {
+		t.Errorf("expected unknown user, got %v", err)
+	}
+}
+
+// sharedExtraPassdb returns the same extra fields map for every request,
+// like backends caching their entries.
+type sharedExtraPassdb struct {
+	testPassdb
+	extra map[string]string
+}
+
+func (db sharedExtraPassdb) VerifyPlain(ctx context.Context, req *AuthReq, user, pass string) (*PassdbResult, error) {
+	res, err := db.testPassdb.VerifyPlain(ctx, req, user, pass)
+	if err != nil {
+		return nil, err
+	}
+	res.Extra = db.extra
+	return res, nil
+}
+
+func (db sharedExtraPassdb) LookupCredentials(ctx context.Context, req *AuthReq, user, scheme string) (*PassdbResult, error) {
+	res, err := db.testPassdb.LookupCredentials(ctx, req, user, scheme)
+	if err != nil {
+		return nil, err
+	}
+	res.Extra = db.extra
+	return res, nil
+}
+
+func TestBackendExtraNotModified(t *testing.T) {
+	extra := map[string]string{"quota": "1G", "userdb_home": "/home/foxcpp"}
+
+	s := NewServer()
+	s.AddPassdbMechanisms(sharedExtraPassdb{testPassdb{"foxcpp": "1234"}, extra})
+	s.Userdb = PrefetchUserdb{}
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mech := range []string{"PLAIN", "SCRAM-SHA-256"} {
+		saslCl, err := cl.mechClient(mech, Credentials{Username: "foxcpp", Password: "1234"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := cl.Do("imap", saslCl, ParamSecured(SecuredTLS))
+		if err != nil {
+			t.Fatalf("%s: %v", mech, err)
+		}
+		if res.Userdb["home"] != "/home/foxcpp" {
+			t.Errorf("%s: prefetched fields are not used: %+v", mech, res)
+		}
+	}
+	if len(extra) != 2 || extra["quota"] != "1G" || extra["userdb_home"] != "/home/foxcpp" {
+		t.Errorf("extra fields of the backend are modified: %v", extra)
+	}
+}
@@ -0,0 +1,158 @@
+package dovecotsasl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/foxcpp/go-dovecot-sasl/expand"
+	"golang.org/x/net/idna"
+)
+
+// DefaultUsernameChars is the default value of auth_username_chars in
+// Dovecot.
+const DefaultUsernameChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ01234567890.-_@"
+
+// UsernameNormalizer wraps a Passdb and canonicalizes usernames before
+// the lookup, similar to Dovecot's auth_username_* settings.
+//
+// Steps are applied in the following order:
+//  1. Translation is applied;
+//  2. Characters are checked against Chars;
+//  3. DefaultRealm is appended if the username has no domain part;
+//  4. Domain part is lowercased or converted to IDNA ASCII form;
+//  5. Format template is expanded.
+//
+// Rejected usernames are reported as ErrUserUnknown with the reason
+// describing the problem, so the client gets a regular authentication
+// failure.
+//
+// The normalized username is returned in PassdbResult.User unless the
+// backend returns its own canonical username.
+type UsernameNormalizer struct {
+	Passdb Passdb
+
+	// Allowed characters (auth_username_chars). If empty, all characters
+	// are allowed.
+	Chars string
+
+	// Character translation map (auth_username_translation), pairs of
+	// from and to characters, e.g. "#@/@" translates # and / into @.
+	Translation string
+
+	// Domain appended to usernames without one (auth_default_realm).
+	DefaultRealm string
+
+	// Lowercase the domain part.
+	LowercaseDomain bool
+
+	// Convert the domain part into IDNA ASCII form (xn--...), this also
+	// lowercases it. Usernames with invalid domains are rejected. Note
+	// that Chars should permit non-ASCII characters for this to be
+	// useful.
+	IDNADomain bool
+
+	// Template for the final username (auth_username_format), e.g. "%Lu"
+	// or "%Ln" to strip the domain. Empty leaves the username as is.
+	Format string
+}
+
+// NewUsernameNormalizer creates the normalizer with Dovecot defaults:
+// DefaultUsernameChars and "%Lu" format.
+func NewUsernameNormalizer(db Passdb) *UsernameNormalizer {
+	return &UsernameNormalizer{
+		Passdb: db,
+		Chars:  DefaultUsernameChars,
+		Format: "%Lu",
+	}
+}
+
+func invalidUsername(format string, args ...interface{}) error {
+	return &PassdbError{
+		Status: PassdbUserUnknown,
+		Reason: "invalid username: " + fmt.Sprintf(format, args...),
+	}
+}
+
+// Normalize returns the canonical form of user.
+func (n *UsernameNormalizer) Normalize(req *AuthReq, user string) (string, error) {
+	if user == "" {
+		return "", invalidUsername("empty username")
+	}
+	if n.Translation != "" {
+		from := []rune(n.Translation)
+		user = strings.Map(func(ch rune) rune {
+			for i := 0; i+1 < len(from); i += 2 {
+				if from[i] == ch {
+					return from[i+1]
+				}
+			}
+			return ch
+		}, user)
+	}
+
+	if n.Chars != "" {
+		for _, ch := range user {
+			if !strings.ContainsRune(n.Chars, ch) {
+				return "", invalidUsername("character %q is not allowed", ch)
+			}
+		}
+	}
+
+	if n.DefaultRealm != "" && !strings.Contains(user, "@") {
+		user += "@" + n.DefaultRealm
+	}
+
+	if at := strings.LastIndexByte(user, '@'); at != -1 {
+		local, domain := user[:at], user[at+1:]
+		if n.LowercaseDomain {
+			domain = strings.ToLower(domain)
+		}
+		if n.IDNADomain {
+			ascii, err := idna.Lookup.ToASCII(domain)
+			if err != nil {
+				return "", invalidUsername("malformed domain: %v", err)
+			}
+			domain = ascii
+		}
+		user = local + "@" + domain
+	}
+
+	if n.Format != "" {
+		user = expand.Expand(n.Format, req.Vars(user), nil)
+		if user == "" {
+			return "", invalidUsername("empty username after formatting")
+		}
+	}
+	return user, nil
+}
+
+// result sets the normalized username in res if the backend did not
+// return its own.
+func (n *UsernameNormalizer) result(user string, res *PassdbResult) *PassdbResult {
+	if res == nil || res.User != "" {
+		return res
+	}
+	// Copy the result since it may be shared (e.g. by a cache).
+	resCopy := *res
+	resCopy.User = user
+	return &resCopy
+}
+
+func (n *UsernameNormalizer) VerifyPlain(ctx context.Context, req *AuthReq, user, pass string) (*PassdbResult, error) {
+	user, err := n.Normalize(req, user)
+	if err != nil {
+		return nil, err
+	}
+	res, err := n.Passdb.VerifyPlain(ctx, req, user, pass)
+	return n.result(user, res), err
+}
+
+func (n *UsernameNormalizer) LookupCredentials(ctx context.Context, req *AuthReq, user, scheme string) (*PassdbResult, error) {
+	user, err := n.Normalize(req, user)
+	if err != nil {
+		return nil, err
+	}
+	res, err := n.Passdb.LookupCredentials(ctx, req, user, scheme)
+	return n.result(user, res), err
+}
@@ -0,0 +1,95 @@
+package dovecotsasl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+)
+
+func TestUsernameNormalizer(t *testing.T) {
+	cases := []struct {
+		name  string
+		setup func(n *UsernameNormalizer)
+		user  string
+		out   string
+		fail  bool
+	}{
+		{"default", nil, "FoxCpp@Example.ORG", "foxcpp@example.org", false},
+		{"disallowed char", nil, "fox cpp", "", true},
+		{"empty", nil, "", "", true},
+		{"translation", func(n *UsernameNormalizer) { n.Translation = "#@" }, "foxcpp#example.org", "foxcpp@example.org", false},
+		{"default realm", func(n *UsernameNormalizer) { n.DefaultRealm = "example.org" }, "foxcpp", "foxcpp@example.org", false},
+		{"realm not appended", func(n *UsernameNormalizer) { n.DefaultRealm = "example.org" }, "foxcpp@example.com", "foxcpp@example.com", false},
+		{"strip domain", func(n *UsernameNormalizer) { n.Format = "%Ln" }, "FoxCpp@example.org", "foxcpp", false},
+		{"lowercase domain", func(n *UsernameNormalizer) {
+			n.Format = ""
+			n.LowercaseDomain = true
+		}, "FoxCpp@Example.ORG", "FoxCpp@example.org", false},
+		{"idna", func(n *UsernameNormalizer) {
+			n.Chars = ""
+			n.Format = ""
+			n.IDNADomain = true
+		}, "FoxCpp@Bücher.example", "FoxCpp@xn--bcher-kva.example", false},
+		{"idna invalid", func(n *UsernameNormalizer) {
+			n.Chars = ""
+			n.IDNADomain = true
+		}, "foxcpp@exa mple.org", "", true},
+	}
+	for _, c := range cases {
+		n := NewUsernameNormalizer(nil)
+		if c.setup != nil {
+			c.setup(n)
+		}
+		out, err := n.Normalize(nil, c.user)
+		if c.fail {
+			if !errors.Is(err, ErrUserUnknown) {
+				t.Errorf("%s: expected ErrUserUnknown, got %q, %v", c.name, out, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if out != c.out {
+			t.Errorf("%s: got %q, want %q", c.name, out, c.out)
+		}
+	}
+}
+
+func TestUsernameNormalizerAuth(t *testing.T) {
+	s := NewServer()
+	n := NewUsernameNormalizer(testPassdb{"foxcpp@example.org": "1234"})
+	n.DefaultRealm = "example.org"
+	s.AddPassdbMechanisms(n)
+	defer s.Close()
+
+	l := testListener(t)
+	go s.Serve(l)
+
+	cl, err := NewClient(testDial(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []string{"foxcpp", "FoxCpp@EXAMPLE.org"} {
+		res, err := cl.Do("imap", sasl.NewPlainClient("", user, "1234"))
+		if err != nil {
+			t.Errorf("%s: %v", user, err)
+			continue
+		}
+		if res.UserID != "foxcpp@example.org" {
+			t.Errorf("%s: normalized username is not returned: %s", user, res.UserID)
+		}
+	}
+
+	_, err = cl.Do("imap", sasl.NewPlainClient("", "fox/cpp", "1234"))
+	var af AuthFail
+	if !errors.As(err, &af) {
+		t.Fatalf("expected authentication failure, got %v", err)
+	}
+	if af.Code != "" {
+		t.Errorf("unexpected failure code: %v", af.Code)
+	}
+}